@@ -33,6 +33,40 @@ func main() {
 	service.REDIS = redis
 	service.DB = db
 
+	keyringFile := os.Getenv("KEYRING_FILE")
+	signingKeyFile := os.Getenv("SIGNING_KEY_FILE")
+	if len(keyringFile) > 0 {
+		keyring, err := service.LoadKeyring(keyringFile)
+		if err != nil {
+			log.Fatal("Failed to load keyring: ", err)
+		}
+		service.KEYRING = keyring
+	} else if len(signingKeyFile) > 0 {
+		signer, err := service.LoadSigningKey(os.Getenv("SIGNING_ALG"), signingKeyFile)
+		if err != nil {
+			log.Fatal("Failed to load signing key: ", err)
+		}
+		service.KEYRING = service.NewKeyring(signer)
+	}
+
+	err = service.CheckOpenIDProvider()
+	if err != nil {
+		log.Print(err, ", ID tokens will not be issued")
+	}
+
+	smtpAddress := os.Getenv("SMTP_ADDRESS")
+	if len(smtpAddress) > 0 {
+		service.MAILER = &service.SMTPMailer{
+			Address:  smtpAddress,
+			From:     os.Getenv("SMTP_FROM"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+		}
+	} else {
+		log.Print("SMTP_ADDRESS not set, email will not be delivered")
+		service.MAILER = &service.MemoryMailer{}
+	}
+
 	port := os.Getenv("PORT")
 	if len(port) == 0 {
 		port = "3000"
@@ -0,0 +1,165 @@
+package service
+
+import (
+	"errors"
+	"time"
+)
+
+//Account states, suspensions always end while bans only end when given an end
+const (
+	AccountActive    = "active"
+	AccountSuspended = "suspended"
+	AccountBanned    = "banned"
+)
+
+//Audit event types for account states
+const (
+	AuditUserSuspended   = "user.suspended"
+	AuditUserUnsuspended = "user.unsuspended"
+	AuditUserBanned      = "user.banned"
+	AuditUserUnbanned    = "user.unbanned"
+)
+
+//AccountStatus is the state of a users account with the reason and the
+//moderator who set it
+type AccountStatus struct {
+	State     string    `json:"state"`
+	Reason    string    `json:"reason,omitempty"`
+	ActorID   uint      `json:"actor_id,omitempty"`
+	Until     time.Time `json:"until"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+//AccountStatusError is returned when a suspended or banned user signs in, it
+//is sent to the user so it leaves out the moderator
+type AccountStatusError struct {
+	Message string `json:"message"`
+	AccountStatus
+}
+
+func (e *AccountStatusError) Error() string {
+	return e.Message
+}
+
+//ErrAccountDeleted is returned when a deleted user signs in
+var ErrAccountDeleted = errors.New("Account has been deleted")
+
+//current is the status now, suspensions and bans lift once their end passed
+func (s AccountStatus) current() AccountStatus {
+	if s.State == "" || s.State == AccountActive {
+		return AccountStatus{State: AccountActive}
+	}
+	if !s.Until.IsZero() && !time.Now().Before(s.Until) {
+		return AccountStatus{State: AccountActive}
+	}
+	return s
+}
+
+func (s AccountStatus) isActive() bool {
+	return s.current().State == AccountActive
+}
+
+//public is the status without the moderator, as shown to the user
+func (s AccountStatus) public() AccountStatus {
+	s.ActorID = 0
+	return s
+}
+
+func newAccountStatusError(status AccountStatus) *AccountStatusError {
+	message := "Account is " + status.State
+	if !status.Until.IsZero() {
+		message += " until " + status.Until.UTC().Format(time.RFC3339)
+	}
+	return &AccountStatusError{Message: message, AccountStatus: status.public()}
+}
+
+//checkAccountActive refuses users that were deleted, or are suspended or banned
+func checkAccountActive(user User) error {
+	if !user.DeletedAt.IsZero() {
+		return ErrAccountDeleted
+	}
+	status := user.Status.current()
+	if status.State != AccountActive {
+		return newAccountStatusError(status)
+	}
+	return nil
+}
+
+//SuspendUser keeps a user from signing in or using their tokens until the
+//suspension ends. Their sessions work again afterwards.
+func SuspendUser(actorID, userID uint, reason string, until time.Time, database Database) error {
+	if until.IsZero() {
+		return errors.New("Suspensions need an end")
+	}
+	return restrictUser(actorID, userID, AccountStatus{State: AccountSuspended, Reason: reason, ActorID: actorID, Until: until}, AuditUserSuspended, database)
+}
+
+//BanUser keeps a user from signing in or using their tokens, for good when
+//until is zero
+func BanUser(actorID, userID uint, reason string, until time.Time, database Database) error {
+	return restrictUser(actorID, userID, AccountStatus{State: AccountBanned, Reason: reason, ActorID: actorID, Until: until}, AuditUserBanned, database)
+}
+
+//UnsuspendUser ends a suspension early
+func UnsuspendUser(actorID, userID uint, database Database) error {
+	return liftRestriction(actorID, userID, AccountSuspended, AuditUserUnsuspended, database)
+}
+
+//UnbanUser lifts a ban
+func UnbanUser(actorID, userID uint, database Database) error {
+	return liftRestriction(actorID, userID, AccountBanned, AuditUserUnbanned, database)
+}
+
+//restrictUser sets a suspension or ban. Token keys cached in redis are
+//dropped so services reading the cache stop accepting them.
+func restrictUser(actorID, userID uint, status AccountStatus, event string, database Database) error {
+	if actorID == userID {
+		return errors.New("Admins can not suspend or ban themselves")
+	}
+	if !status.Until.IsZero() && !status.Until.After(time.Now()) {
+		return errors.New("The end must be in the future")
+	}
+	user, err := database.getUserByID(userID)
+	if err != nil || !user.DeletedAt.IsZero() {
+		return errors.New("User not found")
+	}
+	err = database.setAccountStatus(userID, status)
+	if err != nil {
+		return err
+	}
+	keys, err := database.getUserTokenKeys(userID)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		database.redisDeleteValue(key)
+	}
+	detail := status.Reason
+	if !status.Until.IsZero() {
+		detail = "until " + status.Until.UTC().Format(time.RFC3339) + ": " + detail
+	}
+	audit(AuditEvent{Type: event, UserID: userID, ActorID: actorID, Detail: detail})
+	return nil
+}
+
+//liftRestriction makes the account active if it is in state. Lifting a
+//restriction that already ended is not audited.
+func liftRestriction(actorID, userID uint, state, event string, database Database) error {
+	user, err := database.getUserByID(userID)
+	if err != nil {
+		return errors.New("User not found")
+	}
+	current := user.Status.current()
+	if current.State == AccountActive {
+		return nil
+	}
+	if current.State != state {
+		return errors.New("User is not " + state)
+	}
+	err = database.setAccountStatus(userID, AccountStatus{State: AccountActive, ActorID: actorID})
+	if err != nil {
+		return err
+	}
+	audit(AuditEvent{Type: event, UserID: userID, ActorID: actorID})
+	return nil
+}
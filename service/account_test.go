@@ -0,0 +1,141 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSuspendUser(t *testing.T) {
+	database, _ := adminTestDatabase(t)
+	auditor := &MemoryAuditor{}
+	AUDITOR = auditor
+	defer func() { AUDITOR = LogAuditor{} }()
+	tokens, _ := UserLogin("Testname", "testpassword", database)
+
+	until := time.Now().Add(time.Hour)
+	if err := SuspendUser(1, 1, "spam", until, database); err == nil {
+		t.Error("Admins should not suspend themselves")
+	}
+	if err := SuspendUser(1, 2, "spam", time.Time{}, database); err == nil {
+		t.Error("Suspensions should need an end")
+	}
+	if err := SuspendUser(1, 2, "spam", until, database); err != nil {
+		t.Fatalf("Failed to suspend user: %v", err)
+	}
+	if len(auditor.Events) != 1 || auditor.Events[0].Type != AuditUserSuspended || auditor.Events[0].ActorID != 1 {
+		t.Errorf("Expected the suspension to be audited; got %+v", auditor.Events)
+	}
+
+	_, err := UserLogin("Testname", "testpassword", database)
+	statusErr, ok := err.(*AccountStatusError)
+	if !ok || statusErr.State != AccountSuspended || statusErr.Reason != "spam" || statusErr.ActorID != 0 {
+		t.Errorf("Expected suspended login to fail with the reason; got %v", err)
+	}
+	validation := ValidateTokenKey(tokens.Key, database)
+	if validation.Status != TokenStatusSuspended || validation.Account == nil || validation.Account.Until.Unix() != until.Unix() {
+		t.Errorf("Expected the token to be suspended; got %+v", validation)
+	}
+	if _, err = RefreshTokens(tokens.RefreshToken, database); err == nil {
+		t.Error("Suspended users should not refresh their tokens")
+	}
+
+	UnsuspendUser(1, 2, database)
+	if ValidateTokenKey(tokens.Key, database).Status != TokenStatusValid {
+		t.Error("Tokens should work again once the suspension is lifted")
+	}
+	if _, err = RefreshTokens(tokens.RefreshToken, database); err != nil {
+		t.Errorf("Expected refresh after the suspension; got %v", err)
+	}
+}
+
+func TestBanUser(t *testing.T) {
+	database, _ := adminTestDatabase(t)
+	tokens, _ := UserLogin("Testname", "testpassword", database)
+
+	if err := BanUser(1, 2, "abuse", time.Now().Add(-time.Minute), database); err == nil {
+		t.Error("Bans should not end in the past")
+	}
+	if err := BanUser(1, 2, "abuse", time.Time{}, database); err != nil {
+		t.Fatalf("Failed to ban user: %v", err)
+	}
+	if ValidateTokenKey(tokens.Key, database).Status != TokenStatusBanned {
+		t.Error("Expected the token to be banned")
+	}
+	if err := UnsuspendUser(1, 2, database); err == nil {
+		t.Error("Unsuspending should not lift a ban")
+	}
+	if err := UnbanUser(1, 2, database); err != nil {
+		t.Errorf("Failed to unban user: %v", err)
+	}
+	if _, err := UserLogin("Testname", "testpassword", database); err != nil {
+		t.Errorf("Expected login after the ban was lifted; got %v", err)
+	}
+}
+
+func TestTemporaryBanLifts(t *testing.T) {
+	database, _ := adminTestDatabase(t)
+	tokens, _ := UserLogin("Testname", "testpassword", database)
+	BanUser(1, 2, "abuse", time.Now().Add(time.Hour), database)
+	if ValidateTokenKey(tokens.Key, database).Status != TokenStatusBanned {
+		t.Fatal("Expected the token to be banned")
+	}
+
+	database.users[1].Status.Until = time.Now().Add(-time.Second)
+	if ValidateTokenKey(tokens.Key, database).Status != TokenStatusValid {
+		t.Error("Expected the ban to lift once it ended")
+	}
+	if _, err := UserLogin("Testname", "testpassword", database); err != nil {
+		t.Errorf("Expected login after the ban ended; got %v", err)
+	}
+}
+
+func TestRestrictUserHandlers(t *testing.T) {
+	database, adminTokens := adminTestDatabase(t)
+	server := MakeTestServer(database)
+	tokens, _ := UserLogin("Testname", "testpassword", database)
+
+	restrict := func(path, body string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest("POST", path, bytes.NewBufferString(body))
+		request.Header.Set("Authorization", "Bearer "+adminTokens.Key)
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, request)
+		return recorder
+	}
+	if recorder := restrict("/admin/users/2/suspend", `{"duration": 3600}`); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected a reason to be required; received %v", recorder.Code)
+	}
+	if recorder := restrict("/admin/users/2/suspend", `{"reason": "spam", "duration": 3600}`); recorder.Code != http.StatusOK {
+		t.Fatalf("Expected %v; received %v %s", http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+
+	recorder := bearerRequest(server, "GET", "/auth/token/"+tokens.Key, "", "")
+	var validation TokenValidation
+	json.Unmarshal(recorder.Body.Bytes(), &validation)
+	if recorder.Code != http.StatusUnauthorized || validation.Status != TokenStatusSuspended || validation.Account.Reason != "spam" {
+		t.Errorf("Expected the validator to explain the suspension; got %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	body, _ := json.Marshal(map[string]string{"username": "Testname", "password": "testpassword"})
+	request, _ := http.NewRequest("POST", "/auth/login", bytes.NewBuffer(body))
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, request)
+	var statusErr AccountStatusError
+	json.Unmarshal(recorder.Body.Bytes(), &statusErr)
+	if recorder.Code != http.StatusForbidden || statusErr.State != AccountSuspended || statusErr.Until.IsZero() {
+		t.Errorf("Expected login to explain the suspension; got %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	if recorder := restrict("/admin/users/2/ban", `{"reason": "abuse"}`); recorder.Code != http.StatusOK {
+		t.Errorf("Expected %v; received %v", http.StatusOK, recorder.Code)
+	}
+	if recorder := restrict("/admin/users/2/unban", ``); recorder.Code != http.StatusOK {
+		t.Errorf("Expected %v; received %v", http.StatusOK, recorder.Code)
+	}
+	if ValidateTokenKey(tokens.Key, database).Status != TokenStatusValid {
+		t.Error("Expected the token to work after the ban was lifted")
+	}
+}
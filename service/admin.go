@@ -0,0 +1,151 @@
+package service
+
+import "errors"
+
+//Audit event types for the admin API
+const (
+	AuditUserDeleted       = "user.deleted"
+	AuditUserRestored      = "user.restored"
+	AuditUserPasswordReset = "user.password_reset"
+	AuditUserTokensRevoked = "user.tokens_revoked"
+)
+
+//User search page sizes
+const (
+	defaultUserSearchLimit = 50
+	maxUserSearchLimit     = 200
+)
+
+//UserDetail is a user as shown by the admin API
+type UserDetail struct {
+	User
+	Roles      []string  `json:"roles"`
+	MFAMethods []string  `json:"mfa_methods"`
+	Sessions   []Session `json:"sessions"`
+}
+
+//SearchUsers finds users, deleted ones included, whose username or email contains the query
+func SearchUsers(query string, limit, offset int, database Database) ([]User, error) {
+	if limit <= 0 {
+		limit = defaultUserSearchLimit
+	}
+	if limit > maxUserSearchLimit {
+		limit = maxUserSearchLimit
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	users, err := database.searchUsers(query, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	found := []User{}
+	for _, user := range users {
+		user.Password = ""
+		user.Status = user.Status.current()
+		found = append(found, user)
+	}
+	return found, nil
+}
+
+//GetUserDetail returns a user with their roles, second factors and active sessions
+func GetUserDetail(userID uint, database Database) (UserDetail, error) {
+	user, err := database.getUserByID(userID)
+	if err != nil {
+		return UserDetail{}, errors.New("User not found")
+	}
+	user.Password = ""
+	user.Status = user.Status.current()
+	roles, err := UserRoles(userID, database)
+	if err != nil {
+		return UserDetail{}, err
+	}
+	sessions, err := database.getSessionsByUserID(userID)
+	if err != nil {
+		return UserDetail{}, err
+	}
+	if sessions == nil {
+		sessions = []Session{}
+	}
+	methods := mfaMethods(userID, database)
+	if methods == nil {
+		methods = []string{}
+	}
+	return UserDetail{User: user, Roles: roles, MFAMethods: methods, Sessions: sessions}, nil
+}
+
+//DeleteUser soft deletes a user, they can no longer sign in or be found by username or email
+func DeleteUser(actorID, userID uint, database Database) error {
+	return setUserDeleted(actorID, userID, true, AuditUserDeleted, database)
+}
+
+//RestoreUser undoes DeleteUser
+func RestoreUser(actorID, userID uint, database Database) error {
+	return setUserDeleted(actorID, userID, false, AuditUserRestored, database)
+}
+
+//setUserDeleted deletes or restores a user. Deleting signs the user out,
+//changes that were already made are not audited again.
+func setUserDeleted(actorID, userID uint, deleted bool, event string, database Database) error {
+	if deleted && actorID == userID {
+		return errors.New("Admins can not delete themselves")
+	}
+	_, err := database.getUserByID(userID)
+	if err != nil {
+		return errors.New("User not found")
+	}
+	changed, err := database.deleteUser(userID, deleted)
+	if err != nil || !changed {
+		return err
+	}
+	if deleted {
+		err = revokeUserTokens(userID, database)
+		if err != nil {
+			return err
+		}
+	}
+	audit(AuditEvent{Type: event, UserID: userID, ActorID: actorID})
+	return nil
+}
+
+//ForcePasswordReset replaces the users password with a random one, signs
+//them out everywhere and emails them a reset link
+func ForcePasswordReset(actorID, userID uint, database Database) error {
+	user, err := database.getUserByID(userID)
+	if err != nil || !user.DeletedAt.IsZero() {
+		return errors.New("User not found")
+	}
+	password, err := randomString(32)
+	if err != nil {
+		return err
+	}
+	locked := User{ID: userID, Password: password}
+	err = locked.hashPassword()
+	if err != nil {
+		return err
+	}
+	err = database.updateUserPassword(userID, locked.Password)
+	if err != nil {
+		return err
+	}
+	err = revokeUserTokens(userID, database)
+	if err != nil {
+		return err
+	}
+	audit(AuditEvent{Type: AuditUserPasswordReset, UserID: userID, ActorID: actorID})
+	return sendPasswordReset(user, database)
+}
+
+//RevokeAllTokens signs a user out of every session
+func RevokeAllTokens(actorID, userID uint, database Database) error {
+	_, err := database.getUserByID(userID)
+	if err != nil {
+		return errors.New("User not found")
+	}
+	err = revokeUserTokens(userID, database)
+	if err != nil {
+		return err
+	}
+	audit(AuditEvent{Type: AuditUserTokensRevoked, UserID: userID, ActorID: actorID})
+	return nil
+}
@@ -0,0 +1,121 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func adminTestDatabase(t *testing.T) (*testDatabase, LoginResult) {
+	database := &testDatabase{}
+	admin := User{Username: "Adminname", Password: "adminpassword", Email: "admin@mail.com"}
+	admin.Save(database)
+	saveTestUser(database)
+	database.addUserRole(admin.ID, RoleAdmin, 0)
+	adminTokens, err := UserLogin("Adminname", "adminpassword", database)
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	return database, adminTokens
+}
+
+func TestDeleteUser(t *testing.T) {
+	database, _ := adminTestDatabase(t)
+	auditor := &MemoryAuditor{}
+	AUDITOR = auditor
+	defer func() { AUDITOR = LogAuditor{} }()
+	tokens, _ := UserLogin("Testname", "testpassword", database)
+
+	if err := DeleteUser(1, 1, database); err == nil {
+		t.Error("Admins should not delete themselves")
+	}
+	if err := DeleteUser(1, 2, database); err != nil {
+		t.Fatalf("Failed to delete user: %v", err)
+	}
+	if ValidateTokenKey(tokens.Key, database).Status != TokenStatusRevoked {
+		t.Error("Deleting should sign the user out")
+	}
+	if err := DeleteUser(1, 2, database); err != nil || len(auditor.Events) != 1 {
+		t.Errorf("Deleting twice should succeed without a second audit event; got %v", err)
+	}
+	if _, err := UserLogin("Testname", "testpassword", database); err == nil {
+		t.Error("Deleted users should not sign in")
+	}
+	if _, err := database.getUserByEmail("test@mail.com"); err == nil {
+		t.Error("Deleted users should not be found by email")
+	}
+	users, _ := SearchUsers("test", 0, 0, database)
+	if len(users) != 1 || users[0].DeletedAt.IsZero() || users[0].Password != "" {
+		t.Errorf("Expected search to include the deleted user without the password hash; got %+v", users)
+	}
+	RestoreUser(1, 2, database)
+	if _, err := UserLogin("Testname", "testpassword", database); err != nil {
+		t.Errorf("Expected login after restoring; got %v", err)
+	}
+	if len(auditor.Events) != 2 || auditor.Events[1].Type != AuditUserRestored || auditor.Events[1].ActorID != 1 {
+		t.Errorf("Expected the moderation to be audited; got %+v", auditor.Events)
+	}
+}
+
+func TestForcePasswordReset(t *testing.T) {
+	database, _ := adminTestDatabase(t)
+	mailer := &MemoryMailer{}
+	MAILER = mailer
+	defer func() { MAILER = nil }()
+	tokens, _ := UserLogin("Testname", "testpassword", database)
+
+	err := ForcePasswordReset(1, 2, database)
+	if err != nil {
+		t.Fatalf("Failed to force password reset: %v", err)
+	}
+	if _, err = UserLogin("Testname", "testpassword", database); err == nil {
+		t.Error("The old password should stop working")
+	}
+	if ValidateTokenKey(tokens.Key, database).Status != TokenStatusRevoked {
+		t.Error("Forcing a password reset should sign the user out")
+	}
+	if _, ok := mailer.Last("test@mail.com"); !ok || len(database.resets) != 1 {
+		t.Error("Expected a reset link to be emailed")
+	}
+}
+
+func TestAdminHandlers(t *testing.T) {
+	database, adminTokens := adminTestDatabase(t)
+	server := MakeTestServer(database)
+	tokens, _ := UserLogin("Testname", "testpassword", database)
+
+	recorder := bearerRequest(server, "GET", "/admin/users?q=name", tokens.Key, "")
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected %v; received %v", http.StatusForbidden, recorder.Code)
+	}
+	recorder = bearerRequest(server, "GET", "/admin/users?q=name&limit=1&offset=1", adminTokens.Key, "")
+	var users []User
+	json.Unmarshal(recorder.Body.Bytes(), &users)
+	if recorder.Code != http.StatusOK || len(users) != 1 || users[0].Username != "Testname" {
+		t.Errorf("Unexpected search result %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = bearerRequest(server, "GET", "/admin/users/2", adminTokens.Key, "")
+	var detail UserDetail
+	json.Unmarshal(recorder.Body.Bytes(), &detail)
+	if recorder.Code != http.StatusOK || detail.Username != "Testname" || len(detail.Sessions) != 1 || len(detail.Roles) != 1 {
+		t.Errorf("Unexpected user detail %d %s", recorder.Code, recorder.Body.String())
+	}
+	recorder = bearerRequest(server, "GET", "/admin/users/42", adminTokens.Key, "")
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected %v; received %v", http.StatusNotFound, recorder.Code)
+	}
+
+	recorder = bearerRequest(server, "POST", "/admin/users/2/revoke-tokens", adminTokens.Key, "")
+	if recorder.Code != http.StatusOK || ValidateTokenKey(tokens.Key, database).Status != TokenStatusRevoked {
+		t.Errorf("Expected the users tokens to be revoked; received %v", recorder.Code)
+	}
+	recorder = bearerRequest(server, "POST", "/admin/users/2/unsuspend", tokens.Key, "")
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected %v; received %v", http.StatusUnauthorized, recorder.Code)
+	}
+	recorder = bearerRequest(server, "DELETE", "/admin/users/1", adminTokens.Key, "")
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected admins not to delete themselves; received %v", recorder.Code)
+	}
+}
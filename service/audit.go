@@ -0,0 +1,65 @@
+package service
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+//AUDITOR records security events throughout the service
+var AUDITOR Auditor = LogAuditor{}
+
+//Audit event types
+const (
+	AuditLoginLockout = "login.lockout"
+)
+
+//AuditEvent is a security relevant action
+type AuditEvent struct {
+	Type     string    `json:"type"`
+	UserID   uint      `json:"user_id,omitempty"`
+	Username string    `json:"username,omitempty"`
+	IP       string    `json:"ip,omitempty"`
+	ActorID  uint      `json:"actor_id,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+//Auditor records audit events
+type Auditor interface {
+	Record(event AuditEvent)
+}
+
+//LogAuditor writes audit events to the log as JSON
+type LogAuditor struct{}
+
+//MemoryAuditor keeps audit events in memory, for tests
+type MemoryAuditor struct {
+	mu     sync.Mutex
+	Events []AuditEvent
+}
+
+//Record logs the event
+func (LogAuditor) Record(event AuditEvent) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	log.Print("audit: ", string(line))
+}
+
+//Record keeps the event
+func (m *MemoryAuditor) Record(event AuditEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Events = append(m.Events, event)
+}
+
+func audit(event AuditEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	AUDITOR.Record(event)
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+//The subset of CBOR (RFC 7049) used by WebAuthn attestation objects and COSE
+//keys. Integers decode to int64, byte strings to []byte, text to string,
+//arrays to []interface{} and maps to map[interface{}]interface{}.
+
+const cborMaxDepth = 16
+
+var errCBORInvalid = errors.New("Invalid CBOR data")
+
+//decodeCBOR decodes the first item in data and returns the bytes after it
+func decodeCBOR(data []byte) (interface{}, []byte, error) {
+	return decodeCBORItem(data, 0)
+}
+
+func decodeCBORItem(data []byte, depth int) (interface{}, []byte, error) {
+	if len(data) == 0 || depth > cborMaxDepth {
+		return nil, nil, errCBORInvalid
+	}
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, data[1:], nil
+		case 21:
+			return true, data[1:], nil
+		case 22:
+			return nil, data[1:], nil
+		}
+		return nil, nil, errCBORInvalid
+	}
+	value, rest, err := decodeCBORLength(info, data[1:])
+	if err != nil {
+		return nil, nil, err
+	}
+	switch major {
+	case 0, 1:
+		if value > 1<<63-1 {
+			return nil, nil, errCBORInvalid
+		}
+		if major == 1 {
+			return -1 - int64(value), rest, nil
+		}
+		return int64(value), rest, nil
+	case 2, 3:
+		if value > uint64(len(rest)) {
+			return nil, nil, errCBORInvalid
+		}
+		if major == 3 {
+			return string(rest[:value]), rest[value:], nil
+		}
+		return rest[:value], rest[value:], nil
+	case 4:
+		if value > uint64(len(rest)) {
+			return nil, nil, errCBORInvalid
+		}
+		items := make([]interface{}, value)
+		for i := range items {
+			items[i], rest, err = decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		return items, rest, nil
+	case 5:
+		if value > uint64(len(rest)) {
+			return nil, nil, errCBORInvalid
+		}
+		items := make(map[interface{}]interface{}, value)
+		for i := uint64(0); i < value; i++ {
+			var key, item interface{}
+			key, rest, err = decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errCBORInvalid
+			}
+			item, rest, err = decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items[key] = item
+		}
+		return items, rest, nil
+	}
+	return nil, nil, errCBORInvalid
+}
+
+//decodeCBORLength reads the argument of an item, indefinite lengths are not supported
+func decodeCBORLength(info byte, data []byte) (uint64, []byte, error) {
+	switch {
+	case info < 24:
+		return uint64(info), data, nil
+	case info == 24 && len(data) >= 1:
+		return uint64(data[0]), data[1:], nil
+	case info == 25 && len(data) >= 2:
+		return uint64(binary.BigEndian.Uint16(data)), data[2:], nil
+	case info == 26 && len(data) >= 4:
+		return uint64(binary.BigEndian.Uint32(data)), data[4:], nil
+	case info == 27 && len(data) >= 8:
+		return binary.BigEndian.Uint64(data), data[8:], nil
+	}
+	return 0, nil, errCBORInvalid
+}
@@ -0,0 +1,99 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+//Claims signed into every token key. The subject is the user id, or the
+//client id for tokens issued to a client on its own behalf. Roles are only
+//signed into tokens the user got directly, not those issued to a client.
+type Claims struct {
+	User     uint     `json:"user"`
+	Kind     string   `json:"kind,omitempty"`
+	ClientID string   `json:"client_id,omitempty"`
+	Scope    string   `json:"scope,omitempty"`
+	Roles    []string `json:"roles,omitempty"`
+	jwt.StandardClaims
+}
+
+func newClaims(token Token) (Claims, error) {
+	jti, err := randomString(16)
+	if err != nil {
+		return Claims{}, err
+	}
+	subject := strconv.FormatUint(uint64(token.UserID), 10)
+	if token.isClient() {
+		subject = token.ClientID
+	}
+	now := time.Now().Unix()
+	claims := Claims{
+		User:     token.UserID,
+		Kind:     token.Kind,
+		ClientID: token.ClientID,
+		Scope:    token.Scope,
+		Roles:    token.Roles,
+		StandardClaims: jwt.StandardClaims{
+			Id:        jti,
+			Subject:   subject,
+			Issuer:    getIssuer(),
+			Audience:  getAudience(),
+			IssuedAt:  now,
+			NotBefore: now,
+			ExpiresAt: token.ExpiresAt,
+		},
+	}
+	return claims, nil
+}
+
+func generateKey(token Token) (string, error) {
+	claims, err := newClaims(token)
+	if err != nil {
+		return "", err
+	}
+	return currentKeyring().sign(claims)
+}
+
+//VerifyKey checks the signature and claims of a token key without a database lookup.
+//Revocation is not checked, use ValidateTokenKey for that.
+func VerifyKey(key string) (Claims, error) {
+	var claims Claims
+	_, err := jwt.ParseWithClaims(key, &claims, currentKeyring().verificationKey)
+	if err != nil {
+		return Claims{}, err
+	}
+	if !claims.VerifyIssuer(getIssuer(), true) {
+		return Claims{}, errors.New("Token has an invalid issuer")
+	}
+	if !claims.VerifyAudience(getAudience(), true) {
+		return Claims{}, errors.New("Token has an invalid audience")
+	}
+	subject := strconv.FormatUint(uint64(claims.User), 10)
+	if claims.Kind == TokenKindClient {
+		subject = claims.ClientID
+	}
+	if claims.Subject != subject {
+		return Claims{}, errors.New("Token has an invalid subject")
+	}
+	return claims, nil
+}
+
+func getIssuer() string {
+	issuer := os.Getenv("TOKEN_ISSUER")
+	if issuer == "" {
+		issuer = "chat-auth"
+	}
+	return issuer
+}
+
+func getAudience() string {
+	audience := os.Getenv("TOKEN_AUDIENCE")
+	if audience == "" {
+		audience = "chat"
+	}
+	return audience
+}
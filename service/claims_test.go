@@ -0,0 +1,68 @@
+package service
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestGenerateKeyClaims(t *testing.T) {
+	expiresAt := time.Now().Add(time.Hour).Unix()
+	key, err := generateKey(Token{UserID: 1, ExpiresAt: expiresAt})
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	claims, err := VerifyKey(key)
+	if err != nil {
+		t.Fatalf("Expected key to verify, got %v", err)
+	}
+	if claims.User != 1 || claims.Subject != "1" {
+		t.Error("Expected user and subject claims to be set")
+	}
+	if claims.ExpiresAt != expiresAt || claims.IssuedAt == 0 || claims.NotBefore == 0 {
+		t.Error("Expected exp, iat and nbf claims to be set")
+	}
+	if claims.Id == "" || claims.Issuer != getIssuer() || claims.Audience != getAudience() {
+		t.Error("Expected jti, iss and aud claims to be set")
+	}
+
+	other, _ := generateKey(Token{UserID: 1, ExpiresAt: expiresAt})
+	if other == key {
+		t.Error("Expected keys to be unique")
+	}
+}
+
+func TestVerifyKeyInvalid(t *testing.T) {
+	expired, _ := generateKey(Token{UserID: 1, ExpiresAt: time.Now().AddDate(0, 0, -1).Unix()})
+	if _, err := VerifyKey(expired); err == nil {
+		t.Error("Expected expired key to fail verification")
+	}
+
+	if _, err := VerifyKey("not a key"); err == nil {
+		t.Error("Expected malformed key to fail verification")
+	}
+
+	valid, _ := generateKey(Token{UserID: 1, ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	os.Setenv("SECRET_KEY", "another secret")
+	_, err := VerifyKey(valid)
+	os.Unsetenv("SECRET_KEY")
+	if err == nil {
+		t.Error("Expected key signed with another secret to fail verification")
+	}
+
+	os.Setenv("TOKEN_AUDIENCE", "presence")
+	_, err = VerifyKey(valid)
+	os.Unsetenv("TOKEN_AUDIENCE")
+	if err == nil {
+		t.Error("Expected key for another audience to fail verification")
+	}
+
+	claims, _ := newClaims(Token{UserID: 1, ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	none, _ := jwt.NewWithClaims(jwt.SigningMethodNone, claims).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if _, err := VerifyKey(none); err == nil {
+		t.Error("Expected unsigned key to fail verification")
+	}
+}
@@ -2,10 +2,10 @@ package service
 
 import (
 	"database/sql"
-	"fmt"
+	"strings"
 	"time"
 
-	_ "github.com/lib/pq" // needed
+	"github.com/lib/pq"
 )
 
 var DB *sql.DB
@@ -14,17 +14,72 @@ type Database interface {
 	addToken(token *Token) error
 	addUser(user *User) (uint, error)
 	getUserByUsername(username string) (User, error)
+	getUserByID(id uint) (User, error)
+	getUserByEmail(email string) (User, error)
+	updateUserPassword(userID uint, password string) error
+	updateUsername(userID uint, username string) error
+	changeUserEmail(userID uint, previous, email string) (bool, error)
+	verifyUserEmail(userID uint, email string) (bool, error)
+	searchUsers(query string, limit, offset int) ([]User, error)
+	setAccountStatus(userID uint, status AccountStatus) error
+	deleteUser(userID uint, deleted bool) (bool, error)
 	getTokenByKey(key string) (Token, error)
 	getTokenByUserID(userID uint) (Token, error)
+	revokeToken(key string) error
+	revokeTokenFamily(familyID string) ([]string, error)
+	revokeUserTokens(userID uint) ([]string, error)
+	getUserTokenKeys(userID uint) ([]string, error)
+	revokeOtherUserTokens(userID uint, keepFamilyID string) ([]string, error)
+	addSession(session *Session) error
+	getSessionByID(id uint) (Session, error)
+	getSessionsByUserID(userID uint) ([]Session, error)
+	touchSession(familyID string) error
+	addRefreshToken(refreshToken *RefreshToken) error
+	getRefreshTokenByHash(hash string) (RefreshToken, error)
+	rotateRefreshToken(hash string) (bool, error)
+	addClient(client *Client) (uint, error)
+	getClientByClientID(clientID string) (Client, error)
+	addAuthorizationCode(code *AuthorizationCode) error
+	getAuthorizationCodeByHash(hash string) (AuthorizationCode, error)
+	useAuthorizationCode(hash string) (bool, error)
+	getConsent(userID uint, clientID string) (Consent, error)
+	saveConsent(consent *Consent) error
+	addPasswordReset(reset *PasswordReset) error
+	getPasswordResetByHash(hash string) (PasswordReset, error)
+	usePasswordReset(hash string) (bool, error)
+	usePasswordResets(userID uint) error
+	saveTOTP(totp *TOTP) error
+	getTOTPByUserID(userID uint) (TOTP, error)
+	confirmTOTP(userID uint) error
+	useTOTPStep(userID uint, step int64) (bool, error)
+	deleteTOTP(userID uint) error
+	saveRecoveryCodes(userID uint, hashes []string) error
+	useRecoveryCode(userID uint, hash string) (bool, error)
+	addWebAuthnCredential(credential *WebAuthnCredential) error
+	getWebAuthnCredentialsByUserID(userID uint) ([]WebAuthnCredential, error)
+	getWebAuthnCredentialByCredentialID(credentialID string) (WebAuthnCredential, error)
+	updateWebAuthnSignCount(id uint, oldCount, newCount uint32) (bool, error)
+	deleteWebAuthnCredential(userID, id uint) (bool, error)
+	getRoles() ([]Role, error)
+	getPermissions() ([]string, error)
+	getUserRoles(userID uint) ([]string, error)
+	getUserPermissions(userID uint) ([]string, error)
+	addUserRole(userID uint, role string, grantedBy uint) (bool, error)
+	removeUserRole(userID uint, role string) (bool, error)
+	addRolePermission(role, permission string) (bool, error)
+	removeRolePermission(role, permission string) (bool, error)
 	redisGetValue(key string) (string, error)
 	redisSetValue(key, value string, seconds time.Duration) error
+	redisDeleteValue(key string) error
+	redisTakeValue(key string) (string, error)
+	redisIncrement(key string, expiration time.Duration) (int64, error)
 }
 
 type dataHandler struct{}
 
 func (d *dataHandler) addToken(token *Token) error {
 	var lastInsertID int
-	err := DB.QueryRow("INSERT INTO tokens (key, user_id, expires_at) VALUES($1, $2, $3) returning id;", token.Key, token.UserID, token.ExpiresAt).Scan(&lastInsertID)
+	err := DB.QueryRow("INSERT INTO tokens (key, user_id, kind, client_id, scope, family_id, expires_at) VALUES($1, $2, $3, $4, $5, $6, $7) returning id;", token.Key, token.UserID, token.Kind, token.ClientID, token.Scope, token.FamilyID, token.ExpiresAt).Scan(&lastInsertID)
 	return err
 }
 
@@ -35,24 +90,465 @@ func (d *dataHandler) addUser(user *User) (uint, error) {
 }
 
 func (d *dataHandler) getUserByUsername(username string) (User, error) {
-	var user User
-	err := DB.QueryRow("SELECT ID, USERNAME, PASSWORD FROM USERS WHERE username=$1;", username).Scan(&user.ID, &user.Username, &user.Password)
-	return user, err
+	return scanUser(DB.QueryRow("SELECT "+userColumns+" FROM USERS WHERE username=$1 AND deleted_at IS NULL;", username))
+}
+
+func (d *dataHandler) getUserByID(id uint) (User, error) {
+	return scanUser(DB.QueryRow("SELECT "+userColumns+" FROM USERS WHERE id=$1;", id))
+}
+
+func (d *dataHandler) getUserByEmail(email string) (User, error) {
+	return scanUser(DB.QueryRow("SELECT "+userColumns+" FROM USERS WHERE email=$1 AND deleted_at IS NULL;", email))
+}
+
+func (d *dataHandler) updateUserPassword(userID uint, password string) error {
+	_, err := DB.Exec("UPDATE users SET password=$2, updated_at=now() WHERE id=$1;", userID, password)
+	return err
+}
+
+func (d *dataHandler) updateUsername(userID uint, username string) error {
+	_, err := DB.Exec("UPDATE users SET username=$2, updated_at=now() WHERE id=$1;", userID, username)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code.Name() == "unique_violation" {
+		return ErrUsernameTaken
+	}
+	return err
+}
+
+func (d *dataHandler) changeUserEmail(userID uint, previous, email string) (bool, error) {
+	result, err := DB.Exec("UPDATE users SET email=$3, verified_at=now(), updated_at=now() WHERE id=$1 AND email=$2;", userID, previous, email)
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	return count == 1, err
+}
+
+func (d *dataHandler) verifyUserEmail(userID uint, email string) (bool, error) {
+	result, err := DB.Exec("UPDATE users SET verified_at=now(), updated_at=now() WHERE id=$1 AND email=$2 AND verified_at IS NULL;", userID, email)
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	return count == 1, err
+}
+
+func (d *dataHandler) searchUsers(query string, limit, offset int) ([]User, error) {
+	var users []User
+	pattern := "%" + strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(query) + "%"
+	rows, err := DB.Query("SELECT "+userColumns+" FROM USERS WHERE username ILIKE $1 OR email ILIKE $1 ORDER BY id LIMIT $2 OFFSET $3;", pattern, limit, offset)
+	if err != nil {
+		return users, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return users, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (d *dataHandler) setAccountStatus(userID uint, status AccountStatus) error {
+	var actorID sql.NullInt64
+	var until pq.NullTime
+	if status.ActorID != 0 {
+		actorID = sql.NullInt64{Int64: int64(status.ActorID), Valid: true}
+	}
+	if !status.Until.IsZero() {
+		until = pq.NullTime{Time: status.Until, Valid: true}
+	}
+	_, err := DB.Exec("UPDATE users SET state=$2, state_reason=$3, state_actor_id=$4, state_until=$5, state_changed_at=now(), updated_at=now() WHERE id=$1;", userID, status.State, status.Reason, actorID, until)
+	return err
+}
+
+func (d *dataHandler) deleteUser(userID uint, deleted bool) (bool, error) {
+	query := "UPDATE users SET deleted_at=now(), updated_at=now() WHERE id=$1 AND deleted_at IS NULL;"
+	if !deleted {
+		query = "UPDATE users SET deleted_at=NULL, updated_at=now() WHERE id=$1 AND deleted_at IS NOT NULL;"
+	}
+	result, err := DB.Exec(query, userID)
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	return count == 1, err
 }
 
 func (d *dataHandler) getTokenByKey(key string) (Token, error) {
 	var token Token
-	err := DB.QueryRow("SELECT KEY, CREATED_AT, EXPIRES_AT, USER_ID FROM TOKENS WHERE key=$1;", key).Scan(&token.Key, &token.CreatedAt, &token.ExpiresAt, &token.UserID)
-	fmt.Println(err)
+	var deletedAt pq.NullTime
+	err := DB.QueryRow("SELECT KEY, CREATED_AT, EXPIRES_AT, USER_ID, KIND, CLIENT_ID, SCOPE, FAMILY_ID, DELETED_AT FROM TOKENS WHERE key=$1;", key).Scan(&token.Key, &token.CreatedAt, &token.ExpiresAt, &token.UserID, &token.Kind, &token.ClientID, &token.Scope, &token.FamilyID, &deletedAt)
+	token.DelatedAt = deletedAt.Time
 	return token, err
 }
 
 func (d *dataHandler) getTokenByUserID(userID uint) (Token, error) {
 	var token Token
-	err := DB.QueryRow("SELECT KEY, CREATED_AT, EXPIRES_AT, USER_ID FROM TOKENS WHERE user_id=$1 ORDER BY CREATED_AT DESC LIMIT 1;", userID).Scan(&token.Key, &token.CreatedAt, &token.ExpiresAt, &token.UserID)
+	var deletedAt pq.NullTime
+	err := DB.QueryRow("SELECT KEY, CREATED_AT, EXPIRES_AT, USER_ID, KIND, CLIENT_ID, SCOPE, FAMILY_ID, DELETED_AT FROM TOKENS WHERE user_id=$1 AND kind='user' ORDER BY CREATED_AT DESC LIMIT 1;", userID).Scan(&token.Key, &token.CreatedAt, &token.ExpiresAt, &token.UserID, &token.Kind, &token.ClientID, &token.Scope, &token.FamilyID, &deletedAt)
+	token.DelatedAt = deletedAt.Time
 	return token, err
 }
 
+func (d *dataHandler) revokeToken(key string) error {
+	_, err := DB.Exec("UPDATE tokens SET deleted_at=now() WHERE key=$1 AND deleted_at IS NULL;", key)
+	return err
+}
+
+func (d *dataHandler) revokeTokenFamily(familyID string) ([]string, error) {
+	_, err := DB.Exec("UPDATE sessions SET revoked_at=now() WHERE family_id=$1 AND revoked_at IS NULL;", familyID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = DB.Exec("UPDATE refresh_tokens SET deleted_at=now() WHERE family_id=$1 AND deleted_at IS NULL;", familyID)
+	if err != nil {
+		return nil, err
+	}
+	return queryKeys("UPDATE tokens SET deleted_at=now() WHERE family_id=$1 AND deleted_at IS NULL returning key;", familyID)
+}
+
+func (d *dataHandler) revokeUserTokens(userID uint) ([]string, error) {
+	_, err := DB.Exec("UPDATE sessions SET revoked_at=now() WHERE user_id=$1 AND revoked_at IS NULL;", userID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = DB.Exec("UPDATE refresh_tokens SET deleted_at=now() WHERE user_id=$1 AND deleted_at IS NULL;", userID)
+	if err != nil {
+		return nil, err
+	}
+	return queryKeys("UPDATE tokens SET deleted_at=now() WHERE user_id=$1 AND kind='user' AND deleted_at IS NULL returning key;", userID)
+}
+
+func (d *dataHandler) getUserTokenKeys(userID uint) ([]string, error) {
+	return queryKeys("SELECT key FROM tokens WHERE user_id=$1 AND kind='user' AND deleted_at IS NULL AND expires_at > $2;", userID, time.Now().Unix())
+}
+
+func (d *dataHandler) revokeOtherUserTokens(userID uint, keepFamilyID string) ([]string, error) {
+	_, err := DB.Exec("UPDATE sessions SET revoked_at=now() WHERE user_id=$1 AND family_id<>$2 AND revoked_at IS NULL;", userID, keepFamilyID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = DB.Exec("UPDATE refresh_tokens SET deleted_at=now() WHERE user_id=$1 AND family_id<>$2 AND deleted_at IS NULL;", userID, keepFamilyID)
+	if err != nil {
+		return nil, err
+	}
+	return queryKeys("UPDATE tokens SET deleted_at=now() WHERE user_id=$1 AND kind='user' AND family_id<>$2 AND deleted_at IS NULL returning key;", userID, keepFamilyID)
+}
+
+func (d *dataHandler) addSession(session *Session) error {
+	err := DB.QueryRow("INSERT INTO sessions (family_id, user_id, client_id, device_name, user_agent, ip, expires_at) VALUES($1, $2, $3, $4, $5, $6, $7) returning id, created_at;", session.FamilyID, session.UserID, session.ClientID, session.DeviceName, session.UserAgent, session.IP, session.ExpiresAt).Scan(&session.ID, &session.CreatedAt)
+	return err
+}
+
+func (d *dataHandler) getSessionByID(id uint) (Session, error) {
+	return scanSession(DB.QueryRow("SELECT "+sessionColumns+" FROM SESSIONS WHERE id=$1;", id))
+}
+
+func (d *dataHandler) getSessionsByUserID(userID uint) ([]Session, error) {
+	var sessions []Session
+	rows, err := DB.Query("SELECT "+sessionColumns+" FROM SESSIONS WHERE user_id=$1 AND revoked_at IS NULL AND expires_at > $2 ORDER BY id DESC;", userID, time.Now().Unix())
+	if err != nil {
+		return sessions, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return sessions, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func (d *dataHandler) touchSession(familyID string) error {
+	_, err := DB.Exec("UPDATE sessions SET last_used_at=now() WHERE family_id=$1;", familyID)
+	return err
+}
+
+func (d *dataHandler) addRefreshToken(refreshToken *RefreshToken) error {
+	err := DB.QueryRow("INSERT INTO refresh_tokens (key_hash, user_id, client_id, scope, family_id, expires_at) VALUES($1, $2, $3, $4, $5, $6) returning id;", refreshToken.KeyHash, refreshToken.UserID, refreshToken.ClientID, refreshToken.Scope, refreshToken.FamilyID, refreshToken.ExpiresAt).Scan(&refreshToken.ID)
+	return err
+}
+
+func (d *dataHandler) getRefreshTokenByHash(hash string) (RefreshToken, error) {
+	var refreshToken RefreshToken
+	var rotatedAt, deletedAt pq.NullTime
+	err := DB.QueryRow("SELECT ID, KEY_HASH, USER_ID, CLIENT_ID, SCOPE, FAMILY_ID, EXPIRES_AT, CREATED_AT, ROTATED_AT, DELETED_AT FROM REFRESH_TOKENS WHERE key_hash=$1;", hash).Scan(&refreshToken.ID, &refreshToken.KeyHash, &refreshToken.UserID, &refreshToken.ClientID, &refreshToken.Scope, &refreshToken.FamilyID, &refreshToken.ExpiresAt, &refreshToken.CreatedAt, &rotatedAt, &deletedAt)
+	refreshToken.RotatedAt = rotatedAt.Time
+	refreshToken.DeletedAt = deletedAt.Time
+	return refreshToken, err
+}
+
+func (d *dataHandler) rotateRefreshToken(hash string) (bool, error) {
+	result, err := DB.Exec("UPDATE refresh_tokens SET rotated_at=now() WHERE key_hash=$1 AND rotated_at IS NULL AND deleted_at IS NULL;", hash)
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	return count == 1, err
+}
+
+func (d *dataHandler) addClient(client *Client) (uint, error) {
+	var lastInsertID uint
+	err := DB.QueryRow("INSERT INTO clients (client_id, secret_hash, name, redirect_uris, grant_types, scope, owner_id) VALUES($1, $2, $3, $4, $5, $6, $7) returning id;", client.ClientID, client.SecretHash, client.Name, strings.Join(client.RedirectURIs, " "), strings.Join(client.GrantTypes, " "), client.Scope, client.OwnerID).Scan(&lastInsertID)
+	return lastInsertID, err
+}
+
+func (d *dataHandler) getClientByClientID(clientID string) (Client, error) {
+	var client Client
+	var redirectURIs, grantTypes string
+	err := DB.QueryRow("SELECT ID, CLIENT_ID, SECRET_HASH, NAME, REDIRECT_URIS, GRANT_TYPES, SCOPE, OWNER_ID FROM CLIENTS WHERE client_id=$1 AND deleted_at IS NULL;", clientID).Scan(&client.ID, &client.ClientID, &client.SecretHash, &client.Name, &redirectURIs, &grantTypes, &client.Scope, &client.OwnerID)
+	client.RedirectURIs = strings.Fields(redirectURIs)
+	client.GrantTypes = strings.Fields(grantTypes)
+	return client, err
+}
+
+func (d *dataHandler) addAuthorizationCode(code *AuthorizationCode) error {
+	err := DB.QueryRow("INSERT INTO authorization_codes (code_hash, client_id, user_id, redirect_uri, scope, code_challenge, code_challenge_method, nonce, family_id, expires_at) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) returning id;", code.CodeHash, code.ClientID, code.UserID, code.RedirectURI, code.Scope, code.CodeChallenge, code.CodeChallengeMethod, code.Nonce, code.FamilyID, code.ExpiresAt).Scan(&code.ID)
+	return err
+}
+
+func (d *dataHandler) getAuthorizationCodeByHash(hash string) (AuthorizationCode, error) {
+	var code AuthorizationCode
+	var usedAt pq.NullTime
+	err := DB.QueryRow("SELECT ID, CODE_HASH, CLIENT_ID, USER_ID, REDIRECT_URI, SCOPE, CODE_CHALLENGE, CODE_CHALLENGE_METHOD, NONCE, FAMILY_ID, EXPIRES_AT, USED_AT, CREATED_AT FROM AUTHORIZATION_CODES WHERE code_hash=$1;", hash).Scan(&code.ID, &code.CodeHash, &code.ClientID, &code.UserID, &code.RedirectURI, &code.Scope, &code.CodeChallenge, &code.CodeChallengeMethod, &code.Nonce, &code.FamilyID, &code.ExpiresAt, &usedAt, &code.CreatedAt)
+	code.UsedAt = usedAt.Time
+	return code, err
+}
+
+func (d *dataHandler) useAuthorizationCode(hash string) (bool, error) {
+	result, err := DB.Exec("UPDATE authorization_codes SET used_at=now() WHERE code_hash=$1 AND used_at IS NULL;", hash)
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	return count == 1, err
+}
+
+func (d *dataHandler) getConsent(userID uint, clientID string) (Consent, error) {
+	var consent Consent
+	err := DB.QueryRow("SELECT USER_ID, CLIENT_ID, SCOPE, CREATED_AT FROM CONSENTS WHERE user_id=$1 AND client_id=$2;", userID, clientID).Scan(&consent.UserID, &consent.ClientID, &consent.Scope, &consent.CreatedAt)
+	return consent, err
+}
+
+func (d *dataHandler) saveConsent(consent *Consent) error {
+	_, err := DB.Exec("INSERT INTO consents (user_id, client_id, scope) VALUES($1, $2, $3) ON CONFLICT (user_id, client_id) DO UPDATE SET scope=$3, updated_at=now();", consent.UserID, consent.ClientID, consent.Scope)
+	return err
+}
+
+func (d *dataHandler) addPasswordReset(reset *PasswordReset) error {
+	err := DB.QueryRow("INSERT INTO password_resets (key_hash, user_id, expires_at) VALUES($1, $2, $3) returning id;", reset.KeyHash, reset.UserID, reset.ExpiresAt).Scan(&reset.ID)
+	return err
+}
+
+func (d *dataHandler) getPasswordResetByHash(hash string) (PasswordReset, error) {
+	var reset PasswordReset
+	var usedAt pq.NullTime
+	err := DB.QueryRow("SELECT ID, KEY_HASH, USER_ID, EXPIRES_AT, USED_AT, CREATED_AT FROM PASSWORD_RESETS WHERE key_hash=$1;", hash).Scan(&reset.ID, &reset.KeyHash, &reset.UserID, &reset.ExpiresAt, &usedAt, &reset.CreatedAt)
+	reset.UsedAt = usedAt.Time
+	return reset, err
+}
+
+func (d *dataHandler) usePasswordReset(hash string) (bool, error) {
+	result, err := DB.Exec("UPDATE password_resets SET used_at=now() WHERE key_hash=$1 AND used_at IS NULL;", hash)
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	return count == 1, err
+}
+
+func (d *dataHandler) usePasswordResets(userID uint) error {
+	_, err := DB.Exec("UPDATE password_resets SET used_at=now() WHERE user_id=$1 AND used_at IS NULL;", userID)
+	return err
+}
+
+func (d *dataHandler) saveTOTP(totp *TOTP) error {
+	_, err := DB.Exec("INSERT INTO totp_secrets (user_id, secret) VALUES($1, $2) ON CONFLICT (user_id) DO UPDATE SET secret=$2, last_step=0, confirmed_at=NULL, created_at=now();", totp.UserID, totp.Secret)
+	return err
+}
+
+func (d *dataHandler) getTOTPByUserID(userID uint) (TOTP, error) {
+	var totp TOTP
+	var confirmedAt pq.NullTime
+	err := DB.QueryRow("SELECT USER_ID, SECRET, LAST_STEP, CONFIRMED_AT, CREATED_AT FROM TOTP_SECRETS WHERE user_id=$1;", userID).Scan(&totp.UserID, &totp.Secret, &totp.LastStep, &confirmedAt, &totp.CreatedAt)
+	totp.ConfirmedAt = confirmedAt.Time
+	return totp, err
+}
+
+func (d *dataHandler) confirmTOTP(userID uint) error {
+	_, err := DB.Exec("UPDATE totp_secrets SET confirmed_at=now() WHERE user_id=$1;", userID)
+	return err
+}
+
+func (d *dataHandler) useTOTPStep(userID uint, step int64) (bool, error) {
+	result, err := DB.Exec("UPDATE totp_secrets SET last_step=$2 WHERE user_id=$1 AND last_step < $2;", userID, step)
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	return count == 1, err
+}
+
+func (d *dataHandler) deleteTOTP(userID uint) error {
+	_, err := DB.Exec("DELETE FROM recovery_codes WHERE user_id=$1;", userID)
+	if err != nil {
+		return err
+	}
+	_, err = DB.Exec("DELETE FROM totp_secrets WHERE user_id=$1;", userID)
+	return err
+}
+
+func (d *dataHandler) saveRecoveryCodes(userID uint, hashes []string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM recovery_codes WHERE user_id=$1;", userID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, hash := range hashes {
+		_, err = tx.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES($1, $2);", userID, hash)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (d *dataHandler) useRecoveryCode(userID uint, hash string) (bool, error) {
+	result, err := DB.Exec("UPDATE recovery_codes SET used_at=now() WHERE user_id=$1 AND code_hash=$2 AND used_at IS NULL;", userID, hash)
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	return count == 1, err
+}
+
+func (d *dataHandler) addWebAuthnCredential(credential *WebAuthnCredential) error {
+	err := DB.QueryRow("INSERT INTO webauthn_credentials (user_id, credential_id, public_key, sign_count, name) VALUES($1, $2, $3, $4, $5) returning id, created_at;", credential.UserID, credential.CredentialID, credential.PublicKey, credential.SignCount, credential.Name).Scan(&credential.ID, &credential.CreatedAt)
+	return err
+}
+
+func (d *dataHandler) getWebAuthnCredentialsByUserID(userID uint) ([]WebAuthnCredential, error) {
+	var credentials []WebAuthnCredential
+	rows, err := DB.Query("SELECT "+webAuthnCredentialColumns+" FROM WEBAUTHN_CREDENTIALS WHERE user_id=$1 ORDER BY id;", userID)
+	if err != nil {
+		return credentials, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		credential, err := scanWebAuthnCredential(rows)
+		if err != nil {
+			return credentials, err
+		}
+		credentials = append(credentials, credential)
+	}
+	return credentials, rows.Err()
+}
+
+func (d *dataHandler) getWebAuthnCredentialByCredentialID(credentialID string) (WebAuthnCredential, error) {
+	return scanWebAuthnCredential(DB.QueryRow("SELECT "+webAuthnCredentialColumns+" FROM WEBAUTHN_CREDENTIALS WHERE credential_id=$1;", credentialID))
+}
+
+func (d *dataHandler) updateWebAuthnSignCount(id uint, oldCount, newCount uint32) (bool, error) {
+	result, err := DB.Exec("UPDATE webauthn_credentials SET sign_count=$3, last_used_at=now() WHERE id=$1 AND sign_count=$2;", id, oldCount, newCount)
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	return count == 1, err
+}
+
+func (d *dataHandler) deleteWebAuthnCredential(userID, id uint) (bool, error) {
+	result, err := DB.Exec("DELETE FROM webauthn_credentials WHERE id=$1 AND user_id=$2;", id, userID)
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	return count == 1, err
+}
+
+func (d *dataHandler) getRoles() ([]Role, error) {
+	var roles []Role
+	rows, err := DB.Query("SELECT ROLES.ID, ROLES.NAME, ROLES.DESCRIPTION, PERMISSIONS.NAME FROM ROLES LEFT JOIN ROLE_PERMISSIONS ON ROLE_PERMISSIONS.ROLE_ID=ROLES.ID LEFT JOIN PERMISSIONS ON PERMISSIONS.ID=ROLE_PERMISSIONS.PERMISSION_ID ORDER BY ROLES.ID, PERMISSIONS.NAME;")
+	if err != nil {
+		return roles, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var role Role
+		var permission sql.NullString
+		err = rows.Scan(&role.ID, &role.Name, &role.Description, &permission)
+		if err != nil {
+			return roles, err
+		}
+		if len(roles) == 0 || roles[len(roles)-1].ID != role.ID {
+			role.Permissions = []string{}
+			roles = append(roles, role)
+		}
+		if permission.Valid {
+			last := &roles[len(roles)-1]
+			last.Permissions = append(last.Permissions, permission.String)
+		}
+	}
+	return roles, rows.Err()
+}
+
+func (d *dataHandler) getPermissions() ([]string, error) {
+	return queryKeys("SELECT NAME FROM PERMISSIONS ORDER BY NAME;")
+}
+
+func (d *dataHandler) getUserRoles(userID uint) ([]string, error) {
+	return queryKeys("SELECT ROLES.NAME FROM ROLES JOIN USER_ROLES ON USER_ROLES.ROLE_ID=ROLES.ID WHERE USER_ROLES.USER_ID=$1 ORDER BY ROLES.ID;", userID)
+}
+
+func (d *dataHandler) getUserPermissions(userID uint) ([]string, error) {
+	return queryKeys("SELECT DISTINCT PERMISSIONS.NAME FROM PERMISSIONS JOIN ROLE_PERMISSIONS ON ROLE_PERMISSIONS.PERMISSION_ID=PERMISSIONS.ID JOIN ROLES ON ROLES.ID=ROLE_PERMISSIONS.ROLE_ID WHERE ROLES.NAME=$2 OR ROLES.ID IN (SELECT ROLE_ID FROM USER_ROLES WHERE USER_ID=$1) ORDER BY PERMISSIONS.NAME;", userID, RoleUser)
+}
+
+func (d *dataHandler) addUserRole(userID uint, role string, grantedBy uint) (bool, error) {
+	result, err := DB.Exec("INSERT INTO user_roles (user_id, role_id, granted_by) SELECT $1, id, $3 FROM roles WHERE name=$2 ON CONFLICT DO NOTHING;", userID, role, grantedBy)
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	return count == 1, err
+}
+
+func (d *dataHandler) removeUserRole(userID uint, role string) (bool, error) {
+	result, err := DB.Exec("DELETE FROM user_roles WHERE user_id=$1 AND role_id=(SELECT id FROM roles WHERE name=$2);", userID, role)
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	return count == 1, err
+}
+
+func (d *dataHandler) addRolePermission(role, permission string) (bool, error) {
+	result, err := DB.Exec("INSERT INTO role_permissions (role_id, permission_id) SELECT roles.id, permissions.id FROM roles, permissions WHERE roles.name=$1 AND permissions.name=$2 ON CONFLICT DO NOTHING;", role, permission)
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	return count == 1, err
+}
+
+func (d *dataHandler) removeRolePermission(role, permission string) (bool, error) {
+	result, err := DB.Exec("DELETE FROM role_permissions WHERE role_id=(SELECT id FROM roles WHERE name=$1) AND permission_id=(SELECT id FROM permissions WHERE name=$2);", role, permission)
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	return count == 1, err
+}
+
 func (d *dataHandler) redisGetValue(key string) (string, error) {
 	return REDIS.Get(key).Result()
 }
@@ -61,6 +557,97 @@ func (d *dataHandler) redisSetValue(key, value string, seconds time.Duration) er
 	return REDIS.Set(key, value, seconds).Err()
 }
 
+func (d *dataHandler) redisDeleteValue(key string) error {
+	return REDIS.Del(key).Err()
+}
+
+//redisTakeValue gets and deletes a value. Only the caller whose delete
+//removed the key gets the value, so it can be taken once.
+func (d *dataHandler) redisTakeValue(key string) (string, error) {
+	value, err := REDIS.Get(key).Result()
+	if err != nil {
+		return "", err
+	}
+	deleted, err := REDIS.Del(key).Result()
+	if err != nil || deleted != 1 {
+		return "", err
+	}
+	return value, nil
+}
+
+func (d *dataHandler) redisIncrement(key string, expiration time.Duration) (int64, error) {
+	count, err := REDIS.Incr(key).Result()
+	if err != nil {
+		return count, err
+	}
+	if count == 1 {
+		err = REDIS.Expire(key, expiration).Err()
+	}
+	return count, err
+}
+
+const userColumns = "ID, USERNAME, PASSWORD, EMAIL, VERIFIED_AT, CREATED_AT, STATE, STATE_REASON, STATE_ACTOR_ID, STATE_UNTIL, STATE_CHANGED_AT, DELETED_AT"
+
+//scanUser reads a row selected with userColumns
+func scanUser(row rowScanner) (User, error) {
+	var user User
+	var verifiedAt, until, changedAt, deletedAt pq.NullTime
+	var actorID sql.NullInt64
+	err := row.Scan(&user.ID, &user.Username, &user.Password, &user.Email, &verifiedAt, &user.CreatedAt, &user.Status.State, &user.Status.Reason, &actorID, &until, &changedAt, &deletedAt)
+	user.VerifiedAt = verifiedAt.Time
+	user.Status.ActorID = uint(actorID.Int64)
+	user.Status.Until = until.Time
+	user.Status.ChangedAt = changedAt.Time
+	user.DeletedAt = deletedAt.Time
+	return user, err
+}
+
+const webAuthnCredentialColumns = "ID, USER_ID, CREDENTIAL_ID, PUBLIC_KEY, SIGN_COUNT, NAME, LAST_USED_AT, CREATED_AT"
+
+const sessionColumns = "ID, FAMILY_ID, USER_ID, CLIENT_ID, DEVICE_NAME, USER_AGENT, IP, EXPIRES_AT, CREATED_AT, LAST_USED_AT, REVOKED_AT"
+
+//scanSession reads a row selected with sessionColumns
+func scanSession(row rowScanner) (Session, error) {
+	var session Session
+	var lastUsedAt, revokedAt pq.NullTime
+	err := row.Scan(&session.ID, &session.FamilyID, &session.UserID, &session.ClientID, &session.DeviceName, &session.UserAgent, &session.IP, &session.ExpiresAt, &session.CreatedAt, &lastUsedAt, &revokedAt)
+	session.LastUsedAt = lastUsedAt.Time
+	session.RevokedAt = revokedAt.Time
+	return session, err
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+//scanWebAuthnCredential reads a row selected with webAuthnCredentialColumns
+func scanWebAuthnCredential(row rowScanner) (WebAuthnCredential, error) {
+	var credential WebAuthnCredential
+	var lastUsedAt pq.NullTime
+	err := row.Scan(&credential.ID, &credential.UserID, &credential.CredentialID, &credential.PublicKey, &credential.SignCount, &credential.Name, &lastUsedAt, &credential.CreatedAt)
+	credential.LastUsedAt = lastUsedAt.Time
+	return credential, err
+}
+
+//queryKeys collects the token keys, or other names, returned by a single column query
+func queryKeys(query string, args ...interface{}) ([]string, error) {
+	var keys []string
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return keys, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		err = rows.Scan(&key)
+		if err != nil {
+			return keys, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
 //InitDatabase setup db connection
 func InitDatabase(dbinfo string) (*sql.DB, error) {
 	db, err := sql.Open("postgres", dbinfo+" sslmode=disable")
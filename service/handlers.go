@@ -2,9 +2,16 @@ package service
 
 import (
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/unrolled/render"
@@ -19,6 +26,16 @@ func registerUserHandler(formatter *render.Render, database Database) http.Handl
 			formatter.JSON(w, http.StatusBadRequest, "Failed to parse user.")
 			return
 		}
+		err = validateUsername(user.Username)
+		if err != nil {
+			formatter.JSON(w, http.StatusBadRequest, err.Error()+".")
+			return
+		}
+		err = CheckPassword(user.Password, user.Username, user.Email)
+		if err != nil {
+			formatter.JSON(w, http.StatusBadRequest, err)
+			return
+		}
 		err = user.Save(database)
 		log.Print(err)
 		if err != nil {
@@ -31,15 +48,31 @@ func registerUserHandler(formatter *render.Render, database Database) http.Handl
 
 func loginUserHandler(formatter *render.Render, database Database) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
-		var user User
+		var body struct {
+			User
+			DeviceName string `json:"device_name"`
+		}
 		payload, _ := ioutil.ReadAll(req.Body)
-		err := json.Unmarshal(payload, &user)
+		err := json.Unmarshal(payload, &body)
+		user := body.User
 		if err != nil || (user == User{}) {
 			formatter.JSON(w, http.StatusBadRequest, "Failed to parse user.")
 			return
 		}
-		token, err := UserLogin(user.Username, user.Password, database)
-
+		token, err := UserLoginFromDevice(user.Username, user.Password, deviceFromRequest(req, body.DeviceName), database)
+		if locked, ok := err.(*LoginLockedError); ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(locked.RetryAfter.Seconds()+0.5)))
+			formatter.JSON(w, http.StatusTooManyRequests, locked.Error())
+			return
+		}
+		if err == ErrEmailNotVerified {
+			formatter.JSON(w, http.StatusForbidden, err.Error()+".")
+			return
+		}
+		if statusErr, ok := err.(*AccountStatusError); ok {
+			formatter.JSON(w, http.StatusForbidden, statusErr)
+			return
+		}
 		if err != nil {
 			formatter.JSON(w, http.StatusBadRequest, "Failed to login")
 			return
@@ -48,6 +81,336 @@ func loginUserHandler(formatter *render.Render, database Database) http.HandlerF
 	}
 }
 
+func mfaLoginHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var body struct {
+			MFAToken string `json:"mfa_token"`
+			Code     string `json:"code"`
+		}
+		payload, _ := ioutil.ReadAll(req.Body)
+		err := json.Unmarshal(payload, &body)
+		if err != nil || body.MFAToken == "" || body.Code == "" {
+			formatter.JSON(w, http.StatusBadRequest, "Failed to parse code.")
+			return
+		}
+		tokens, err := CompleteMFALogin(body.MFAToken, body.Code, database)
+		if err != nil {
+			formatter.JSON(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		formatter.JSON(w, http.StatusOK, tokens)
+	}
+}
+
+func totpEnrollHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		token, err := authenticatedUserToken(req, database)
+		if err != nil {
+			formatter.JSON(w, http.StatusUnauthorized, "Login required.")
+			return
+		}
+		enrollment, err := EnrollTOTP(token.UserID, database)
+		if err != nil {
+			formatter.JSON(w, http.StatusConflict, err.Error())
+			return
+		}
+		formatter.JSON(w, http.StatusOK, enrollment)
+	}
+}
+
+//totpCodeHandler runs action with the code sent by a logged in user
+func totpCodeHandler(formatter *render.Render, database Database, action func(userID uint, code string, database Database) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		token, err := authenticatedUserToken(req, database)
+		if err != nil {
+			formatter.JSON(w, http.StatusUnauthorized, "Login required.")
+			return
+		}
+		var body struct {
+			Code string `json:"code"`
+		}
+		payload, _ := ioutil.ReadAll(req.Body)
+		err = json.Unmarshal(payload, &body)
+		if err != nil || body.Code == "" {
+			formatter.JSON(w, http.StatusBadRequest, "Failed to parse code.")
+			return
+		}
+		result, err := action(token.UserID, body.Code, database)
+		if err != nil {
+			formatter.JSON(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		formatter.JSON(w, http.StatusOK, result)
+	}
+}
+
+func totpConfirmHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return totpCodeHandler(formatter, database, func(userID uint, code string, database Database) (interface{}, error) {
+		codes, err := ConfirmTOTP(userID, code, database)
+		return map[string][]string{"recovery_codes": codes}, err
+	})
+}
+
+func totpDisableHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return totpCodeHandler(formatter, database, func(userID uint, code string, database Database) (interface{}, error) {
+		err := DisableTOTP(userID, code, database)
+		return "Two factor authentication disabled.", err
+	})
+}
+
+func recoveryCodesHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return totpCodeHandler(formatter, database, func(userID uint, code string, database Database) (interface{}, error) {
+		ok, err := VerifySecondFactor(userID, code, database)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errors.New("Invalid code")
+		}
+		codes, err := GenerateRecoveryCodes(userID, database)
+		return map[string][]string{"recovery_codes": codes}, err
+	})
+}
+
+func webAuthnRegisterBeginHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		token, err := authenticatedUserToken(req, database)
+		if err != nil {
+			formatter.JSON(w, http.StatusUnauthorized, "Login required.")
+			return
+		}
+		options, err := BeginWebAuthnRegistration(token.UserID, database)
+		if err != nil {
+			formatter.JSON(w, http.StatusInternalServerError, "Failed to start registration.")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, options)
+	}
+}
+
+func webAuthnRegisterFinishHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		token, err := authenticatedUserToken(req, database)
+		if err != nil {
+			formatter.JSON(w, http.StatusUnauthorized, "Login required.")
+			return
+		}
+		var body struct {
+			Name       string                     `json:"name"`
+			Credential WebAuthnCredentialResponse `json:"credential"`
+		}
+		payload, _ := ioutil.ReadAll(req.Body)
+		err = json.Unmarshal(payload, &body)
+		if err != nil {
+			formatter.JSON(w, http.StatusBadRequest, "Failed to parse credential.")
+			return
+		}
+		credential, err := FinishWebAuthnRegistration(token.UserID, body.Name, body.Credential, database)
+		if err != nil {
+			formatter.JSON(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		formatter.JSON(w, http.StatusCreated, credential)
+	}
+}
+
+func webAuthnCredentialsHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		token, err := authenticatedUserToken(req, database)
+		if err != nil {
+			formatter.JSON(w, http.StatusUnauthorized, "Login required.")
+			return
+		}
+		credentials, err := database.getWebAuthnCredentialsByUserID(token.UserID)
+		if err != nil {
+			formatter.JSON(w, http.StatusInternalServerError, "Failed to load credentials.")
+			return
+		}
+		if credentials == nil {
+			credentials = []WebAuthnCredential{}
+		}
+		formatter.JSON(w, http.StatusOK, credentials)
+	}
+}
+
+func webAuthnDeleteCredentialHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		token, err := authenticatedUserToken(req, database)
+		if err != nil {
+			formatter.JSON(w, http.StatusUnauthorized, "Login required.")
+			return
+		}
+		id, err := strconv.ParseUint(mux.Vars(req)["id"], 10, 64)
+		if err != nil {
+			formatter.JSON(w, http.StatusNotFound, "Credential not found.")
+			return
+		}
+		deleted, err := database.deleteWebAuthnCredential(token.UserID, uint(id))
+		if err != nil || !deleted {
+			formatter.JSON(w, http.StatusNotFound, "Credential not found.")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, "Credential succesfully deleted.")
+	}
+}
+
+func webAuthnLoginBeginHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		options, err := BeginWebAuthnLogin(database)
+		if err != nil {
+			formatter.JSON(w, http.StatusInternalServerError, "Failed to start login.")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, options)
+	}
+}
+
+func webAuthnLoginFinishHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var body struct {
+			Credential WebAuthnCredentialResponse `json:"credential"`
+			DeviceName string                     `json:"device_name"`
+		}
+		payload, _ := ioutil.ReadAll(req.Body)
+		err := json.Unmarshal(payload, &body)
+		if err != nil {
+			formatter.JSON(w, http.StatusBadRequest, "Failed to parse credential.")
+			return
+		}
+		tokens, err := FinishWebAuthnLogin(body.Credential, deviceFromRequest(req, body.DeviceName), database)
+		if err == ErrEmailNotVerified {
+			formatter.JSON(w, http.StatusForbidden, err.Error()+".")
+			return
+		}
+		if err != nil {
+			formatter.JSON(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		formatter.JSON(w, http.StatusOK, tokens)
+	}
+}
+
+func webAuthnMFABeginHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var body struct {
+			MFAToken string `json:"mfa_token"`
+		}
+		payload, _ := ioutil.ReadAll(req.Body)
+		err := json.Unmarshal(payload, &body)
+		if err != nil || body.MFAToken == "" {
+			formatter.JSON(w, http.StatusBadRequest, "Failed to parse challenge.")
+			return
+		}
+		options, err := BeginWebAuthnMFA(body.MFAToken, database)
+		if err != nil {
+			formatter.JSON(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		formatter.JSON(w, http.StatusOK, options)
+	}
+}
+
+func webAuthnMFAFinishHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var body struct {
+			MFAToken   string                     `json:"mfa_token"`
+			Credential WebAuthnCredentialResponse `json:"credential"`
+		}
+		payload, _ := ioutil.ReadAll(req.Body)
+		err := json.Unmarshal(payload, &body)
+		if err != nil || body.MFAToken == "" {
+			formatter.JSON(w, http.StatusBadRequest, "Failed to parse credential.")
+			return
+		}
+		tokens, err := CompleteMFALoginWithWebAuthn(body.MFAToken, body.Credential, database)
+		if err != nil {
+			formatter.JSON(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		formatter.JSON(w, http.StatusOK, tokens)
+	}
+}
+
+func listSessionsHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		token, err := authenticatedUserToken(req, database)
+		if err != nil {
+			formatter.JSON(w, http.StatusUnauthorized, "Login required.")
+			return
+		}
+		sessions, err := ListSessions(token, database)
+		if err != nil {
+			formatter.JSON(w, http.StatusInternalServerError, "Failed to load sessions.")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, sessions)
+	}
+}
+
+func revokeSessionHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		token, err := authenticatedUserToken(req, database)
+		if err != nil {
+			formatter.JSON(w, http.StatusUnauthorized, "Login required.")
+			return
+		}
+		id, err := strconv.ParseUint(mux.Vars(req)["id"], 10, 64)
+		if err == nil {
+			err = RevokeSession(token.UserID, uint(id), database)
+		}
+		if err != nil {
+			formatter.JSON(w, http.StatusNotFound, "Session not found.")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, "Session succesfully revoked.")
+	}
+}
+
+func revokeOtherSessionsHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		token, err := authenticatedUserToken(req, database)
+		if err != nil {
+			formatter.JSON(w, http.StatusUnauthorized, "Login required.")
+			return
+		}
+		err = RevokeOtherSessions(token, database)
+		if err != nil {
+			formatter.JSON(w, http.StatusInternalServerError, "Failed to revoke sessions.")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, "Other sessions succesfully revoked.")
+	}
+}
+
+func exchangeTokenHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		token, err := CheckTokenKey(bearerKey(req), database)
+		if err != nil {
+			formatter.JSON(w, http.StatusUnauthorized, "Login required.")
+			return
+		}
+		var body struct {
+			Scope     string `json:"scope"`
+			ExpiresIn int64  `json:"expires_in"`
+		}
+		payload, _ := ioutil.ReadAll(req.Body)
+		err = json.Unmarshal(payload, &body)
+		if err != nil {
+			formatter.JSON(w, http.StatusBadRequest, "Failed to parse scope.")
+			return
+		}
+		scoped, err := ExchangeScopedToken(token, body.Scope, time.Duration(body.ExpiresIn)*time.Second, database)
+		switch err {
+		case nil:
+			formatter.JSON(w, http.StatusOK, scoped)
+		case ErrEmailNotVerified, ErrScopeNotAllowed:
+			formatter.JSON(w, http.StatusForbidden, err.Error()+".")
+		default:
+			formatter.JSON(w, http.StatusBadRequest, err.Error()+".")
+		}
+	}
+}
+
 func tokenValidatorHandler(formatter *render.Render, database Database) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		vars := mux.Vars(req)
@@ -56,11 +419,731 @@ func tokenValidatorHandler(formatter *render.Render, database Database) http.Han
 			formatter.JSON(w, http.StatusNotFound, "No key sent.")
 			return
 		}
-		validToken, err := CheckTokenKey(key, database)
+		validation := ValidateTokenKey(key, database)
+		switch validation.Status {
+		case TokenStatusValid:
+			formatter.JSON(w, http.StatusOK, validation)
+		case TokenStatusUnknown:
+			formatter.JSON(w, http.StatusNotFound, validation)
+		default:
+			formatter.JSON(w, http.StatusUnauthorized, validation)
+		}
+	}
+}
+
+func forgotPasswordHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var body struct {
+			Email string `json:"email"`
+		}
+		payload, _ := ioutil.ReadAll(req.Body)
+		err := json.Unmarshal(payload, &body)
+		if err != nil || body.Email == "" {
+			formatter.JSON(w, http.StatusBadRequest, "Failed to parse email.")
+			return
+		}
+		//Sent in the background so the response takes as long whether or
+		//not the email is registered
+		go RequestPasswordReset(body.Email, database)
+		formatter.JSON(w, http.StatusAccepted, "If the email is registered a reset link has been sent.")
+	}
+}
+
+func resetPasswordHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var body struct {
+			Token    string `json:"token"`
+			Password string `json:"password"`
+		}
+		payload, _ := ioutil.ReadAll(req.Body)
+		err := json.Unmarshal(payload, &body)
+		if err != nil || body.Token == "" {
+			formatter.JSON(w, http.StatusBadRequest, "Failed to parse reset.")
+			return
+		}
+		err = ResetPassword(body.Token, body.Password, database)
+		if policyErr, ok := err.(*PasswordPolicyError); ok {
+			formatter.JSON(w, http.StatusBadRequest, policyErr)
+			return
+		}
+		if err != nil {
+			formatter.JSON(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		formatter.JSON(w, http.StatusOK, "Password succesfully reset.")
+	}
+}
+
+func verifyEmailHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		key := req.FormValue("token")
+		if key == "" {
+			formatter.JSON(w, http.StatusBadRequest, "No token sent.")
+			return
+		}
+		err := VerifyEmail(key, database)
+		if err != nil {
+			formatter.JSON(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		formatter.JSON(w, http.StatusOK, "Email succesfully verified.")
+	}
+}
+
+func resendVerificationHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var body struct {
+			Email string `json:"email"`
+		}
+		payload, _ := ioutil.ReadAll(req.Body)
+		err := json.Unmarshal(payload, &body)
+		if err != nil || body.Email == "" {
+			formatter.JSON(w, http.StatusBadRequest, "Failed to parse email.")
+			return
+		}
+		err = ResendVerificationEmail(body.Email, database)
+		if err != nil {
+			log.Print(err)
+		}
+		formatter.JSON(w, http.StatusAccepted, "If the email is registered and unverified a new link has been sent.")
+	}
+}
+
+func refreshTokenHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var body struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		payload, _ := ioutil.ReadAll(req.Body)
+		err := json.Unmarshal(payload, &body)
+		if err != nil || body.RefreshToken == "" {
+			formatter.JSON(w, http.StatusBadRequest, "Failed to parse refresh token.")
+			return
+		}
+		tokens, err := RefreshClientTokens(body.RefreshToken, Client{}, database)
+		if err != nil {
+			formatter.JSON(w, http.StatusUnauthorized, "Invalid refresh token.")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, tokens)
+	}
+}
+
+func logoutUserHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		key := bearerKey(req)
+		if key == "" {
+			formatter.JSON(w, http.StatusUnauthorized, "No key sent.")
+			return
+		}
+		err := RevokeToken(key, database)
 		if err != nil {
 			formatter.JSON(w, http.StatusNotFound, "Token key not found.")
 			return
 		}
-		formatter.JSON(w, http.StatusOK, validToken)
+		formatter.JSON(w, http.StatusOK, "User succesfully logged out.")
+	}
+}
+
+//authenticateClient checks client credentials sent with basic auth or in the form body
+func authenticateClient(req *http.Request, database Database) (Client, error) {
+	clientID, secret, ok := req.BasicAuth()
+	if !ok {
+		clientID, secret = req.PostFormValue("client_id"), req.PostFormValue("client_secret")
+	}
+	if clientID == "" {
+		return Client{}, errors.New("No client credentials sent")
+	}
+	client, err := database.getClientByClientID(clientID)
+	if err != nil {
+		return Client{}, err
+	}
+	if !client.CheckSecret(secret) {
+		return Client{}, errors.New("Invalid client secret")
+	}
+	return client, nil
+}
+
+//authenticateOAuthClient authenticates confidential clients by secret, public
+//clients only identify themselves by client id
+func authenticateOAuthClient(req *http.Request, database Database) (Client, error) {
+	if _, _, ok := req.BasicAuth(); ok || req.PostFormValue("client_secret") != "" {
+		return authenticateClient(req, database)
+	}
+	client, err := database.getClientByClientID(req.PostFormValue("client_id"))
+	if err != nil {
+		return Client{}, err
+	}
+	if !client.isPublic() {
+		return Client{}, errors.New("Client secret required")
+	}
+	return client, nil
+}
+
+//authenticatedUserToken returns the valid bearer token of a user signed in to
+//chat-auth directly, tokens issued to other clients or narrowed to chat scopes
+//are refused
+func authenticatedUserToken(req *http.Request, database Database) (Token, error) {
+	key := bearerKey(req)
+	if key == "" {
+		return Token{}, errors.New("No key sent")
+	}
+	token, err := CheckTokenKey(key, database)
+	if err != nil {
+		return Token{}, err
+	}
+	if token.ClientID != "" {
+		return Token{}, errors.New("Token was issued to a client")
+	}
+	if token.isScoped() {
+		return Token{}, errors.New("Token is limited to chat scopes")
+	}
+	return token, nil
+}
+
+//clientIP is the address of the client. X-Forwarded-For is only trusted when
+//TRUST_PROXY is set since clients can send it themselves.
+func clientIP(req *http.Request) string {
+	if os.Getenv("TRUST_PROXY") != "" {
+		forwarded := strings.Split(req.Header.Get("X-Forwarded-For"), ",")
+		if ip := strings.TrimSpace(forwarded[len(forwarded)-1]); ip != "" {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func bearerKey(req *http.Request) string {
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+}
+
+func introspectionHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		_, err := authenticateClient(req, database)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", "Basic realm=\"chat-auth\"")
+			formatter.JSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+			return
+		}
+		key := req.PostFormValue("token")
+		if key == "" {
+			formatter.JSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+			return
+		}
+		formatter.JSON(w, http.StatusOK, IntrospectToken(key, req.PostFormValue("token_type_hint"), database))
+	}
+}
+
+func registerClientHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		token, err := authenticatedUserToken(req, database)
+		if err != nil {
+			formatter.JSON(w, http.StatusUnauthorized, "Login required.")
+			return
+		}
+		if token.Scope == UnverifiedScope {
+			formatter.JSON(w, http.StatusForbidden, ErrEmailNotVerified.Error()+".")
+			return
+		}
+		var body struct {
+			Client
+			Confidential bool `json:"confidential"`
+		}
+		payload, _ := ioutil.ReadAll(req.Body)
+		err = json.Unmarshal(payload, &body)
+		if err != nil {
+			formatter.JSON(w, http.StatusBadRequest, "Failed to parse client.")
+			return
+		}
+		client := body.Client
+		client.OwnerID = token.UserID
+		secret := ""
+		if body.Confidential && !HasPermission(token.UserID, PermissionClientsManage, database) {
+			formatter.JSON(w, http.StatusForbidden, "Missing permission "+PermissionClientsManage+".")
+			return
+		}
+		if body.Confidential {
+			secret, err = client.generateSecret()
+			if err != nil {
+				formatter.JSON(w, http.StatusInternalServerError, "Failed to create client.")
+				return
+			}
+		}
+		err = client.Save(database)
+		if err != nil {
+			formatter.JSON(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		formatter.JSON(w, http.StatusCreated, struct {
+			Client
+			ClientSecret string `json:"client_secret,omitempty"`
+		}{client, secret})
+	}
+}
+
+func authorizeHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		request, err := ParseAuthorizationRequest(req.Form, database)
+		if err != nil {
+			authorizeErrorResponse(w, req, formatter, request, err)
+			return
+		}
+		token, err := authenticatedUserToken(req, database)
+		if err != nil {
+			formatter.JSON(w, http.StatusUnauthorized, "Login required.")
+			return
+		}
+		if req.Method == "POST" {
+			if req.PostFormValue("approve") != "true" {
+				authorizeErrorResponse(w, req, formatter, request, newOAuthError(OAuthErrorAccessDenied, "The user denied the request."))
+				return
+			}
+			err = GrantConsent(token.UserID, request, database)
+			if err != nil {
+				authorizeErrorResponse(w, req, formatter, request, err)
+				return
+			}
+		} else if !HasConsent(token.UserID, request, database) {
+			formatter.JSON(w, http.StatusOK, struct {
+				AuthorizationRequest
+				ConsentRequired bool `json:"consent_required"`
+			}{request, true})
+			return
+		}
+		redirectURI, err := IssueAuthorizationCode(token.UserID, request, database)
+		if err != nil {
+			authorizeErrorResponse(w, req, formatter, request, err)
+			return
+		}
+		http.Redirect(w, req, redirectURI, http.StatusFound)
+	}
+}
+
+func oauthTokenHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Pragma", "no-cache")
+		client, err := authenticateOAuthClient(req, database)
+		if err != nil {
+			formatter.JSON(w, http.StatusUnauthorized, newOAuthError(OAuthErrorInvalidClient, "Client authentication failed."))
+			return
+		}
+		var tokens TokenPair
+		switch req.PostFormValue("grant_type") {
+		case "authorization_code":
+			tokens, err = ExchangeAuthorizationCode(req.PostFormValue("code"), req.PostFormValue("redirect_uri"), req.PostFormValue("code_verifier"), client, database)
+		case "refresh_token":
+			tokens, err = RefreshClientTokens(req.PostFormValue("refresh_token"), client, database)
+		case "client_credentials":
+			tokens.Token, err = ClientCredentialsGrant(client, req.PostFormValue("scope"), database)
+		default:
+			err = newOAuthError(OAuthErrorUnsupportedGrantType, "Unsupported grant type.")
+		}
+		if err != nil {
+			oauthErr, ok := err.(*OAuthError)
+			if !ok {
+				formatter.JSON(w, http.StatusInternalServerError, newOAuthError(OAuthErrorServerError, ""))
+				return
+			}
+			formatter.JSON(w, http.StatusBadRequest, oauthErr)
+			return
+		}
+		formatter.JSON(w, http.StatusOK, newOAuthTokenResponse(tokens))
+	}
+}
+
+func authorizeErrorResponse(w http.ResponseWriter, req *http.Request, formatter *render.Render, request AuthorizationRequest, err error) {
+	oauthErr, ok := err.(*OAuthError)
+	if !ok {
+		oauthErr = newOAuthError(OAuthErrorServerError, "")
+	}
+	if request.RedirectURI == "" {
+		formatter.JSON(w, http.StatusBadRequest, oauthErr)
+		return
+	}
+	redirectURI, err := redirectURIWith(request.RedirectURI, url.Values{
+		"error":             {oauthErr.Code},
+		"error_description": {oauthErr.Description},
+		"state":             {request.State},
+	})
+	if err != nil {
+		formatter.JSON(w, http.StatusBadRequest, oauthErr)
+		return
+	}
+	http.Redirect(w, req, redirectURI, http.StatusFound)
+}
+
+func userInfoHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		token, err := CheckTokenKey(bearerKey(req), database)
+		if err != nil || !scopeCovers(token.Scope, "openid") {
+			w.Header().Set("WWW-Authenticate", "Bearer error=\"invalid_token\"")
+			formatter.JSON(w, http.StatusUnauthorized, newOAuthError("invalid_token", "An openid access token is required."))
+			return
+		}
+		info, err := GetUserInfo(token.UserID, token.Scope, database)
+		if err != nil {
+			formatter.JSON(w, http.StatusNotFound, "User not found.")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, info)
+	}
+}
+
+func openIDConfigurationHandler(formatter *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		config, err := GetOpenIDConfiguration()
+		if err != nil {
+			formatter.JSON(w, http.StatusNotFound, err.Error())
+			return
+		}
+		formatter.JSON(w, http.StatusOK, config)
+	}
+}
+
+func jwksHandler(formatter *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		formatter.JSON(w, http.StatusOK, currentKeyring().PublicKeys())
+	}
+}
+
+//permittedUserToken is authenticatedUserToken for users holding a permission,
+//it writes the error response when they do not
+func permittedUserToken(w http.ResponseWriter, req *http.Request, formatter *render.Render, database Database, permission string) (Token, bool) {
+	token, err := authenticatedUserToken(req, database)
+	if err != nil {
+		formatter.JSON(w, http.StatusUnauthorized, "Login required.")
+		return Token{}, false
+	}
+	if !HasPermission(token.UserID, permission, database) {
+		formatter.JSON(w, http.StatusForbidden, "Missing permission "+permission+".")
+		return Token{}, false
+	}
+	return token, true
+}
+
+func listRolesHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		_, err := authenticatedUserToken(req, database)
+		if err != nil {
+			formatter.JSON(w, http.StatusUnauthorized, "Login required.")
+			return
+		}
+		roles, err := database.getRoles()
+		if err != nil {
+			formatter.JSON(w, http.StatusInternalServerError, "Failed to load roles.")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, roles)
+	}
+}
+
+func userRolesHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		token, err := authenticatedUserToken(req, database)
+		if err != nil {
+			formatter.JSON(w, http.StatusUnauthorized, "Login required.")
+			return
+		}
+		id, err := strconv.ParseUint(mux.Vars(req)["id"], 10, 64)
+		if err != nil {
+			formatter.JSON(w, http.StatusNotFound, "User not found.")
+			return
+		}
+		if uint(id) != token.UserID && !HasPermission(token.UserID, PermissionRolesManage, database) {
+			formatter.JSON(w, http.StatusForbidden, "Missing permission "+PermissionRolesManage+".")
+			return
+		}
+		roles, err := UserRoles(uint(id), database)
+		if err != nil {
+			formatter.JSON(w, http.StatusInternalServerError, "Failed to load roles.")
+			return
+		}
+		permissions, err := database.getUserPermissions(uint(id))
+		if err != nil {
+			formatter.JSON(w, http.StatusInternalServerError, "Failed to load roles.")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, struct {
+			Roles       []string `json:"roles"`
+			Permissions []string `json:"permissions"`
+		}{roles, permissions})
+	}
+}
+
+func userRoleHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		token, ok := permittedUserToken(w, req, formatter, database, PermissionRolesManage)
+		if !ok {
+			return
+		}
+		vars := mux.Vars(req)
+		id, err := strconv.ParseUint(vars["id"], 10, 64)
+		if err != nil {
+			formatter.JSON(w, http.StatusNotFound, "User not found.")
+			return
+		}
+		message := "Role succesfully assigned."
+		if req.Method == "DELETE" {
+			message = "Role succesfully removed."
+			err = RemoveRole(token.UserID, uint(id), vars["role"], database)
+		} else {
+			err = AssignRole(token.UserID, uint(id), vars["role"], database)
+		}
+		if err != nil {
+			formatter.JSON(w, http.StatusBadRequest, err.Error()+".")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, message)
+	}
+}
+
+func rolePermissionHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		token, ok := permittedUserToken(w, req, formatter, database, PermissionRolesManage)
+		if !ok {
+			return
+		}
+		vars := mux.Vars(req)
+		var err error
+		message := "Permission succesfully granted."
+		if req.Method == "DELETE" {
+			message = "Permission succesfully revoked."
+			err = RevokePermission(token.UserID, vars["role"], vars["permission"], database)
+		} else {
+			err = GrantPermission(token.UserID, vars["role"], vars["permission"], database)
+		}
+		if err != nil {
+			formatter.JSON(w, http.StatusBadRequest, err.Error()+".")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, message)
+	}
+}
+
+func adminSearchUsersHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		_, ok := permittedUserToken(w, req, formatter, database, PermissionUsersRead)
+		if !ok {
+			return
+		}
+		query := req.URL.Query()
+		limit, _ := strconv.Atoi(query.Get("limit"))
+		offset, _ := strconv.Atoi(query.Get("offset"))
+		users, err := SearchUsers(query.Get("q"), limit, offset, database)
+		if err != nil {
+			formatter.JSON(w, http.StatusInternalServerError, "Failed to search users.")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, users)
+	}
+}
+
+func adminUserHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		_, ok := permittedUserToken(w, req, formatter, database, PermissionUsersRead)
+		if !ok {
+			return
+		}
+		id, err := strconv.ParseUint(mux.Vars(req)["id"], 10, 64)
+		if err != nil {
+			formatter.JSON(w, http.StatusNotFound, "User not found.")
+			return
+		}
+		detail, err := GetUserDetail(uint(id), database)
+		if err != nil {
+			formatter.JSON(w, http.StatusNotFound, err.Error()+".")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, detail)
+	}
+}
+
+//adminUserActionHandler runs an admin action on the user in the path
+func adminUserActionHandler(formatter *render.Render, database Database, action func(actorID, userID uint, database Database) error, message string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		token, ok := permittedUserToken(w, req, formatter, database, PermissionUsersManage)
+		if !ok {
+			return
+		}
+		id, err := strconv.ParseUint(mux.Vars(req)["id"], 10, 64)
+		if err != nil {
+			formatter.JSON(w, http.StatusNotFound, "User not found.")
+			return
+		}
+		err = action(token.UserID, uint(id), database)
+		if err != nil {
+			formatter.JSON(w, http.StatusBadRequest, err.Error()+".")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, message)
+	}
+}
+
+//adminRestrictUserHandler suspends or bans the user in the path. The end is
+//sent as a time in until or as a duration in seconds.
+func adminRestrictUserHandler(formatter *render.Render, database Database, restrict func(actorID, userID uint, reason string, until time.Time, database Database) error, message string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		token, ok := permittedUserToken(w, req, formatter, database, PermissionUsersManage)
+		if !ok {
+			return
+		}
+		id, err := strconv.ParseUint(mux.Vars(req)["id"], 10, 64)
+		if err != nil {
+			formatter.JSON(w, http.StatusNotFound, "User not found.")
+			return
+		}
+		var body struct {
+			Reason   string    `json:"reason"`
+			Until    time.Time `json:"until"`
+			Duration int64     `json:"duration"`
+		}
+		payload, _ := ioutil.ReadAll(req.Body)
+		err = json.Unmarshal(payload, &body)
+		if err != nil || body.Reason == "" {
+			formatter.JSON(w, http.StatusBadRequest, "A reason is required.")
+			return
+		}
+		until := body.Until
+		if body.Duration > 0 {
+			until = time.Now().Add(time.Duration(body.Duration) * time.Second)
+		}
+		err = restrict(token.UserID, uint(id), body.Reason, until, database)
+		if err != nil {
+			formatter.JSON(w, http.StatusBadRequest, err.Error()+".")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, message)
+	}
+}
+
+func meHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		token, err := authenticatedUserToken(req, database)
+		if err != nil {
+			formatter.JSON(w, http.StatusUnauthorized, "Login required.")
+			return
+		}
+		profile, err := GetProfile(token.UserID, database)
+		if err != nil {
+			formatter.JSON(w, http.StatusNotFound, err.Error()+".")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, profile)
+	}
+}
+
+func updateMeHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		token, err := authenticatedUserToken(req, database)
+		if err != nil {
+			formatter.JSON(w, http.StatusUnauthorized, "Login required.")
+			return
+		}
+		var body struct {
+			Username *string `json:"username"`
+		}
+		payload, _ := ioutil.ReadAll(req.Body)
+		err = json.Unmarshal(payload, &body)
+		if err != nil {
+			formatter.JSON(w, http.StatusBadRequest, "Failed to parse profile.")
+			return
+		}
+		if body.Username != nil {
+			err = UpdateUsername(token.UserID, *body.Username, database)
+			if err != nil {
+				formatter.JSON(w, http.StatusBadRequest, err.Error()+".")
+				return
+			}
+		}
+		profile, err := GetProfile(token.UserID, database)
+		if err != nil {
+			formatter.JSON(w, http.StatusNotFound, err.Error()+".")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, profile)
+	}
+}
+
+func changePasswordHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		token, err := authenticatedUserToken(req, database)
+		if err != nil {
+			formatter.JSON(w, http.StatusUnauthorized, "Login required.")
+			return
+		}
+		var body struct {
+			CurrentPassword string `json:"current_password"`
+			Password        string `json:"password"`
+		}
+		payload, _ := ioutil.ReadAll(req.Body)
+		err = json.Unmarshal(payload, &body)
+		if err != nil || body.CurrentPassword == "" {
+			formatter.JSON(w, http.StatusBadRequest, "Failed to parse password.")
+			return
+		}
+		err = ChangePassword(token, body.CurrentPassword, body.Password, clientIP(req), database)
+		if locked, ok := err.(*LoginLockedError); ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(locked.RetryAfter.Seconds()+0.5)))
+			formatter.JSON(w, http.StatusTooManyRequests, locked.Error())
+			return
+		}
+		if policyErr, ok := err.(*PasswordPolicyError); ok {
+			formatter.JSON(w, http.StatusBadRequest, policyErr)
+			return
+		}
+		if err == ErrIncorrectPassword {
+			formatter.JSON(w, http.StatusForbidden, err.Error()+".")
+			return
+		}
+		if err != nil {
+			formatter.JSON(w, http.StatusInternalServerError, "Failed to change password.")
+			return
+		}
+		formatter.JSON(w, http.StatusOK, "Password succesfully changed.")
+	}
+}
+
+func changeEmailHandler(formatter *render.Render, database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		token, err := authenticatedUserToken(req, database)
+		if err != nil {
+			formatter.JSON(w, http.StatusUnauthorized, "Login required.")
+			return
+		}
+		var body struct {
+			Email    string `json:"email"`
+			Password string `json:"password"`
+		}
+		payload, _ := ioutil.ReadAll(req.Body)
+		err = json.Unmarshal(payload, &body)
+		if err != nil || body.Email == "" {
+			formatter.JSON(w, http.StatusBadRequest, "Failed to parse email.")
+			return
+		}
+		err = RequestEmailChange(token.UserID, body.Password, body.Email, clientIP(req), database)
+		if locked, ok := err.(*LoginLockedError); ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(locked.RetryAfter.Seconds()+0.5)))
+			formatter.JSON(w, http.StatusTooManyRequests, locked.Error())
+			return
+		}
+		if err == ErrIncorrectPassword {
+			formatter.JSON(w, http.StatusForbidden, err.Error()+".")
+			return
+		}
+		if err != nil {
+			formatter.JSON(w, http.StatusBadRequest, err.Error()+".")
+			return
+		}
+		formatter.JSON(w, http.StatusAccepted, "Confirmation sent to the new email address.")
 	}
 }
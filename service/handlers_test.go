@@ -5,12 +5,15 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/unrolled/render"
 	"github.com/urfave/negroni"
+	"golang.org/x/crypto/bcrypt"
 )
 
 var (
@@ -198,6 +201,327 @@ func TestGetTokenValidationValidToken(t *testing.T) {
 	if tokenResponse.Key != "test" {
 		t.Errorf("Expected token key to be test; received %s", token.Key)
 	}
+
+	var validation TokenValidation
+	json.Unmarshal(recorder.Body.Bytes(), &validation)
+	if validation.Status != TokenStatusValid || validation.TTL <= 0 {
+		t.Errorf("Expected valid status with a ttl; received %s %d", validation.Status, validation.TTL)
+	}
+}
+
+func TestGetTokenValidationExpiredToken(t *testing.T) {
+	var (
+		request  *http.Request
+		recorder *httptest.ResponseRecorder
+	)
+	database := &testDatabase{}
+
+	server := MakeTestServer(database)
+	token := &Token{Key: "test", ExpiresAt: time.Now().AddDate(0, 0, -1).Unix()}
+	token.Save(database)
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/auth/token/"+token.Key, nil)
+	server.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected %v; received %v", http.StatusUnauthorized, recorder.Code)
+	}
+
+	var validation TokenValidation
+	json.Unmarshal(recorder.Body.Bytes(), &validation)
+	if validation.Status != TokenStatusExpired {
+		t.Errorf("Expected status %s; received %s", TokenStatusExpired, validation.Status)
+	}
+}
+
+func TestRefreshTokenHandler(t *testing.T) {
+	var (
+		request  *http.Request
+		recorder *httptest.ResponseRecorder
+	)
+	database := &testDatabase{}
+	server := MakeTestServer(database)
+	tokens, _ := issueTokenPair(RefreshToken{UserID: 1, FamilyID: "family", ExpiresAt: getRefreshExpiresAtTime()}, database)
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/auth/token/refresh", bytes.NewBufferString("not json"))
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected %v; received %v", http.StatusBadRequest, recorder.Code)
+	}
+
+	body := []byte("{\"refresh_token\":\"" + tokens.RefreshToken + "\"}")
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/auth/token/refresh", bytes.NewBuffer(body))
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected %v; received %v", http.StatusOK, recorder.Code)
+	}
+	var rotated TokenPair
+	json.Unmarshal(recorder.Body.Bytes(), &rotated)
+	if rotated.Key == "" || rotated.RefreshToken == "" || rotated.RefreshToken == tokens.RefreshToken {
+		t.Error("Expected a rotated token pair")
+	}
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/auth/token/refresh", bytes.NewBuffer(body))
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected reused refresh token to return %v; received %v", http.StatusUnauthorized, recorder.Code)
+	}
+}
+
+func TestLogoutUserHandler(t *testing.T) {
+	var (
+		request  *http.Request
+		recorder *httptest.ResponseRecorder
+	)
+	database := &testDatabase{}
+
+	server := MakeTestServer(database)
+	token := &Token{Key: "test", ExpiresAt: time.Now().AddDate(0, 2, 0).Unix()}
+	token.Save(database)
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/auth/logout", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected %v; received %v", http.StatusUnauthorized, recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/auth/logout", nil)
+	request.Header.Set("Authorization", "Bearer "+token.Key)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected %v; received %v", http.StatusOK, recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/auth/token/"+token.Key, nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected revoked token to return %v; received %v", http.StatusUnauthorized, recorder.Code)
+	}
+}
+
+func TestIntrospectionHandler(t *testing.T) {
+	var (
+		request  *http.Request
+		recorder *httptest.ResponseRecorder
+	)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	database := &testDatabase{clients: []Client{{ClientID: "gateway", SecretHash: string(hash)}}}
+	server := MakeTestServer(database)
+	token := &Token{Key: "test", UserID: 1, ExpiresAt: time.Now().Add(time.Hour).Unix()}
+	token.Save(database)
+
+	form := url.Values{"token": {token.Key}, "token_type_hint": {TokenTypeHintAccessToken}}
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/auth/introspect", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.SetBasicAuth("gateway", "wrong")
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected %v; received %v", http.StatusUnauthorized, recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/auth/introspect", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.SetBasicAuth("gateway", "secret")
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected %v; received %v", http.StatusOK, recorder.Code)
+	}
+	var introspection Introspection
+	json.Unmarshal(recorder.Body.Bytes(), &introspection)
+	if !introspection.Active || introspection.Sub != "1" {
+		t.Errorf("Expected active token for user 1, got %+v", introspection)
+	}
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/auth/introspect", strings.NewReader("client_id=gateway&client_secret=secret"))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected missing token to return %v; received %v", http.StatusBadRequest, recorder.Code)
+	}
+}
+
+func TestOAuthAuthorizationCodeFlow(t *testing.T) {
+	var (
+		request  *http.Request
+		recorder *httptest.ResponseRecorder
+	)
+	database := &testDatabase{}
+	server := MakeTestServer(database)
+	user := User{Username: "testname", Password: "password", Email: "test@mail.com"}
+	user.Save(database)
+	userToken := &Token{Key: "user", UserID: 1, ExpiresAt: time.Now().Add(time.Hour).Unix()}
+	userToken.Save(database)
+
+	body := []byte("{\"name\":\"bot\",\"redirect_uris\":[\"https://bot.example.com/callback\"],\"scope\":\"chat\"}")
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/oauth/clients", bytes.NewBuffer(body))
+	request.Header.Set("Authorization", "Bearer user")
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected %v; received %v", http.StatusCreated, recorder.Code)
+	}
+	var client Client
+	json.Unmarshal(recorder.Body.Bytes(), &client)
+
+	authorize := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.ClientID},
+		"redirect_uri":          {"https://bot.example.com/callback"},
+		"scope":                 {"chat"},
+		"state":                 {"xyz"},
+		"code_challenge":        {testCodeChallenge(testVerifier)},
+		"code_challenge_method": {"S256"},
+	}
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/oauth/authorize?"+authorize.Encode(), nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected anonymous authorize to return %v; received %v", http.StatusUnauthorized, recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/oauth/authorize?"+authorize.Encode(), nil)
+	request.Header.Set("Authorization", "Bearer user")
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), "consent_required") {
+		t.Errorf("Expected consent to be required; received %v", recorder.Code)
+	}
+
+	authorize.Set("approve", "true")
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/oauth/authorize", strings.NewReader(authorize.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Authorization", "Bearer user")
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("Expected %v; received %v", http.StatusFound, recorder.Code)
+	}
+	location, _ := url.Parse(recorder.Header().Get("Location"))
+	code := location.Query().Get("code")
+
+	exchange := url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {client.ClientID},
+		"code":          {code},
+		"redirect_uri":  {"https://bot.example.com/callback"},
+		"code_verifier": {testVerifier},
+	}
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/oauth/token", strings.NewReader(exchange.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected %v; received %v %s", http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+	var tokens OAuthTokenResponse
+	json.Unmarshal(recorder.Body.Bytes(), &tokens)
+	if tokens.AccessToken == "" || tokens.RefreshToken == "" || tokens.TokenType != "Bearer" || tokens.Scope != "chat" {
+		t.Errorf("Expected an oauth token response, got %+v", tokens)
+	}
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/oauth/authorize?"+authorize.Encode(), nil)
+	request.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected client tokens to be refused at authorize; received %v", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/oauth/authorize?"+authorize.Encode(), nil)
+	request.Header.Set("Authorization", "Bearer user")
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusFound {
+		t.Errorf("Expected existing consent to redirect straight away; received %v", recorder.Code)
+	}
+
+	refresh := url.Values{"grant_type": {"refresh_token"}, "client_id": {client.ClientID}, "refresh_token": {tokens.RefreshToken}}
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/oauth/token", strings.NewReader(refresh.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected refresh grant to return %v; received %v", http.StatusOK, recorder.Code)
+	}
+}
+
+func TestOAuthClientCredentialsFlow(t *testing.T) {
+	var (
+		request  *http.Request
+		recorder *httptest.ResponseRecorder
+	)
+	database := &testDatabase{}
+	server := MakeTestServer(database)
+	userToken := &Token{Key: "user", UserID: 1, ExpiresAt: time.Now().Add(time.Hour).Unix()}
+	userToken.Save(database)
+
+	body := []byte("{\"name\":\"presence\",\"confidential\":true,\"grant_types\":[\"client_credentials\"],\"scope\":\"presence:write\"}")
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/oauth/clients", bytes.NewBuffer(body))
+	request.Header.Set("Authorization", "Bearer user")
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusForbidden {
+		t.Fatalf("Expected confidential clients to need %s; received %v", PermissionClientsManage, recorder.Code)
+	}
+
+	database.addUserRole(1, RoleAdmin, 0)
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/oauth/clients", bytes.NewBuffer(body))
+	request.Header.Set("Authorization", "Bearer user")
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected %v; received %v %s", http.StatusCreated, recorder.Code, recorder.Body.String())
+	}
+	var client struct {
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &client)
+	if client.ClientSecret == "" || strings.Contains(recorder.Body.String(), "SecretHash") {
+		t.Fatal("Expected the client secret to be returned once and the hash never")
+	}
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/oauth/token", strings.NewReader("grant_type=client_credentials"))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.SetBasicAuth(client.ClientID, client.ClientSecret)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected %v; received %v %s", http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+	var tokens OAuthTokenResponse
+	json.Unmarshal(recorder.Body.Bytes(), &tokens)
+	if tokens.AccessToken == "" || tokens.RefreshToken != "" || tokens.Scope != "presence:write" {
+		t.Errorf("Expected a scoped access token without a refresh token, got %+v", tokens)
+	}
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/auth/token/"+tokens.AccessToken, nil)
+	server.ServeHTTP(recorder, request)
+	var validation TokenValidation
+	json.Unmarshal(recorder.Body.Bytes(), &validation)
+	if validation.Status != TokenStatusValid || validation.Kind != TokenKindClient || validation.ClientID != client.ClientID {
+		t.Errorf("Expected validation to identify the client token, got %s", recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/oauth/token", strings.NewReader("grant_type=client_credentials"))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.SetBasicAuth(client.ClientID, "wrong")
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected wrong secret to return %v; received %v", http.StatusUnauthorized, recorder.Code)
+	}
 }
 
 func MakeTestServer(database *testDatabase) *negroni.Negroni {
@@ -207,3 +531,19 @@ func MakeTestServer(database *testDatabase) *negroni.Negroni {
 	server.UseHandler(mx)
 	return server
 }
+
+//bearerRequest sends a request to server authorized with key
+func bearerRequest(server http.Handler, method, path, key, body string) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+	request.Header.Set("Authorization", "Bearer "+key)
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, request)
+	return recorder
+}
+
+//saveTestUser saves the user most tests log in as, Testname with testpassword
+func saveTestUser(database *testDatabase) User {
+	user := User{Username: "Testname", Password: "testpassword", Email: "test@mail.com"}
+	user.Save(database)
+	return user
+}
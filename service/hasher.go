@@ -0,0 +1,170 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+//Password hashing algorithms, set with PASSWORD_HASHER
+const (
+	HasherBcrypt   = "bcrypt"
+	HasherArgon2id = "argon2id"
+)
+
+//PasswordHasher hashes passwords into self describing encoded strings
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	Verify(encoded, password string) bool
+	//NeedsRehash reports whether an encoded hash was made with other parameters
+	NeedsRehash(encoded string) bool
+}
+
+//BcryptHasher hashes with bcrypt at Cost
+type BcryptHasher struct {
+	Cost int
+}
+
+//Argon2idHasher hashes with argon2id, encoded in the PHC string format
+//$argon2id$v=19$m=<memory KiB>,t=<time>,p=<threads>$<salt>$<key>
+type Argon2idHasher struct {
+	Time      uint32
+	Memory    uint32
+	Threads   uint8
+	SaltLen   int
+	KeyLength uint32
+}
+
+var argon2Encoding = base64.RawStdEncoding
+
+//currentHasher is the hasher new passwords are hashed with, configured with
+//PASSWORD_HASHER, BCRYPT_COST, ARGON2_TIME, ARGON2_MEMORY and ARGON2_THREADS.
+//bcrypt stays the default, argon2id needs ARGON2_MEMORY KiB for every login
+//in flight.
+func currentHasher() PasswordHasher {
+	if os.Getenv("PASSWORD_HASHER") != HasherArgon2id {
+		return BcryptHasher{Cost: envInt("BCRYPT_COST", bcrypt.DefaultCost)}
+	}
+	return Argon2idHasher{
+		Time:      uint32(envInt("ARGON2_TIME", 3)),
+		Memory:    uint32(envInt("ARGON2_MEMORY", 64*1024)),
+		Threads:   uint8(envInt("ARGON2_THREADS", 4)),
+		SaltLen:   16,
+		KeyLength: 32,
+	}
+}
+
+//hasherFor returns a hasher able to verify the encoded hash
+func hasherFor(encoded string) PasswordHasher {
+	if strings.HasPrefix(encoded, "$"+HasherArgon2id+"$") {
+		return Argon2idHasher{}
+	}
+	return BcryptHasher{}
+}
+
+func hashPassword(password string) (string, error) {
+	return currentHasher().Hash(password)
+}
+
+func verifyPassword(encoded, password string) bool {
+	return hasherFor(encoded).Verify(encoded, password)
+}
+
+//passwordNeedsRehash reports whether the hash is not what currentHasher would make
+func passwordNeedsRehash(encoded string) bool {
+	current := currentHasher()
+	if _, ok := current.(Argon2idHasher); ok != strings.HasPrefix(encoded, "$"+HasherArgon2id+"$") {
+		return true
+	}
+	return current.NeedsRehash(encoded)
+}
+
+//Hash returns the bcrypt hash of password
+func (h BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	return string(hash), err
+}
+
+//Verify compares password with a bcrypt hash
+func (h BcryptHasher) Verify(encoded, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password)) == nil
+}
+
+//NeedsRehash reports whether the hash used another cost
+func (h BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.Cost
+}
+
+//Hash returns the encoded argon2id hash of password with a random salt
+func (h Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.SaltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, h.KeyLength)
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s", HasherArgon2id, argon2.Version, h.Memory, h.Time, h.Threads,
+		argon2Encoding.EncodeToString(salt), argon2Encoding.EncodeToString(key)), nil
+}
+
+//Verify recomputes the key with the parameters and salt in the encoded hash
+func (h Argon2idHasher) Verify(encoded, password string) bool {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false
+	}
+	computed := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(computed, key) == 1
+}
+
+//NeedsRehash reports whether the hash used other parameters
+func (h Argon2idHasher) NeedsRehash(encoded string) bool {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	return params.Time != h.Time || params.Memory != h.Memory || params.Threads != h.Threads ||
+		len(salt) != h.SaltLen || uint32(len(key)) != h.KeyLength
+}
+
+func decodeArgon2id(encoded string) (Argon2idHasher, []byte, []byte, error) {
+	var params Argon2idHasher
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != HasherArgon2id || parts[2] != "v="+strconv.Itoa(argon2.Version) {
+		return params, nil, nil, errors.New("Invalid argon2id hash")
+	}
+	var threads uint32
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &threads)
+	if err != nil || params.Time == 0 || threads == 0 || threads > 255 {
+		return params, nil, nil, errors.New("Invalid argon2id parameters")
+	}
+	params.Threads = uint8(threads)
+	salt, err := argon2Encoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	key, err := argon2Encoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, errors.New("Invalid argon2id key")
+	}
+	params.SaltLen = len(salt)
+	params.KeyLength = uint32(len(key))
+	return params, salt, key, nil
+}
+
+func envInt(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
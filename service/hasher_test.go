@@ -0,0 +1,75 @@
+package service
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordHashers(t *testing.T) {
+	hashers := []PasswordHasher{
+		BcryptHasher{Cost: bcrypt.MinCost},
+		Argon2idHasher{Time: 1, Memory: 1024, Threads: 1, SaltLen: 16, KeyLength: 32},
+	}
+	for _, hasher := range hashers {
+		encoded, err := hasher.Hash("testpassword")
+		if err != nil {
+			t.Fatalf("Failed to hash: %v", err)
+		}
+		if !verifyPassword(encoded, "testpassword") || verifyPassword(encoded, "wrongpassword") {
+			t.Errorf("%T hash did not verify correctly", hasher)
+		}
+		if hasher.NeedsRehash(encoded) {
+			t.Errorf("%T hash should not need a rehash with the same parameters", hasher)
+		}
+	}
+}
+
+func TestArgon2idEncoding(t *testing.T) {
+	hasher := Argon2idHasher{Time: 2, Memory: 1024, Threads: 2, SaltLen: 16, KeyLength: 32}
+	encoded, _ := hasher.Hash("testpassword")
+	if !strings.HasPrefix(encoded, "$argon2id$v=19$m=1024,t=2,p=2$") {
+		t.Errorf("Unexpected encoding %s", encoded)
+	}
+	stronger := hasher
+	stronger.Memory = 2048
+	if !stronger.NeedsRehash(encoded) {
+		t.Error("Hash with weaker parameters should need a rehash")
+	}
+	for _, invalid := range []string{"", "$argon2id$v=19$m=1024,t=0,p=2$c2FsdA$a2V5", "$argon2i$v=19$m=1024,t=2,p=2$c2FsdA$a2V5"} {
+		if hasher.Verify(invalid, "testpassword") {
+			t.Errorf("Invalid hash %q should not verify", invalid)
+		}
+	}
+}
+
+func TestUserLoginRehashesPassword(t *testing.T) {
+	database := &testDatabase{}
+	user := User{Username: "Testname", Password: "testpassword", Email: "test@mail.com"}
+	user.Save(database)
+	os.Setenv("PASSWORD_HASHER", HasherArgon2id)
+	os.Setenv("ARGON2_MEMORY", "1024")
+	defer os.Unsetenv("PASSWORD_HASHER")
+	defer os.Unsetenv("ARGON2_MEMORY")
+	if !strings.HasPrefix(database.users[0].Password, "$2a$") {
+		t.Fatalf("Expected a bcrypt hash; got %s", database.users[0].Password)
+	}
+
+	_, err := UserLogin("Testname", "testpassword", database)
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	rehashed := database.users[0].Password
+	if !strings.HasPrefix(rehashed, "$argon2id$v=19$m=1024,") {
+		t.Fatalf("Expected an argon2id hash after login; got %s", rehashed)
+	}
+	_, err = UserLogin("Testname", "testpassword", database)
+	if err != nil {
+		t.Fatalf("Login with the rehashed password failed: %v", err)
+	}
+	if database.users[0].Password != rehashed {
+		t.Error("An up to date hash should not be rehashed")
+	}
+}
@@ -0,0 +1,77 @@
+package service
+
+import "strconv"
+
+//Token type hints accepted by introspection
+const (
+	TokenTypeHintAccessToken  = "access_token"
+	TokenTypeHintRefreshToken = "refresh_token"
+)
+
+//Introspection is an RFC 7662 token introspection response
+type Introspection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+	Sub       string `json:"sub,omitempty"`
+	Aud       string `json:"aud,omitempty"`
+	Iss       string `json:"iss,omitempty"`
+}
+
+//IntrospectToken describes an access or refresh token. The hint only decides
+//which kind of token is looked up first.
+func IntrospectToken(key, hint string, database Database) Introspection {
+	if hint == TokenTypeHintRefreshToken {
+		if introspection := introspectRefreshToken(key, database); introspection.Active {
+			return introspection
+		}
+		return introspectAccessToken(key, database)
+	}
+	if introspection := introspectAccessToken(key, database); introspection.Active {
+		return introspection
+	}
+	return introspectRefreshToken(key, database)
+}
+
+func introspectAccessToken(key string, database Database) Introspection {
+	validation := ValidateTokenKey(key, database)
+	if validation.Status != TokenStatusValid {
+		return Introspection{Active: false}
+	}
+	token := validation.Token
+	sub := strconv.FormatUint(uint64(token.UserID), 10)
+	if token.isClient() {
+		sub = token.ClientID
+	}
+	return Introspection{
+		Active:    true,
+		Scope:     token.Scope,
+		ClientID:  token.ClientID,
+		TokenType: "Bearer",
+		Exp:       token.ExpiresAt,
+		Iat:       token.CreatedAt.Unix(),
+		Sub:       sub,
+		Aud:       getAudience(),
+		Iss:       getIssuer(),
+	}
+}
+
+func introspectRefreshToken(key string, database Database) Introspection {
+	refreshToken, err := database.getRefreshTokenByHash(hashKey(key))
+	if err != nil || refreshToken.isRevoked() || refreshToken.isRotated() || !refreshToken.isValid() {
+		return Introspection{Active: false}
+	}
+	return Introspection{
+		Active:    true,
+		Scope:     refreshToken.Scope,
+		ClientID:  refreshToken.ClientID,
+		TokenType: TokenTypeHintRefreshToken,
+		Exp:       refreshToken.ExpiresAt,
+		Iat:       refreshToken.CreatedAt.Unix(),
+		Sub:       strconv.FormatUint(uint64(refreshToken.UserID), 10),
+		Iss:       getIssuer(),
+	}
+}
@@ -0,0 +1,39 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIntrospectToken(t *testing.T) {
+	database := &testDatabase{}
+	database.addToken(&Token{Key: "access", UserID: 3, Scope: "chat", ClientID: "web", ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	database.addToken(&Token{Key: "expired", UserID: 3, ExpiresAt: time.Now().AddDate(0, 0, -1).Unix()})
+	refreshToken := RefreshToken{Key: "refresh", UserID: 3, FamilyID: "family", ExpiresAt: time.Now().Add(time.Hour).Unix()}
+	refreshToken.Save(database)
+
+	access := IntrospectToken("access", "", database)
+	if !access.Active || access.Sub != "3" || access.Scope != "chat" || access.ClientID != "web" || access.Exp == 0 {
+		t.Errorf("Expected active access token introspection, got %+v", access)
+	}
+
+	refresh := IntrospectToken("refresh", TokenTypeHintRefreshToken, database)
+	if !refresh.Active || refresh.TokenType != TokenTypeHintRefreshToken || refresh.Sub != "3" {
+		t.Errorf("Expected active refresh token introspection, got %+v", refresh)
+	}
+
+	if !IntrospectToken("refresh", TokenTypeHintAccessToken, database).Active {
+		t.Error("Expected a wrong hint to fall back to the other token type")
+	}
+
+	for _, key := range []string{"expired", "unknown"} {
+		if introspection := IntrospectToken(key, "", database); introspection != (Introspection{}) {
+			t.Errorf("Expected only active false for %s, got %+v", key, introspection)
+		}
+	}
+
+	database.rotateRefreshToken(hashKey("refresh"))
+	if IntrospectToken("refresh", TokenTypeHintRefreshToken, database).Active {
+		t.Error("Expected rotated refresh token to be inactive")
+	}
+}
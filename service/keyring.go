@@ -0,0 +1,192 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+//KEYRING holds the signing keys, HS256 with SECRET_KEY when nil
+var KEYRING *Keyring
+
+//retiredKeyGrace is how long a retired key keeps verifying. The keyring also
+//signs email verification links, which outlive every token key.
+const retiredKeyGrace = verificationLinkTTL
+
+//Signing key states
+const (
+	KeyStateActive     = "active"
+	KeyStateVerifyOnly = "verify-only"
+	KeyStateRetired    = "retired"
+)
+
+//Keyring holds every signing key. The most recently activated key signs new
+//token keys, the others only verify until they are retired.
+type Keyring struct {
+	Keys []*SigningKey
+}
+
+type keyringEntry struct {
+	Kid        string    `json:"kid"`
+	Alg        string    `json:"alg"`
+	KeyFile    string    `json:"key_file"`
+	ActivateAt time.Time `json:"activate_at"`
+	RetireAt   time.Time `json:"retire_at"`
+}
+
+//NewKeyring returns a keyring holding keys
+func NewKeyring(keys ...*SigningKey) *Keyring {
+	return &Keyring{Keys: keys}
+}
+
+//LoadKeyring reads a JSON list of keys with their rotation schedule.
+//Key files are relative to the keyring file.
+func LoadKeyring(path string) (*Keyring, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []keyringEntry
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return nil, err
+	}
+	keyring := NewKeyring()
+	for _, entry := range entries {
+		keyFile := entry.KeyFile
+		if !filepath.IsAbs(keyFile) {
+			keyFile = filepath.Join(filepath.Dir(path), keyFile)
+		}
+		key, err := LoadSigningKey(entry.Alg, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load key %s: %v", entry.Kid, err)
+		}
+		if entry.Kid != "" {
+			key.ID = entry.Kid
+		}
+		key.ActivateAt = entry.ActivateAt
+		key.RetireAt = entry.RetireAt
+		if keyring.key(key.ID) != nil {
+			return nil, fmt.Errorf("Duplicate key id %s", key.ID)
+		}
+		keyring.Keys = append(keyring.Keys, key)
+	}
+	return keyring, nil
+}
+
+//currentKeyring falls back to SECRET_KEY when no keyring is loaded. To rotate
+//the secret move the old one to PREVIOUS_SECRET_KEY, it only verifies.
+func currentKeyring() *Keyring {
+	if KEYRING != nil {
+		return KEYRING
+	}
+	secret := []byte(os.Getenv("SECRET_KEY"))
+	keyring := NewKeyring(&SigningKey{Method: jwt.SigningMethodHS256, Private: secret, Public: secret})
+	if previous := os.Getenv("PREVIOUS_SECRET_KEY"); previous != "" {
+		secret = []byte(previous)
+		keyring.Keys = append(keyring.Keys, &SigningKey{Method: jwt.SigningMethodHS256, Public: secret})
+	}
+	return keyring
+}
+
+//State of a key at a point in time
+func (k *Keyring) State(key *SigningKey, now time.Time) string {
+	if !key.RetireAt.IsZero() && !now.Before(key.RetireAt) {
+		return KeyStateRetired
+	}
+	if active := k.active(now); active == key {
+		return KeyStateActive
+	}
+	return KeyStateVerifyOnly
+}
+
+func (k *Keyring) active(now time.Time) *SigningKey {
+	var active *SigningKey
+	for _, key := range k.Keys {
+		if key.ActivateAt.After(now) || (!key.RetireAt.IsZero() && !now.Before(key.RetireAt)) {
+			continue
+		}
+		if active == nil || key.ActivateAt.After(active.ActivateAt) {
+			active = key
+		}
+	}
+	return active
+}
+
+func (k *Keyring) key(id string) *SigningKey {
+	for _, key := range k.Keys {
+		if key.ID == id {
+			return key
+		}
+	}
+	return nil
+}
+
+//verifies reports whether a key still verifies token keys, retired keys do
+//until the tokens they signed have expired
+func (k *Keyring) verifies(key *SigningKey, now time.Time) bool {
+	return key.RetireAt.IsZero() || now.Before(key.RetireAt.Add(retiredKeyGrace))
+}
+
+func (k *Keyring) sign(claims jwt.Claims) (string, error) {
+	key := k.active(time.Now())
+	if key == nil {
+		return "", errors.New("No active signing key")
+	}
+	return key.sign(claims)
+}
+
+//verificationKey finds the key named by the kid header, keys without a kid
+//verify tokens signed before key ids were added. When several keys share a
+//kid, like SECRET_KEY and PREVIOUS_SECRET_KEY, the one whose signature
+//matches is used.
+func (k *Keyring) verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	var candidates []*SigningKey
+	for _, key := range k.Keys {
+		if key.ID == kid {
+			candidates = append(candidates, key)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("Unknown signing key %s", kid)
+	}
+	now := time.Now()
+	key := candidates[0]
+	if len(candidates) > 1 {
+		split := strings.LastIndex(token.Raw, ".")
+		for _, candidate := range candidates {
+			if token.Method.Verify(token.Raw[:split], token.Raw[split+1:], candidate.Public) == nil {
+				key = candidate
+				break
+			}
+		}
+	}
+	if !k.verifies(key, now) {
+		return nil, fmt.Errorf("Signing key %s has been retired", kid)
+	}
+	return key.verificationKey(token)
+}
+
+//PublicKeys returns every key that can still verify token keys, secrets are never included
+func (k *Keyring) PublicKeys() JWKS {
+	jwks := JWKS{Keys: []JWK{}}
+	now := time.Now()
+	for _, key := range k.Keys {
+		if key.isSymmetric() || !k.verifies(key, now) {
+			continue
+		}
+		jwk, err := key.jwk()
+		if err == nil {
+			jwks.Keys = append(jwks.Keys, jwk)
+		}
+	}
+	return jwks
+}
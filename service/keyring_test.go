@@ -0,0 +1,134 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestKeyringRotation(t *testing.T) {
+	defer func() { KEYRING = nil }()
+	keys := testSigningKeys(t)
+	for _, path := range keys {
+		defer os.Remove(path)
+	}
+	now := time.Now()
+	oldKey, _ := LoadSigningKey("ES256", keys["ES256"])
+	oldKey.ActivateAt = now.Add(-2 * time.Hour)
+	newKey, _ := LoadSigningKey("EdDSA", keys["EdDSA"])
+	newKey.ActivateAt = now.Add(-time.Hour)
+	nextKey, _ := LoadSigningKey("RS256", keys["RS256"])
+	nextKey.ActivateAt = now.Add(time.Hour)
+	KEYRING = NewKeyring(oldKey, newKey, nextKey)
+
+	if KEYRING.State(newKey, now) != KeyStateActive {
+		t.Error("Expected most recently activated key to be active")
+	}
+	if KEYRING.State(oldKey, now) != KeyStateVerifyOnly || KEYRING.State(nextKey, now) != KeyStateVerifyOnly {
+		t.Error("Expected superseded and scheduled keys to be verify-only")
+	}
+	if KEYRING.State(nextKey, now.Add(2*time.Hour)) != KeyStateActive {
+		t.Error("Expected scheduled key to become active")
+	}
+
+	claims, _ := newClaims(Token{UserID: 1, ExpiresAt: now.Add(time.Hour).Unix()})
+	oldTokenKey, _ := oldKey.sign(claims)
+	if _, err := VerifyKey(oldTokenKey); err != nil {
+		t.Errorf("Expected key signed with superseded key to verify, got %v", err)
+	}
+
+	tokenKey, _ := generateKey(Token{UserID: 1, ExpiresAt: now.Add(time.Hour).Unix()})
+	token, _, _ := new(jwt.Parser).ParseUnverified(tokenKey, &Claims{})
+	if token.Header["kid"] != newKey.ID {
+		t.Error("Expected new keys to be signed by the active key")
+	}
+
+	if len(KEYRING.PublicKeys().Keys) != 3 {
+		t.Error("Expected every unretired key to be published")
+	}
+
+	oldKey.RetireAt = now.Add(-time.Minute)
+	if KEYRING.State(oldKey, now) != KeyStateRetired {
+		t.Error("Expected key to be retired")
+	}
+	if _, err := VerifyKey(oldTokenKey); err != nil {
+		t.Errorf("Expected key signed before retirement to verify until it expires, got %v", err)
+	}
+	if len(KEYRING.PublicKeys().Keys) != 3 {
+		t.Error("Expected recently retired key to stay published")
+	}
+
+	oldKey.RetireAt = now.Add(-retiredKeyGrace - time.Minute)
+	if _, err := VerifyKey(oldTokenKey); err == nil {
+		t.Error("Expected key signed with retired key to fail verification")
+	}
+	if len(KEYRING.PublicKeys().Keys) != 2 {
+		t.Error("Expected retired key not to be published")
+	}
+}
+
+func TestPreviousSecretKey(t *testing.T) {
+	defer os.Unsetenv("SECRET_KEY")
+	defer os.Unsetenv("PREVIOUS_SECRET_KEY")
+	os.Setenv("SECRET_KEY", "old secret")
+	oldTokenKey, _ := generateKey(Token{UserID: 1, ExpiresAt: time.Now().Add(time.Hour).Unix()})
+
+	os.Setenv("SECRET_KEY", "new secret")
+	if _, err := VerifyKey(oldTokenKey); err == nil {
+		t.Error("Expected key signed with a replaced secret to fail verification")
+	}
+	os.Setenv("PREVIOUS_SECRET_KEY", "old secret")
+	if _, err := VerifyKey(oldTokenKey); err != nil {
+		t.Errorf("Expected key signed with the previous secret to verify, got %v", err)
+	}
+	tokenKey, _ := generateKey(Token{UserID: 1, ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	os.Unsetenv("PREVIOUS_SECRET_KEY")
+	if _, err := VerifyKey(tokenKey); err != nil {
+		t.Errorf("Expected new keys to be signed with the current secret, got %v", err)
+	}
+}
+
+func TestKeyringWithoutActiveKey(t *testing.T) {
+	defer func() { KEYRING = nil }()
+	keys := testSigningKeys(t)
+	for _, path := range keys {
+		defer os.Remove(path)
+	}
+	key, _ := LoadSigningKey("ES256", keys["ES256"])
+	key.ActivateAt = time.Now().Add(time.Hour)
+	KEYRING = NewKeyring(key)
+
+	if _, err := generateKey(Token{UserID: 1, ExpiresAt: time.Now().Add(time.Hour).Unix()}); err == nil {
+		t.Error("Expected error signing without an active key")
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+	keys := testSigningKeys(t)
+	for _, path := range keys {
+		defer os.Remove(path)
+	}
+	config := `[
+		{"kid": "2016-12", "alg": "ES256", "key_file": "` + keys["ES256"] + `", "activate_at": "2016-12-01T00:00:00Z"},
+		{"kid": "2017-01", "alg": "EdDSA", "key_file": "` + filepath.Base(keys["EdDSA"]) + `", "activate_at": "2017-01-01T00:00:00Z"}
+	]`
+	file, _ := ioutil.TempFile(filepath.Dir(keys["EdDSA"]), "keyring")
+	defer os.Remove(file.Name())
+	file.WriteString(config)
+	file.Close()
+
+	keyring, err := LoadKeyring(file.Name())
+	if err != nil {
+		t.Fatalf("Failed to load keyring: %v", err)
+	}
+	if len(keyring.Keys) != 2 || keyring.key("2016-12") == nil {
+		t.Fatal("Expected keys to be loaded with their key ids")
+	}
+	if keyring.active(time.Now()).ID != "2017-01" {
+		t.Error("Expected newest key to be active")
+	}
+}
@@ -0,0 +1,234 @@
+package service
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+//SigningMethodEdDSA signs token keys with Ed25519
+var SigningMethodEdDSA = &signingMethodEdDSA{}
+
+func init() {
+	jwt.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
+
+//SigningKey signs and verifies token keys
+type SigningKey struct {
+	ID         string
+	Method     jwt.SigningMethod
+	Private    interface{}
+	Public     interface{}
+	ActivateAt time.Time
+	RetireAt   time.Time
+}
+
+//JWK is a public key in JSON Web Key format
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+//JWKS is a set of public keys
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+//LoadSigningKey reads a signing key for alg from a PEM file, or a raw secret for HS256
+func LoadSigningKey(alg, path string) (*SigningKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseSigningKey(alg, data)
+}
+
+func parseSigningKey(alg string, data []byte) (*SigningKey, error) {
+	key := &SigningKey{}
+	switch alg {
+	case "HS256":
+		secret := []byte(strings.TrimSpace(string(data)))
+		key.Method, key.Private, key.Public = jwt.SigningMethodHS256, secret, secret
+		return key, nil
+	case "RS256":
+		private, err := jwt.ParseRSAPrivateKeyFromPEM(data)
+		if err != nil {
+			return nil, err
+		}
+		key.Method, key.Private, key.Public = jwt.SigningMethodRS256, private, &private.PublicKey
+	case "ES256":
+		private, err := jwt.ParseECPrivateKeyFromPEM(data)
+		if err != nil {
+			return nil, err
+		}
+		if private.Curve != elliptic.P256() {
+			return nil, errors.New("ES256 requires a P-256 key")
+		}
+		key.Method, key.Private, key.Public = jwt.SigningMethodES256, private, &private.PublicKey
+	case "EdDSA":
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("Key must be PEM encoded")
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		private, ok := parsed.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.New("EdDSA requires an Ed25519 key")
+		}
+		key.Method, key.Private, key.Public = SigningMethodEdDSA, private, private.Public()
+	default:
+		return nil, fmt.Errorf("Unsupported signing algorithm %s", alg)
+	}
+	jwk, err := key.jwk()
+	if err != nil {
+		return nil, err
+	}
+	key.ID = jwk.thumbprint()
+	return key, nil
+}
+
+func (k *SigningKey) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.Method, claims)
+	if k.ID != "" {
+		token.Header["kid"] = k.ID
+	}
+	return token.SignedString(k.Private)
+}
+
+func (k *SigningKey) verificationKey(token *jwt.Token) (interface{}, error) {
+	if token.Method.Alg() != k.Method.Alg() {
+		return nil, fmt.Errorf("Unexpected signing method %v", token.Header["alg"])
+	}
+	return k.Public, nil
+}
+
+func (k *SigningKey) isSymmetric() bool {
+	_, ok := k.Method.(*jwt.SigningMethodHMAC)
+	return ok
+}
+
+func (k *SigningKey) jwk() (JWK, error) {
+	jwk := JWK{Kid: k.ID, Use: "sig", Alg: k.Method.Alg()}
+	switch public := k.Public.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = encodeSegment(public.N.Bytes())
+		jwk.E = encodeSegment(big.NewInt(int64(public.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (public.Curve.Params().BitSize + 7) / 8
+		jwk.Kty = "EC"
+		jwk.Crv = public.Curve.Params().Name
+		jwk.X = encodeSegment(padBytes(public.X.Bytes(), size))
+		jwk.Y = encodeSegment(padBytes(public.Y.Bytes(), size))
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = encodeSegment(public)
+	default:
+		return JWK{}, errors.New("Symmetric keys can not be published")
+	}
+	return jwk, nil
+}
+
+//thumbprint is the RFC 7638 thumbprint of the key
+func (j JWK) thumbprint() string {
+	var members interface{}
+	switch j.Kty {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{j.E, j.Kty, j.N}
+	case "EC":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{j.Crv, j.Kty, j.X, j.Y}
+	default:
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{j.Crv, j.Kty, j.X}
+	}
+	payload, _ := json.Marshal(members)
+	sum := sha256.Sum256(payload)
+	return encodeSegment(sum[:])
+}
+
+func encodeSegment(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func padBytes(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	padded := make([]byte, size)
+	copy(padded[size-len(b):], b)
+	return padded
+}
+
+type signingMethodEdDSA struct{}
+
+func (m *signingMethodEdDSA) Alg() string {
+	return "EdDSA"
+}
+
+func (m *signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	signature, err := private.Sign(rand.Reader, []byte(signingString), crypto.Hash(0))
+	if err != nil {
+		return "", err
+	}
+	return jwt.EncodeSegment(signature), nil
+}
+
+func (m *signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	public, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(public, []byte(signingString), sig) {
+		return errors.New("EdDSA verification failed")
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func writeTestKey(t *testing.T, blockType string, der []byte) string {
+	file, err := ioutil.TempFile("", "signing-key")
+	if err != nil {
+		t.Fatalf("Failed to create key file: %v", err)
+	}
+	defer file.Close()
+	pem.Encode(file, &pem.Block{Type: blockType, Bytes: der})
+	return file.Name()
+}
+
+func testSigningKeys(t *testing.T) map[string]string {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ecDer, _ := x509.MarshalECPrivateKey(ecKey)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	edDer, _ := x509.MarshalPKCS8PrivateKey(edKey)
+
+	return map[string]string{
+		"RS256": writeTestKey(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey)),
+		"ES256": writeTestKey(t, "EC PRIVATE KEY", ecDer),
+		"EdDSA": writeTestKey(t, "PRIVATE KEY", edDer),
+	}
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	defer func() { KEYRING = nil }()
+	for alg, path := range testSigningKeys(t) {
+		defer os.Remove(path)
+		key, err := LoadSigningKey(alg, path)
+		if err != nil {
+			t.Errorf("Failed to load %s key: %v", alg, err)
+			continue
+		}
+		if key.ID == "" || key.Method.Alg() != alg {
+			t.Errorf("Expected %s key with a key id", alg)
+		}
+
+		KEYRING = NewKeyring(key)
+		tokenKey, err := generateKey(Token{UserID: 1, ExpiresAt: time.Now().Add(time.Hour).Unix()})
+		if err != nil {
+			t.Errorf("Failed to sign with %s key: %v", alg, err)
+			continue
+		}
+		claims, err := VerifyKey(tokenKey)
+		if err != nil || claims.User != 1 {
+			t.Errorf("Expected %s signed key to verify, got %v", alg, err)
+		}
+
+		jwks := KEYRING.PublicKeys()
+		if len(jwks.Keys) != 1 || jwks.Keys[0].Kid != key.ID || jwks.Keys[0].Alg != alg {
+			t.Errorf("Expected %s public key to be published", alg)
+		}
+	}
+
+	if _, err := LoadSigningKey("RS256", "/does/not/exist"); err == nil {
+		t.Error("Expected error for missing key file")
+	}
+}
+
+func TestVerifyKeyRejectsOtherAlgorithm(t *testing.T) {
+	defer func() { KEYRING = nil }()
+	keys := testSigningKeys(t)
+	for _, path := range keys {
+		defer os.Remove(path)
+	}
+
+	esKey, _ := LoadSigningKey("ES256", keys["ES256"])
+	KEYRING = NewKeyring(esKey)
+	tokenKey, _ := generateKey(Token{UserID: 1, ExpiresAt: time.Now().Add(time.Hour).Unix()})
+
+	edKey, _ := LoadSigningKey("EdDSA", keys["EdDSA"])
+	edKey.ID = esKey.ID
+	KEYRING = NewKeyring(edKey)
+	if _, err := VerifyKey(tokenKey); err == nil {
+		t.Error("Expected key signed with another algorithm to fail verification")
+	}
+
+	KEYRING = nil
+	if _, err := VerifyKey(tokenKey); err == nil {
+		t.Error("Expected asymmetric key not to verify with the shared secret")
+	}
+}
+
+func TestJWKSHandler(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/.well-known/jwks.json", nil)
+	MakeTestServer(&testDatabase{}).ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected %v; received %v", http.StatusOK, recorder.Code)
+	}
+	var jwks JWKS
+	json.Unmarshal(recorder.Body.Bytes(), &jwks)
+	if len(jwks.Keys) != 0 {
+		t.Error("Expected shared secret not to be published")
+	}
+}
@@ -0,0 +1,145 @@
+package service
+
+import (
+	"strconv"
+	"time"
+)
+
+//Failed logins are counted per username and per client ip. After backoffAfter
+//failures each further failure locks logins for twice as long as the last,
+//up to lockoutDuration, and crossing threshold is audited.
+type lockoutPolicy struct {
+	prefix       string
+	backoffAfter int
+	threshold    int
+}
+
+var (
+	usernameLockout = lockoutPolicy{prefix: "lockout:user:", backoffAfter: 3, threshold: 10}
+	ipLockout       = lockoutPolicy{prefix: "lockout:ip:", backoffAfter: 20, threshold: 100}
+)
+
+const (
+	lockoutDuration = 15 * time.Minute
+	failureWindow   = time.Hour
+)
+
+//LoginLockedError is returned while logins are locked after too many failures
+type LoginLockedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LoginLockedError) Error() string {
+	return "Too many failed logins, try again in " + strconv.Itoa(int(e.RetryAfter.Seconds()+0.5)) + " seconds"
+}
+
+type loginFailures struct {
+	Count       int
+	LockedUntil int64
+}
+
+//checkLoginLockout returns a LoginLockedError if the username or ip is locked
+func checkLoginLockout(username, ip string, database Database) error {
+	var retryAfter time.Duration
+	for _, lock := range loginLocks(username, ip) {
+		failures := lock.policy.get(lock.subject, database)
+		wait := time.Until(time.Unix(failures.LockedUntil, 0))
+		if wait > retryAfter {
+			retryAfter = wait
+		}
+	}
+	if retryAfter > 0 {
+		return &LoginLockedError{RetryAfter: retryAfter}
+	}
+	return nil
+}
+
+//recordLoginFailure counts a failed login against the username and ip
+func recordLoginFailure(username, ip string, database Database) {
+	for _, lock := range loginLocks(username, ip) {
+		failures, err := lock.policy.fail(lock.subject, database)
+		if err != nil {
+			continue
+		}
+		if failures.Count == lock.policy.threshold {
+			event := AuditEvent{Type: AuditLoginLockout, IP: ip, Detail: strconv.Itoa(failures.Count) + " failed logins"}
+			if lock.policy == usernameLockout {
+				event.Username = username
+			}
+			audit(event)
+		}
+	}
+}
+
+//clearLoginFailures forgets the failures for a username after a successful
+//login. Failures for the ip are kept so one account can not reset them.
+func clearLoginFailures(username string, database Database) {
+	database.redisDeleteValue(usernameLockout.countKey(username))
+	database.redisDeleteValue(usernameLockout.lockKey(username))
+}
+
+type loginLock struct {
+	policy  lockoutPolicy
+	subject string
+}
+
+func loginLocks(username, ip string) []loginLock {
+	locks := []loginLock{{usernameLockout, username}}
+	if ip != "" {
+		locks = append(locks, loginLock{ipLockout, ip})
+	}
+	return locks
+}
+
+//get returns the failures counted for a subject and until when it is locked
+func (p lockoutPolicy) get(subject string, database Database) loginFailures {
+	var failures loginFailures
+	value, err := database.redisGetValue(p.countKey(subject))
+	if err == nil && value != "" {
+		failures.Count, _ = strconv.Atoi(value)
+	}
+	value, err = database.redisGetValue(p.lockKey(subject))
+	if err == nil && value != "" {
+		failures.LockedUntil, _ = strconv.ParseInt(value, 10, 64)
+	}
+	return failures
+}
+
+//fail counts a failure for a subject and locks it for the backoff. The count
+//is incremented atomically so concurrent failures are never lost.
+func (p lockoutPolicy) fail(subject string, database Database) (loginFailures, error) {
+	count, err := database.redisIncrement(p.countKey(subject), failureWindow)
+	if err != nil {
+		return loginFailures{}, err
+	}
+	failures := loginFailures{Count: int(count)}
+	delay := p.delay(failures.Count)
+	if delay > 0 {
+		failures.LockedUntil = time.Now().Add(delay).Unix()
+		err = database.redisSetValue(p.lockKey(subject), strconv.FormatInt(failures.LockedUntil, 10), delay)
+	}
+	return failures, err
+}
+
+func (p lockoutPolicy) countKey(subject string) string {
+	return p.prefix + subject + ":count"
+}
+
+func (p lockoutPolicy) lockKey(subject string) string {
+	return p.prefix + subject + ":until"
+}
+
+//delay is how long logins are locked after count failures
+func (p lockoutPolicy) delay(count int) time.Duration {
+	if count < p.backoffAfter {
+		return 0
+	}
+	if count >= p.threshold || count-p.backoffAfter >= 20 {
+		return lockoutDuration
+	}
+	delay := time.Second << uint(count-p.backoffAfter)
+	if delay > lockoutDuration {
+		return lockoutDuration
+	}
+	return delay
+}
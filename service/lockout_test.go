@@ -0,0 +1,109 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUserLoginLockout(t *testing.T) {
+	database := &testDatabase{}
+	user := User{Username: "Testname", Password: "testpassword", Email: "test@mail.com"}
+	user.Save(database)
+
+	for i := 0; i < usernameLockout.backoffAfter; i++ {
+		_, err := UserLoginFromDevice("Testname", "wrong", Device{IP: "10.0.0.1"}, database)
+		if _, ok := err.(*LoginLockedError); ok {
+			t.Fatalf("Locked after only %d failures", i)
+		}
+	}
+	_, err := UserLoginFromDevice("Testname", "testpassword", Device{IP: "10.0.0.2"}, database)
+	locked, ok := err.(*LoginLockedError)
+	if !ok {
+		t.Fatalf("Expected logins to be locked; got %v", err)
+	}
+	if locked.RetryAfter <= 0 || locked.RetryAfter > time.Second {
+		t.Errorf("Expected a one second backoff; got %v", locked.RetryAfter)
+	}
+}
+
+func TestUserLoginSuccessClearsFailures(t *testing.T) {
+	database := &testDatabase{}
+	user := User{Username: "Testname", Password: "testpassword", Email: "test@mail.com"}
+	user.Save(database)
+	UserLoginFromDevice("Testname", "wrong", Device{IP: "10.0.0.1"}, database)
+	_, err := UserLoginFromDevice("Testname", "testpassword", Device{IP: "10.0.0.1"}, database)
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	if usernameLockout.get("Testname", database).Count != 0 {
+		t.Error("A successful login should clear the usernames failures")
+	}
+	if ipLockout.get("10.0.0.1", database).Count != 1 {
+		t.Error("A successful login should not clear the ips failures")
+	}
+}
+
+func TestLoginLockoutAudit(t *testing.T) {
+	auditor := &MemoryAuditor{}
+	AUDITOR = auditor
+	defer func() { AUDITOR = LogAuditor{} }()
+	database := &testDatabase{}
+	for i := 0; i < usernameLockout.threshold; i++ {
+		recordLoginFailure("Testname", "10.0.0.1", database)
+	}
+	if len(auditor.Events) != 1 || auditor.Events[0].Type != AuditLoginLockout || auditor.Events[0].Username != "Testname" {
+		t.Fatalf("Expected one lockout event; got %+v", auditor.Events)
+	}
+	err := checkLoginLockout("Testname", "", database)
+	locked, ok := err.(*LoginLockedError)
+	if !ok || locked.RetryAfter < lockoutDuration-time.Minute {
+		t.Errorf("Expected a temporary lockout; got %v", err)
+	}
+}
+
+func TestLockoutPolicyDelay(t *testing.T) {
+	policy := lockoutPolicy{backoffAfter: 3, threshold: 10}
+	expected := map[int]time.Duration{
+		1:   0,
+		3:   time.Second,
+		4:   2 * time.Second,
+		6:   8 * time.Second,
+		10:  lockoutDuration,
+		100: lockoutDuration,
+	}
+	for count, delay := range expected {
+		if policy.delay(count) != delay {
+			t.Errorf("%d failures: expected %v; got %v", count, delay, policy.delay(count))
+		}
+	}
+}
+
+func TestLoginLockoutPerIP(t *testing.T) {
+	database := &testDatabase{}
+	for i := 0; i < ipLockout.backoffAfter; i++ {
+		recordLoginFailure("user"+string(rune('a'+i)), "10.0.0.1", database)
+	}
+	if _, ok := checkLoginLockout("someone", "10.0.0.1", database).(*LoginLockedError); !ok {
+		t.Error("Failures across usernames should lock the ip")
+	}
+	if checkLoginLockout("someone", "10.0.0.2", database) != nil {
+		t.Error("Other ips should not be locked")
+	}
+}
+
+func TestLoginFailuresSharedCounter(t *testing.T) {
+	auditor := &MemoryAuditor{}
+	AUDITOR = auditor
+	defer func() { AUDITOR = LogAuditor{} }()
+	database := &testDatabase{}
+	for i := 1; i < usernameLockout.threshold; i++ {
+		database.redisIncrement(usernameLockout.countKey("Testname"), failureWindow)
+	}
+	recordLoginFailure("Testname", "", database)
+	if len(auditor.Events) != 1 || usernameLockout.get("Testname", database).Count != usernameLockout.threshold {
+		t.Errorf("Expected failures counted elsewhere to be added to; got %+v", auditor.Events)
+	}
+	if _, ok := checkLoginLockout("Testname", "", database).(*LoginLockedError); !ok {
+		t.Error("Expected the username to be locked")
+	}
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"errors"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+)
+
+//MAILER sends email throughout the service, set in main
+var MAILER Mailer
+
+//Mailer sends an email
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+//SMTPMailer sends email through an SMTP server
+type SMTPMailer struct {
+	Address  string
+	From     string
+	Username string
+	Password string
+}
+
+//Message is an email kept by MemoryMailer
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+//MemoryMailer keeps sent email in memory, for tests and development
+type MemoryMailer struct {
+	mu       sync.Mutex
+	Messages []Message
+}
+
+//Send delivers the email to the SMTP server
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	msg, err := buildMessage(m.From, to, subject, body)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, err := net.SplitHostPort(m.Address)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+	return smtp.SendMail(m.Address, auth, m.From, []string{to}, msg)
+}
+
+//Send keeps the email
+func (m *MemoryMailer) Send(to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Messages = append(m.Messages, Message{To: to, Subject: subject, Body: body})
+	return nil
+}
+
+//Last returns the most recent email sent to an address
+func (m *MemoryMailer) Last(to string) (Message, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := len(m.Messages) - 1; i >= 0; i-- {
+		if m.Messages[i].To == to {
+			return m.Messages[i], true
+		}
+	}
+	return Message{}, false
+}
+
+func sendMail(to, subject, body string) error {
+	if MAILER == nil {
+		return errors.New("No mailer configured")
+	}
+	return MAILER.Send(to, subject, body)
+}
+
+func buildMessage(from, to, subject, body string) ([]byte, error) {
+	for _, header := range []string{from, to, subject} {
+		if strings.ContainsAny(header, "\r\n") {
+			return nil, errors.New("Email headers must not contain line breaks")
+		}
+	}
+	msg := "From: " + from + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=\"utf-8\"\r\n" +
+		"\r\n" + body
+	return []byte(msg), nil
+}
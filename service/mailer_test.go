@@ -0,0 +1,20 @@
+package service
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildMessage(t *testing.T) {
+	msg, err := buildMessage("auth@mail.com", "test@mail.com", "Hello", "Body")
+	if err != nil {
+		t.Fatalf("Failed to build message: %v", err)
+	}
+	if !strings.Contains(string(msg), "Subject: Hello\r\n") || !strings.HasSuffix(string(msg), "\r\n\r\nBody") {
+		t.Errorf("Unexpected message: %q", msg)
+	}
+	_, err = buildMessage("auth@mail.com", "test@mail.com\r\nBcc: other@mail.com", "Hello", "Body")
+	if err == nil {
+		t.Error("Headers with line breaks should be rejected")
+	}
+}
@@ -0,0 +1,158 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const mfaChallengeTTL = 5 * time.Minute
+
+const mfaChallengeAttempts = 5
+
+//LoginResult is returned by UserLogin. It holds either the tokens or, for
+//users with two factor authentication, a challenge to finish logging in with.
+type LoginResult struct {
+	*TokenPair
+	MFARequired bool     `json:"mfa_required,omitempty"`
+	MFAToken    string   `json:"mfa_token,omitempty"`
+	MFAExpires  int64    `json:"mfa_expires_in,omitempty"`
+	MFAMethods  []string `json:"mfa_methods,omitempty"`
+}
+
+//Second factors a user can finish an MFA challenge with
+const (
+	MFAMethodTOTP     = "totp"
+	MFAMethodWebAuthn = "webauthn"
+)
+
+//MFAChallenge is kept in redis while the user enters their second factor
+type MFAChallenge struct {
+	UserID    uint   `json:"user_id"`
+	Username  string `json:"username"`
+	Device    Device `json:"device"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+//mfaMethods returns the second factors the user has enabled
+func mfaMethods(userID uint, database Database) []string {
+	var methods []string
+	totp, err := database.getTOTPByUserID(userID)
+	if err == nil && totp.isConfirmed() {
+		methods = append(methods, MFAMethodTOTP)
+	}
+	credentials, err := database.getWebAuthnCredentialsByUserID(userID)
+	if err == nil && len(credentials) > 0 {
+		methods = append(methods, MFAMethodWebAuthn)
+	}
+	return methods
+}
+
+//newMFAChallenge stores a challenge for the user and returns its key
+func newMFAChallenge(user User, methods []string, device Device, database Database) (LoginResult, error) {
+	key, err := randomString(32)
+	if err != nil {
+		return LoginResult{}, err
+	}
+	challenge := MFAChallenge{UserID: user.ID, Username: user.Username, Device: device, ExpiresAt: time.Now().Add(mfaChallengeTTL).Unix()}
+	err = saveMFAChallenge(key, challenge, database)
+	if err != nil {
+		return LoginResult{}, err
+	}
+	return LoginResult{MFARequired: true, MFAToken: key, MFAExpires: int64(mfaChallengeTTL.Seconds()), MFAMethods: methods}, nil
+}
+
+//CompleteMFALogin checks the second factor for a challenge and issues tokens.
+//A challenge is deleted once used or after too many wrong codes.
+func CompleteMFALogin(key, code string, database Database) (TokenPair, error) {
+	challenge, err := getMFAChallenge(key, database)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	attempts, err := countMFAAttempt(key, challenge, database)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	ok, err := VerifySecondFactor(challenge.UserID, code, database)
+	if err != nil || !ok {
+		failMFAChallenge(key, challenge, attempts, database)
+		return TokenPair{}, errors.New("Invalid code")
+	}
+	return completeMFAChallenge(key, challenge, database)
+}
+
+//countMFAAttempt counts an attempt at a challenge before the second factor is
+//checked. The counter is incremented atomically so parallel guesses can not
+//all be tried before any of them is counted. Locked out users can not finish
+//a challenge either.
+func countMFAAttempt(key string, challenge MFAChallenge, database Database) (int64, error) {
+	err := checkLoginLockout(challenge.Username, challenge.Device.IP, database)
+	if err != nil {
+		return 0, err
+	}
+	ttl := time.Until(time.Unix(challenge.ExpiresAt, 0))
+	attempts, err := database.redisIncrement(mfaAttemptsKey(key), ttl)
+	if err != nil {
+		return attempts, err
+	}
+	if attempts > mfaChallengeAttempts {
+		discardMFAChallenge(key, database)
+		return attempts, errors.New("Login challenge has expired")
+	}
+	return attempts, nil
+}
+
+//failMFAChallenge counts a wrong second factor as a failed login and discards
+//the challenge after too many of them
+func failMFAChallenge(key string, challenge MFAChallenge, attempts int64, database Database) {
+	recordLoginFailure(challenge.Username, challenge.Device.IP, database)
+	if attempts >= mfaChallengeAttempts {
+		discardMFAChallenge(key, database)
+	}
+}
+
+//completeMFAChallenge discards the challenge and issues tokens to its user
+func completeMFAChallenge(key string, challenge MFAChallenge, database Database) (TokenPair, error) {
+	discardMFAChallenge(key, database)
+	clearLoginFailures(challenge.Username, database)
+	user, err := database.getUserByID(challenge.UserID)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	return startTokenFamily(user, challenge.Device, database)
+}
+
+func discardMFAChallenge(key string, database Database) {
+	database.redisDeleteValue(mfaChallengeKey(key))
+	database.redisDeleteValue(mfaAttemptsKey(key))
+}
+
+func getMFAChallenge(key string, database Database) (MFAChallenge, error) {
+	var challenge MFAChallenge
+	value, err := database.redisGetValue(mfaChallengeKey(key))
+	if err != nil || value == "" {
+		return challenge, errors.New("Login challenge has expired")
+	}
+	err = json.Unmarshal([]byte(value), &challenge)
+	if err != nil || challenge.ExpiresAt < time.Now().Unix() {
+		return challenge, errors.New("Login challenge has expired")
+	}
+	return challenge, nil
+}
+
+func saveMFAChallenge(key string, challenge MFAChallenge, database Database) error {
+	value, err := json.Marshal(challenge)
+	if err != nil {
+		return err
+	}
+	ttl := time.Until(time.Unix(challenge.ExpiresAt, 0))
+	return database.redisSetValue(mfaChallengeKey(key), string(value), ttl)
+}
+
+func mfaChallengeKey(key string) string {
+	return "mfa:" + hashKey(key)
+}
+
+func mfaAttemptsKey(key string) string {
+	return "mfa:attempts:" + hashKey(key)
+}
@@ -1,17 +1,26 @@
 package service
 
 import (
+	"errors"
+	"log"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
 //User struct
 type User struct {
-	ID       uint   `json:"id"`
-	Username string `json:"username"`
-	Password string `json:"password"`
-	Email    string `json:"email"`
+	ID         uint          `json:"id"`
+	Username   string        `json:"username"`
+	Password   string        `json:"password,omitempty"`
+	Email      string        `json:"email"`
+	VerifiedAt time.Time     `json:"verified_at"`
+	CreatedAt  time.Time     `json:"created_at"`
+	Status     AccountStatus `json:"status"`
+	DeletedAt  time.Time     `json:"deleted_at"`
 }
 
 //Token struct
@@ -19,11 +28,139 @@ type Token struct {
 	ID        uint      `json:"id"`
 	Key       string    `json:"key"`
 	UserID    uint      `json:"userID"`
+	Kind      string    `json:"kind"`
+	ClientID  string    `json:"client_id"`
+	Scope     string    `json:"scope"`
+	FamilyID  string    `json:"family_id"`
+	Roles     []string  `json:"roles,omitempty"`
 	ExpiresAt int64     `json:"expires_at"`
 	CreatedAt time.Time `json:"created_at"`
 	DelatedAt time.Time `json:"deleted_at"`
 }
 
+//Token kinds, client tokens are issued to a client on its own behalf
+const (
+	TokenKindUser   = "user"
+	TokenKindClient = "client"
+)
+
+//RefreshToken struct, only the hash of the key is stored
+type RefreshToken struct {
+	ID        uint      `json:"id"`
+	Key       string    `json:"key"`
+	KeyHash   string    `json:"-"`
+	UserID    uint      `json:"userID"`
+	ClientID  string    `json:"client_id"`
+	Scope     string    `json:"scope"`
+	FamilyID  string    `json:"family_id"`
+	ExpiresAt int64     `json:"expires_at"`
+	RotatedAt time.Time `json:"rotated_at"`
+	CreatedAt time.Time `json:"created_at"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+//Client is an application that authenticates to chat-auth
+type Client struct {
+	ID           uint     `json:"id"`
+	ClientID     string   `json:"client_id"`
+	SecretHash   string   `json:"-"`
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	GrantTypes   []string `json:"grant_types"`
+	Scope        string   `json:"scope"`
+	OwnerID      uint     `json:"owner_id"`
+}
+
+//AuthorizationCode is a single use code exchanged for tokens, only the hash of the code is stored
+type AuthorizationCode struct {
+	ID                  uint      `json:"id"`
+	Code                string    `json:"-"`
+	CodeHash            string    `json:"-"`
+	ClientID            string    `json:"client_id"`
+	UserID              uint      `json:"userID"`
+	RedirectURI         string    `json:"redirect_uri"`
+	Scope               string    `json:"scope"`
+	CodeChallenge       string    `json:"code_challenge"`
+	CodeChallengeMethod string    `json:"code_challenge_method"`
+	Nonce               string    `json:"nonce"`
+	FamilyID            string    `json:"family_id"`
+	ExpiresAt           int64     `json:"expires_at"`
+	UsedAt              time.Time `json:"used_at"`
+	CreatedAt           time.Time `json:"created_at"`
+}
+
+//Consent records the scopes a user has granted a client
+type Consent struct {
+	UserID    uint      `json:"userID"`
+	ClientID  string    `json:"client_id"`
+	Scope     string    `json:"scope"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+//PasswordReset is a single use token to set a new password, only the hash of the key is stored
+type PasswordReset struct {
+	ID        uint      `json:"id"`
+	Key       string    `json:"-"`
+	KeyHash   string    `json:"-"`
+	UserID    uint      `json:"userID"`
+	ExpiresAt int64     `json:"expires_at"`
+	UsedAt    time.Time `json:"used_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+//TOTP is a users authenticator secret, two factor authentication is on once it is confirmed
+type TOTP struct {
+	UserID      uint      `json:"userID"`
+	Secret      string    `json:"-"`
+	LastStep    int64     `json:"-"`
+	ConfirmedAt time.Time `json:"confirmed_at"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+//WebAuthnCredential is a passkey or security key registered by a user. The
+//public key is kept in its COSE encoding.
+type WebAuthnCredential struct {
+	ID           uint      `json:"id"`
+	UserID       uint      `json:"userID"`
+	CredentialID string    `json:"credential_id"`
+	PublicKey    []byte    `json:"-"`
+	SignCount    uint32    `json:"sign_count"`
+	Name         string    `json:"name"`
+	LastUsedAt   time.Time `json:"last_used_at"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+//Session is a login on one device. Its tokens share the sessions family id.
+type Session struct {
+	ID         uint      `json:"id"`
+	FamilyID   string    `json:"-"`
+	UserID     uint      `json:"userID"`
+	ClientID   string    `json:"client_id,omitempty"`
+	DeviceName string    `json:"device_name"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	ExpiresAt  int64     `json:"expires_at"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	RevokedAt  time.Time `json:"revoked_at"`
+}
+
+//Role groups permissions, users have the roles assigned to them besides RoleUser
+type Role struct {
+	ID          uint     `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+//TokenPair is a short lived access token with the refresh token used to renew it
+type TokenPair struct {
+	Token
+	RefreshToken     string `json:"refresh_token"`
+	RefreshExpiresAt int64  `json:"refresh_expires_at"`
+	IDToken          string `json:"id_token,omitempty"`
+}
+
 //Save handles before save functions
 func (u *User) Save(db Database) error {
 	u.beforeSave()
@@ -37,22 +174,49 @@ func (u *User) Save(db Database) error {
 }
 
 func (u *User) beforeSave() {
+	u.VerifiedAt = time.Time{}
 	u.hashPassword()
 }
 
+//afterSave sends the verification email and, unless unverified users are
+//blocked, issues the users first token
 func (u *User) afterSave(db Database) {
-	token, err := GenerateToken(u.ID)
+	err := SendVerificationEmail(*u)
+	if err != nil {
+		log.Print(err)
+	}
+	scope, err := verificationScope(*u)
+	if err != nil {
+		return
+	}
+	token, err := generateToken(Token{UserID: u.ID, Kind: TokenKindUser, Scope: scope, Roles: []string{RoleUser}})
 	if err != nil {
 		return
 	}
 	token.Save(db)
-	time := time.Duration(token.ExpiresAt)
-	db.redisSetValue(token.Key, string(token.UserID), time)
+	token.cache(db)
+}
+
+//validateUsername checks a username for signup and renames
+func validateUsername(username string) error {
+	if username == "" {
+		return errors.New("Username can not be empty")
+	}
+	for _, r := range username {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return errors.New("Username can not contain spaces")
+		}
+	}
+	return nil
+}
+
+func (u *User) isVerified() bool {
+	return !u.VerifiedAt.IsZero()
 }
 
 func (u *User) hashPassword() error {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(u.Password), bcrypt.DefaultCost)
-	u.Password = string(hashedPassword)
+	hashedPassword, err := hashPassword(u.Password)
+	u.Password = hashedPassword
 	if err != nil {
 		return err
 	}
@@ -61,8 +225,7 @@ func (u *User) hashPassword() error {
 
 //CheckPasswordEqual compares passwords
 func (u *User) CheckPasswordEqual(password string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password))
-	return err == nil
+	return verifyPassword(u.Password, password)
 }
 
 // Save create token
@@ -71,6 +234,24 @@ func (t *Token) Save(database Database) error {
 	return err
 }
 
+//cache stores the user id, or client id for client tokens, under the key in redis
+func (t *Token) cache(database Database) error {
+	expiration := time.Duration(t.ttl()) * time.Second
+	subject := strconv.FormatUint(uint64(t.UserID), 10)
+	if t.isClient() {
+		subject = t.ClientID
+	}
+	return database.redisSetValue(t.Key, subject, expiration)
+}
+
+func (t *Token) isClient() bool {
+	return t.Kind == TokenKindClient
+}
+
+func (t *Token) isRevoked() bool {
+	return !t.DelatedAt.IsZero()
+}
+
 func (t *Token) isValid() bool {
 	now := time.Now().Unix()
 	if t.ExpiresAt < now {
@@ -78,3 +259,146 @@ func (t *Token) isValid() bool {
 	}
 	return true
 }
+
+func (t *Token) ttl() int64 {
+	ttl := t.ExpiresAt - time.Now().Unix()
+	if ttl < 0 {
+		return 0
+	}
+	return ttl
+}
+
+//Save stores the refresh token hash
+func (r *RefreshToken) Save(database Database) error {
+	r.KeyHash = hashKey(r.Key)
+	return database.addRefreshToken(r)
+}
+
+func (r *RefreshToken) isRevoked() bool {
+	return !r.DeletedAt.IsZero()
+}
+
+func (r *RefreshToken) isRotated() bool {
+	return !r.RotatedAt.IsZero()
+}
+
+func (r *RefreshToken) isValid() bool {
+	return r.ExpiresAt >= time.Now().Unix()
+}
+
+//Save registers the client under a new client id
+func (c *Client) Save(database Database) error {
+	if strings.TrimSpace(c.Name) == "" {
+		return errors.New("Client name is required")
+	}
+	if len(c.GrantTypes) == 0 {
+		c.GrantTypes = []string{"authorization_code", "refresh_token"}
+	}
+	for _, grantType := range c.GrantTypes {
+		switch grantType {
+		case "authorization_code", "refresh_token":
+		case "client_credentials":
+			if c.isPublic() {
+				return errors.New("Only confidential clients can use client credentials")
+			}
+		default:
+			return errors.New("Unsupported grant type " + grantType)
+		}
+	}
+	if c.allowsGrantType("authorization_code") && len(c.RedirectURIs) == 0 {
+		return errors.New("At least one redirect uri is required")
+	}
+	c.Scope = normalizeScope(c.Scope)
+	for _, uri := range c.RedirectURIs {
+		err := validateRedirectURI(uri)
+		if err != nil {
+			return err
+		}
+	}
+	clientID, err := randomString(16)
+	if err != nil {
+		return err
+	}
+	c.ClientID = clientID
+	id, err := database.addClient(c)
+	c.ID = id
+	return err
+}
+
+//generateSecret makes the client confidential and returns its secret, only
+//the hash of the secret is kept
+func (c *Client) generateSecret() (string, error) {
+	secret, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	c.SecretHash = string(hash)
+	return secret, nil
+}
+
+func (c *Client) isPublic() bool {
+	return c.SecretHash == ""
+}
+
+func (c *Client) allowsGrantType(grantType string) bool {
+	for _, allowed := range c.GrantTypes {
+		if allowed == grantType {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) allowsRedirectURI(uri string) bool {
+	for _, allowed := range c.RedirectURIs {
+		if allowed == uri {
+			return true
+		}
+	}
+	return false
+}
+
+//CheckSecret compares a client secret with the stored hash
+func (c *Client) CheckSecret(secret string) bool {
+	if c.SecretHash == "" {
+		return false
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(c.SecretHash), []byte(secret))
+	return err == nil
+}
+
+//Save stores the hash of the authorization code
+func (a *AuthorizationCode) Save(database Database) error {
+	a.CodeHash = hashKey(a.Code)
+	return database.addAuthorizationCode(a)
+}
+
+func (a *AuthorizationCode) isUsed() bool {
+	return !a.UsedAt.IsZero()
+}
+
+func (a *AuthorizationCode) isValid() bool {
+	return a.ExpiresAt >= time.Now().Unix()
+}
+
+//Save stores the hash of the reset key
+func (p *PasswordReset) Save(database Database) error {
+	p.KeyHash = hashKey(p.Key)
+	return database.addPasswordReset(p)
+}
+
+func (p *PasswordReset) isUsed() bool {
+	return !p.UsedAt.IsZero()
+}
+
+func (p *PasswordReset) isValid() bool {
+	return p.ExpiresAt >= time.Now().Unix()
+}
+
+func (t *TOTP) isConfirmed() bool {
+	return !t.ConfirmedAt.IsZero()
+}
@@ -2,13 +2,63 @@ package service
 
 import (
 	"errors"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 type testDatabase struct {
-	users  []User
-	tokens []Token
+	users         []User
+	tokens        []Token
+	refreshTokens []RefreshToken
+	clients       []Client
+	codes         []AuthorizationCode
+	consents      []Consent
+	resets        []PasswordReset
+	totps         []TOTP
+	recoveryCodes map[uint]map[string]bool
+	credentials   []WebAuthnCredential
+	sessions      []Session
+	grants        map[string][]string
+	userRoles     map[uint][]string
+	redis         map[string]string
+}
+
+//testRoles and testPermissions mirror the rows seeded by tables.sql
+var testRoles = []string{RoleUser, RoleModerator, RoleAdmin, RoleBot}
+
+var testPermissions = []string{PermissionClientsManage, "messages:delete", PermissionRolesManage, "rooms:moderate", PermissionUsersManage, PermissionUsersRead}
+
+func (t *testDatabase) rolePermissions() map[string][]string {
+	if t.grants == nil {
+		t.grants = map[string][]string{
+			RoleModerator: {"messages:delete", "rooms:moderate", PermissionUsersRead},
+			RoleAdmin:     append([]string{}, testPermissions...),
+		}
+	}
+	return t.grants
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func removeString(values []string, value string) []string {
+	var kept []string
+	for _, v := range values {
+		if v != value {
+			kept = append(kept, v)
+		}
+	}
+	return kept
 }
 
 func (t *testDatabase) addToken(token *Token) error {
@@ -17,19 +67,129 @@ func (t *testDatabase) addToken(token *Token) error {
 }
 
 func (t *testDatabase) addUser(user *User) (uint, error) {
+	user.ID = uint(len(t.users) + 1)
 	t.users = append(t.users, *user)
-	return 1, nil
+	return user.ID, nil
 }
 
 func (t *testDatabase) getUserByUsername(username string) (User, error) {
 	for _, user := range t.users {
-		if username == user.Username {
+		if username == user.Username && user.DeletedAt.IsZero() {
+			return user, nil
+		}
+	}
+	return User{}, errors.New("User not found")
+}
+
+func (t *testDatabase) getUserByID(id uint) (User, error) {
+	for _, user := range t.users {
+		if id == user.ID {
 			return user, nil
 		}
 	}
 	return User{}, errors.New("User not found")
 }
 
+func (t *testDatabase) getUserByEmail(email string) (User, error) {
+	for _, user := range t.users {
+		if email == user.Email && user.DeletedAt.IsZero() {
+			return user, nil
+		}
+	}
+	return User{}, errors.New("User not found")
+}
+
+func (t *testDatabase) updateUsername(userID uint, username string) error {
+	for _, user := range t.users {
+		if user.Username == username && user.ID != userID {
+			return ErrUsernameTaken
+		}
+	}
+	for i := range t.users {
+		if t.users[i].ID == userID {
+			t.users[i].Username = username
+		}
+	}
+	return nil
+}
+
+func (t *testDatabase) changeUserEmail(userID uint, previous, email string) (bool, error) {
+	for _, user := range t.users {
+		if user.Email == email {
+			return false, errors.New("Email is taken")
+		}
+	}
+	for i := range t.users {
+		if t.users[i].ID == userID && t.users[i].Email == previous {
+			t.users[i].Email = email
+			t.users[i].VerifiedAt = time.Now()
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (t *testDatabase) searchUsers(query string, limit, offset int) ([]User, error) {
+	var users []User
+	query = strings.ToLower(query)
+	for _, user := range t.users {
+		if strings.Contains(strings.ToLower(user.Username), query) || strings.Contains(strings.ToLower(user.Email), query) {
+			users = append(users, user)
+		}
+	}
+	if offset >= len(users) {
+		return nil, nil
+	}
+	users = users[offset:]
+	if len(users) > limit {
+		users = users[:limit]
+	}
+	return users, nil
+}
+
+func (t *testDatabase) setAccountStatus(userID uint, status AccountStatus) error {
+	for i := range t.users {
+		if t.users[i].ID == userID {
+			status.ChangedAt = time.Now()
+			t.users[i].Status = status
+		}
+	}
+	return nil
+}
+
+func (t *testDatabase) deleteUser(userID uint, deleted bool) (bool, error) {
+	for i := range t.users {
+		if t.users[i].ID == userID && t.users[i].DeletedAt.IsZero() == deleted {
+			t.users[i].DeletedAt = time.Time{}
+			if deleted {
+				t.users[i].DeletedAt = time.Now()
+			}
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (t *testDatabase) updateUserPassword(userID uint, password string) error {
+	for i := range t.users {
+		if t.users[i].ID == userID {
+			t.users[i].Password = password
+			return nil
+		}
+	}
+	return errors.New("User not found")
+}
+
+func (t *testDatabase) verifyUserEmail(userID uint, email string) (bool, error) {
+	for i := range t.users {
+		if t.users[i].ID == userID && t.users[i].Email == email && t.users[i].VerifiedAt.IsZero() {
+			t.users[i].VerifiedAt = time.Now()
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func (t *testDatabase) getTokenByKey(key string) (Token, error) {
 	for _, token := range t.tokens {
 		if token.Key == key {
@@ -40,23 +200,458 @@ func (t *testDatabase) getTokenByKey(key string) (Token, error) {
 }
 
 func (t *testDatabase) getTokenByUserID(userID uint) (Token, error) {
-	for _, token := range t.tokens {
-		if token.UserID == userID {
-			return token, nil
+	for i := len(t.tokens) - 1; i >= 0; i-- {
+		if t.tokens[i].UserID == userID {
+			return t.tokens[i], nil
 		}
 	}
 
 	return Token{}, errors.New("Token not found")
 }
 
+func (t *testDatabase) revokeToken(key string) error {
+	for i := range t.tokens {
+		if t.tokens[i].Key == key && t.tokens[i].DelatedAt.IsZero() {
+			t.tokens[i].DelatedAt = time.Now()
+		}
+	}
+	return nil
+}
+
+func (t *testDatabase) revokeTokenFamily(familyID string) ([]string, error) {
+	var keys []string
+	for i := range t.sessions {
+		if t.sessions[i].FamilyID == familyID && t.sessions[i].RevokedAt.IsZero() {
+			t.sessions[i].RevokedAt = time.Now()
+		}
+	}
+	for i := range t.refreshTokens {
+		if t.refreshTokens[i].FamilyID == familyID && t.refreshTokens[i].DeletedAt.IsZero() {
+			t.refreshTokens[i].DeletedAt = time.Now()
+		}
+	}
+	for i := range t.tokens {
+		if t.tokens[i].FamilyID == familyID && t.tokens[i].DelatedAt.IsZero() {
+			t.tokens[i].DelatedAt = time.Now()
+			keys = append(keys, t.tokens[i].Key)
+		}
+	}
+	return keys, nil
+}
+
+func (t *testDatabase) revokeUserTokens(userID uint) ([]string, error) {
+	var keys []string
+	for i := range t.sessions {
+		if t.sessions[i].UserID == userID && t.sessions[i].RevokedAt.IsZero() {
+			t.sessions[i].RevokedAt = time.Now()
+		}
+	}
+	for i := range t.refreshTokens {
+		if t.refreshTokens[i].UserID == userID && t.refreshTokens[i].DeletedAt.IsZero() {
+			t.refreshTokens[i].DeletedAt = time.Now()
+		}
+	}
+	for i := range t.tokens {
+		if t.tokens[i].UserID == userID && t.tokens[i].Kind == TokenKindUser && t.tokens[i].DelatedAt.IsZero() {
+			t.tokens[i].DelatedAt = time.Now()
+			keys = append(keys, t.tokens[i].Key)
+		}
+	}
+	return keys, nil
+}
+
+func (t *testDatabase) addSession(session *Session) error {
+	session.ID = uint(len(t.sessions) + 1)
+	session.CreatedAt = time.Now()
+	t.sessions = append(t.sessions, *session)
+	return nil
+}
+
+func (t *testDatabase) getUserTokenKeys(userID uint) ([]string, error) {
+	var keys []string
+	for _, token := range t.tokens {
+		if token.UserID == userID && token.Kind == TokenKindUser && !token.isRevoked() && token.isValid() {
+			keys = append(keys, token.Key)
+		}
+	}
+	return keys, nil
+}
+
+func (t *testDatabase) revokeOtherUserTokens(userID uint, keepFamilyID string) ([]string, error) {
+	var keys []string
+	now := time.Now()
+	for i := range t.sessions {
+		if t.sessions[i].UserID == userID && t.sessions[i].FamilyID != keepFamilyID && t.sessions[i].RevokedAt.IsZero() {
+			t.sessions[i].RevokedAt = now
+		}
+	}
+	for i := range t.refreshTokens {
+		if t.refreshTokens[i].UserID == userID && t.refreshTokens[i].FamilyID != keepFamilyID && t.refreshTokens[i].DeletedAt.IsZero() {
+			t.refreshTokens[i].DeletedAt = now
+		}
+	}
+	for i := range t.tokens {
+		if t.tokens[i].UserID == userID && t.tokens[i].Kind == TokenKindUser && t.tokens[i].FamilyID != keepFamilyID && t.tokens[i].DelatedAt.IsZero() {
+			t.tokens[i].DelatedAt = now
+			keys = append(keys, t.tokens[i].Key)
+		}
+	}
+	return keys, nil
+}
+
+func (t *testDatabase) getSessionByID(id uint) (Session, error) {
+	for _, session := range t.sessions {
+		if session.ID == id {
+			return session, nil
+		}
+	}
+	return Session{}, errors.New("Session not found")
+}
+
+func (t *testDatabase) getSessionsByUserID(userID uint) ([]Session, error) {
+	var sessions []Session
+	for i := len(t.sessions) - 1; i >= 0; i-- {
+		session := t.sessions[i]
+		if session.UserID == userID && session.RevokedAt.IsZero() && session.ExpiresAt > time.Now().Unix() {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
+
+func (t *testDatabase) touchSession(familyID string) error {
+	for i := range t.sessions {
+		if t.sessions[i].FamilyID == familyID {
+			t.sessions[i].LastUsedAt = time.Now()
+		}
+	}
+	return nil
+}
+
+func (t *testDatabase) addRefreshToken(refreshToken *RefreshToken) error {
+	refreshToken.ID = uint(len(t.refreshTokens) + 1)
+	t.refreshTokens = append(t.refreshTokens, *refreshToken)
+	return nil
+}
+
+func (t *testDatabase) getRefreshTokenByHash(hash string) (RefreshToken, error) {
+	for _, refreshToken := range t.refreshTokens {
+		if refreshToken.KeyHash == hash {
+			return refreshToken, nil
+		}
+	}
+	return RefreshToken{}, errors.New("Refresh token not found")
+}
+
+func (t *testDatabase) rotateRefreshToken(hash string) (bool, error) {
+	for i := range t.refreshTokens {
+		if t.refreshTokens[i].KeyHash == hash && t.refreshTokens[i].RotatedAt.IsZero() && t.refreshTokens[i].DeletedAt.IsZero() {
+			t.refreshTokens[i].RotatedAt = time.Now()
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (t *testDatabase) addClient(client *Client) (uint, error) {
+	client.ID = uint(len(t.clients) + 1)
+	t.clients = append(t.clients, *client)
+	return client.ID, nil
+}
+
+func (t *testDatabase) getClientByClientID(clientID string) (Client, error) {
+	for _, client := range t.clients {
+		if client.ClientID == clientID {
+			return client, nil
+		}
+	}
+	return Client{}, errors.New("Client not found")
+}
+
+func (t *testDatabase) addAuthorizationCode(code *AuthorizationCode) error {
+	t.codes = append(t.codes, *code)
+	return nil
+}
+
+func (t *testDatabase) getAuthorizationCodeByHash(hash string) (AuthorizationCode, error) {
+	for _, code := range t.codes {
+		if code.CodeHash == hash {
+			return code, nil
+		}
+	}
+	return AuthorizationCode{}, errors.New("Authorization code not found")
+}
+
+func (t *testDatabase) useAuthorizationCode(hash string) (bool, error) {
+	for i := range t.codes {
+		if t.codes[i].CodeHash == hash && t.codes[i].UsedAt.IsZero() {
+			t.codes[i].UsedAt = time.Now()
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (t *testDatabase) getConsent(userID uint, clientID string) (Consent, error) {
+	for _, consent := range t.consents {
+		if consent.UserID == userID && consent.ClientID == clientID {
+			return consent, nil
+		}
+	}
+	return Consent{}, errors.New("Consent not found")
+}
+
+func (t *testDatabase) saveConsent(consent *Consent) error {
+	for i := range t.consents {
+		if t.consents[i].UserID == consent.UserID && t.consents[i].ClientID == consent.ClientID {
+			t.consents[i].Scope = consent.Scope
+			return nil
+		}
+	}
+	t.consents = append(t.consents, *consent)
+	return nil
+}
+
+func (t *testDatabase) addPasswordReset(reset *PasswordReset) error {
+	reset.ID = uint(len(t.resets) + 1)
+	t.resets = append(t.resets, *reset)
+	return nil
+}
+
+func (t *testDatabase) getPasswordResetByHash(hash string) (PasswordReset, error) {
+	for _, reset := range t.resets {
+		if reset.KeyHash == hash {
+			return reset, nil
+		}
+	}
+	return PasswordReset{}, errors.New("Password reset not found")
+}
+
+func (t *testDatabase) usePasswordReset(hash string) (bool, error) {
+	for i := range t.resets {
+		if t.resets[i].KeyHash == hash && t.resets[i].UsedAt.IsZero() {
+			t.resets[i].UsedAt = time.Now()
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (t *testDatabase) usePasswordResets(userID uint) error {
+	for i := range t.resets {
+		if t.resets[i].UserID == userID && t.resets[i].UsedAt.IsZero() {
+			t.resets[i].UsedAt = time.Now()
+		}
+	}
+	return nil
+}
+
+func (t *testDatabase) saveTOTP(totp *TOTP) error {
+	t.deleteTOTP(totp.UserID)
+	t.totps = append(t.totps, *totp)
+	return nil
+}
+
+func (t *testDatabase) getTOTPByUserID(userID uint) (TOTP, error) {
+	for _, totp := range t.totps {
+		if totp.UserID == userID {
+			return totp, nil
+		}
+	}
+	return TOTP{}, errors.New("TOTP not found")
+}
+
+func (t *testDatabase) confirmTOTP(userID uint) error {
+	for i := range t.totps {
+		if t.totps[i].UserID == userID {
+			t.totps[i].ConfirmedAt = time.Now()
+		}
+	}
+	return nil
+}
+
+func (t *testDatabase) useTOTPStep(userID uint, step int64) (bool, error) {
+	for i := range t.totps {
+		if t.totps[i].UserID == userID && t.totps[i].LastStep < step {
+			t.totps[i].LastStep = step
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (t *testDatabase) deleteTOTP(userID uint) error {
+	for i := range t.totps {
+		if t.totps[i].UserID == userID {
+			t.totps = append(t.totps[:i], t.totps[i+1:]...)
+			break
+		}
+	}
+	delete(t.recoveryCodes, userID)
+	return nil
+}
+
+func (t *testDatabase) saveRecoveryCodes(userID uint, hashes []string) error {
+	if t.recoveryCodes == nil {
+		t.recoveryCodes = make(map[uint]map[string]bool)
+	}
+	t.recoveryCodes[userID] = make(map[string]bool)
+	for _, hash := range hashes {
+		t.recoveryCodes[userID][hash] = true
+	}
+	return nil
+}
+
+func (t *testDatabase) useRecoveryCode(userID uint, hash string) (bool, error) {
+	if !t.recoveryCodes[userID][hash] {
+		return false, nil
+	}
+	t.recoveryCodes[userID][hash] = false
+	return true, nil
+}
+
+func (t *testDatabase) addWebAuthnCredential(credential *WebAuthnCredential) error {
+	credential.ID = uint(len(t.credentials) + 1)
+	credential.CreatedAt = time.Now()
+	t.credentials = append(t.credentials, *credential)
+	return nil
+}
+
+func (t *testDatabase) getWebAuthnCredentialsByUserID(userID uint) ([]WebAuthnCredential, error) {
+	var credentials []WebAuthnCredential
+	for _, credential := range t.credentials {
+		if credential.UserID == userID {
+			credentials = append(credentials, credential)
+		}
+	}
+	return credentials, nil
+}
+
+func (t *testDatabase) getWebAuthnCredentialByCredentialID(credentialID string) (WebAuthnCredential, error) {
+	for _, credential := range t.credentials {
+		if credential.CredentialID == credentialID {
+			return credential, nil
+		}
+	}
+	return WebAuthnCredential{}, errors.New("Credential not found")
+}
+
+func (t *testDatabase) updateWebAuthnSignCount(id uint, oldCount, newCount uint32) (bool, error) {
+	for i := range t.credentials {
+		if t.credentials[i].ID == id && t.credentials[i].SignCount == oldCount {
+			t.credentials[i].SignCount = newCount
+			t.credentials[i].LastUsedAt = time.Now()
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (t *testDatabase) deleteWebAuthnCredential(userID, id uint) (bool, error) {
+	for i := range t.credentials {
+		if t.credentials[i].ID == id && t.credentials[i].UserID == userID {
+			t.credentials = append(t.credentials[:i], t.credentials[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (t *testDatabase) getRoles() ([]Role, error) {
+	var roles []Role
+	for i, name := range testRoles {
+		permissions := append([]string{}, t.rolePermissions()[name]...)
+		roles = append(roles, Role{ID: uint(i + 1), Name: name, Permissions: permissions})
+	}
+	return roles, nil
+}
+
+func (t *testDatabase) getPermissions() ([]string, error) {
+	return testPermissions, nil
+}
+
+func (t *testDatabase) getUserRoles(userID uint) ([]string, error) {
+	return t.userRoles[userID], nil
+}
+
+func (t *testDatabase) getUserPermissions(userID uint) ([]string, error) {
+	var permissions []string
+	for _, role := range append([]string{RoleUser}, t.userRoles[userID]...) {
+		for _, permission := range t.rolePermissions()[role] {
+			if !containsString(permissions, permission) {
+				permissions = append(permissions, permission)
+			}
+		}
+	}
+	return permissions, nil
+}
+
+func (t *testDatabase) addUserRole(userID uint, role string, grantedBy uint) (bool, error) {
+	if !containsString(testRoles, role) || containsString(t.userRoles[userID], role) {
+		return false, nil
+	}
+	if t.userRoles == nil {
+		t.userRoles = map[uint][]string{}
+	}
+	t.userRoles[userID] = append(t.userRoles[userID], role)
+	return true, nil
+}
+
+func (t *testDatabase) removeUserRole(userID uint, role string) (bool, error) {
+	if !containsString(t.userRoles[userID], role) {
+		return false, nil
+	}
+	t.userRoles[userID] = removeString(t.userRoles[userID], role)
+	return true, nil
+}
+
+func (t *testDatabase) addRolePermission(role, permission string) (bool, error) {
+	grants := t.rolePermissions()
+	if !containsString(testRoles, role) || !containsString(testPermissions, permission) || containsString(grants[role], permission) {
+		return false, nil
+	}
+	grants[role] = append(grants[role], permission)
+	return true, nil
+}
+
+func (t *testDatabase) removeRolePermission(role, permission string) (bool, error) {
+	grants := t.rolePermissions()
+	if !containsString(grants[role], permission) {
+		return false, nil
+	}
+	grants[role] = removeString(grants[role], permission)
+	return true, nil
+}
+
 func (t *testDatabase) redisGetValue(key string) (string, error) {
-	return "", nil
+	return t.redis[key], nil
 }
 
 func (t *testDatabase) redisSetValue(key, value string, seconds time.Duration) error {
+	if t.redis == nil {
+		t.redis = make(map[string]string)
+	}
+	t.redis[key] = value
 	return nil
 }
 
+func (t *testDatabase) redisDeleteValue(key string) error {
+	delete(t.redis, key)
+	return nil
+}
+
+func (t *testDatabase) redisTakeValue(key string) (string, error) {
+	value := t.redis[key]
+	delete(t.redis, key)
+	return value, nil
+}
+
+func (t *testDatabase) redisIncrement(key string, expiration time.Duration) (int64, error) {
+	count, _ := strconv.ParseInt(t.redis[key], 10, 64)
+	count++
+	return count, t.redisSetValue(key, strconv.FormatInt(count, 10), expiration)
+}
+
 func TestUserSave(t *testing.T) {
 	database := &testDatabase{}
 	user := User{Username: "Testname", Password: "testpassword", Email: "test@mail.com"}
@@ -156,3 +751,44 @@ func TestTokenIsValid(t *testing.T) {
 		t.Error("Expected token to be invalid")
 	}
 }
+
+func TestTokenIsRevoked(t *testing.T) {
+	token := Token{Key: "testtoken", UserID: 1}
+	if token.isRevoked() {
+		t.Error("Expected token not to be revoked")
+	}
+
+	token.DelatedAt = time.Now()
+	if token.isRevoked() == false {
+		t.Error("Expected token to be revoked")
+	}
+}
+
+func TestRefreshTokenSave(t *testing.T) {
+	refreshToken := RefreshToken{Key: "testkey", UserID: 1, FamilyID: "family"}
+	database := &testDatabase{}
+
+	refreshToken.Save(database)
+
+	if len(database.refreshTokens) != 1 {
+		t.Fatal("Refresh token did not save")
+	}
+	if database.refreshTokens[0].KeyHash != hashKey("testkey") {
+		t.Error("Expected refresh token hash to be stored")
+	}
+}
+
+func TestClientCheckSecret(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	client := Client{ClientID: "gateway", SecretHash: string(hash)}
+
+	if client.CheckSecret("secret") == false {
+		t.Error("Expected secret to match")
+	}
+	if client.CheckSecret("wrong") {
+		t.Error("Expected wrong secret not to match")
+	}
+	if (&Client{ClientID: "public"}).CheckSecret("") {
+		t.Error("Expected client without a secret never to match")
+	}
+}
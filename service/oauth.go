@@ -0,0 +1,343 @@
+package service
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//OAuth error codes from RFC 6749
+const (
+	OAuthErrorInvalidRequest       = "invalid_request"
+	OAuthErrorInvalidClient        = "invalid_client"
+	OAuthErrorInvalidGrant         = "invalid_grant"
+	OAuthErrorUnauthorizedClient   = "unauthorized_client"
+	OAuthErrorUnsupportedGrantType = "unsupported_grant_type"
+	OAuthErrorUnsupportedResponse  = "unsupported_response_type"
+	OAuthErrorAccessDenied         = "access_denied"
+	OAuthErrorInvalidScope         = "invalid_scope"
+	OAuthErrorServerError          = "server_error"
+)
+
+//OAuthError is returned to clients as the error response body
+type OAuthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *OAuthError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+func newOAuthError(code, description string) *OAuthError {
+	return &OAuthError{Code: code, Description: description}
+}
+
+//AuthorizationRequest is a parsed request to the authorize endpoint
+type AuthorizationRequest struct {
+	ResponseType        string `json:"response_type"`
+	ClientID            string `json:"client_id"`
+	ClientName          string `json:"client_name"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+	Nonce               string `json:"nonce"`
+}
+
+//OAuthTokenResponse is the token endpoint response from RFC 6749
+type OAuthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+}
+
+func newOAuthTokenResponse(tokens TokenPair) OAuthTokenResponse {
+	return OAuthTokenResponse{
+		AccessToken:  tokens.Key,
+		TokenType:    "Bearer",
+		ExpiresIn:    tokens.ttl(),
+		RefreshToken: tokens.RefreshToken,
+		Scope:        tokens.Scope,
+		IDToken:      tokens.IDToken,
+	}
+}
+
+//ParseAuthorizationRequest validates an authorize request. The redirect uri is
+//only set on the request once it is known to be registered for the client, so
+//errors are only sent back to the client when it is set.
+func ParseAuthorizationRequest(values url.Values, database Database) (AuthorizationRequest, error) {
+	request := AuthorizationRequest{
+		ResponseType:        values.Get("response_type"),
+		ClientID:            values.Get("client_id"),
+		RedirectURI:         values.Get("redirect_uri"),
+		Scope:               normalizeScope(values.Get("scope")),
+		State:               values.Get("state"),
+		CodeChallenge:       values.Get("code_challenge"),
+		CodeChallengeMethod: values.Get("code_challenge_method"),
+		Nonce:               values.Get("nonce"),
+	}
+	client, err := database.getClientByClientID(request.ClientID)
+	if err != nil {
+		request.RedirectURI = ""
+		return request, newOAuthError(OAuthErrorInvalidClient, "Unknown client.")
+	}
+	request.ClientName = client.Name
+	if request.RedirectURI == "" && len(client.RedirectURIs) == 1 {
+		request.RedirectURI = client.RedirectURIs[0]
+	}
+	if !client.allowsRedirectURI(request.RedirectURI) || !client.allowsGrantType("authorization_code") {
+		request.RedirectURI = ""
+		return request, newOAuthError(OAuthErrorInvalidRequest, "Redirect uri is not registered for this client.")
+	}
+
+	if request.ResponseType != "code" {
+		return request, newOAuthError(OAuthErrorUnsupportedResponse, "Only the code response type is supported.")
+	}
+	if request.Scope == "" {
+		request.Scope = client.Scope
+	}
+	if !scopeCovers(client.Scope, request.Scope) {
+		return request, newOAuthError(OAuthErrorInvalidScope, "Requested scope is not allowed for this client.")
+	}
+	if request.CodeChallengeMethod == "" {
+		request.CodeChallengeMethod = "plain"
+	}
+	if request.CodeChallengeMethod != "S256" && request.CodeChallengeMethod != "plain" {
+		return request, newOAuthError(OAuthErrorInvalidRequest, "Unsupported code challenge method.")
+	}
+	if request.CodeChallengeMethod != "S256" && client.isPublic() {
+		return request, newOAuthError(OAuthErrorInvalidRequest, "Public clients must use the S256 code challenge method.")
+	}
+	if len(request.CodeChallenge) < 43 || len(request.CodeChallenge) > 128 {
+		return request, newOAuthError(OAuthErrorInvalidRequest, "A PKCE code challenge is required.")
+	}
+	return request, nil
+}
+
+//HasConsent reports whether the user already granted every requested scope to the client
+func HasConsent(userID uint, request AuthorizationRequest, database Database) bool {
+	consent, err := database.getConsent(userID, request.ClientID)
+	if err != nil {
+		return false
+	}
+	return scopeCovers(consent.Scope, request.Scope)
+}
+
+//GrantConsent adds the requested scopes to the users consent for the client
+func GrantConsent(userID uint, request AuthorizationRequest, database Database) error {
+	scope := request.Scope
+	consent, err := database.getConsent(userID, request.ClientID)
+	if err == nil {
+		scope = normalizeScope(consent.Scope + " " + request.Scope)
+	}
+	return database.saveConsent(&Consent{UserID: userID, ClientID: request.ClientID, Scope: scope})
+}
+
+//IssueAuthorizationCode creates a code for the request and returns the uri to redirect to
+func IssueAuthorizationCode(userID uint, request AuthorizationRequest, database Database) (string, error) {
+	if getEmailVerificationRule() != EmailVerificationOff {
+		user, err := database.getUserByID(userID)
+		if err != nil || !user.isVerified() {
+			return "", newOAuthError(OAuthErrorAccessDenied, ErrEmailNotVerified.Error()+".")
+		}
+	}
+	code, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+	familyID, err := randomString(16)
+	if err != nil {
+		return "", err
+	}
+	authorizationCode := AuthorizationCode{
+		Code:                code,
+		ClientID:            request.ClientID,
+		UserID:              userID,
+		RedirectURI:         request.RedirectURI,
+		Scope:               request.Scope,
+		CodeChallenge:       request.CodeChallenge,
+		CodeChallengeMethod: request.CodeChallengeMethod,
+		Nonce:               request.Nonce,
+		FamilyID:            familyID,
+		ExpiresAt:           time.Now().Add(10 * time.Minute).Unix(),
+	}
+	err = authorizationCode.Save(database)
+	if err != nil {
+		return "", err
+	}
+	return redirectURIWith(request.RedirectURI, url.Values{"code": {code}, "state": {request.State}})
+}
+
+//ExchangeAuthorizationCode checks the code, redirect uri and PKCE verifier and
+//issues tokens. The code is only used up once every check passed, using it
+//twice revokes the tokens it was exchanged for.
+func ExchangeAuthorizationCode(code, redirectURI, verifier string, client Client, database Database) (TokenPair, error) {
+	hash := hashKey(code)
+	authorizationCode, err := database.getAuthorizationCodeByHash(hash)
+	if err != nil || authorizationCode.ClientID != client.ClientID {
+		return TokenPair{}, newOAuthError(OAuthErrorInvalidGrant, "Unknown authorization code.")
+	}
+	if authorizationCode.isUsed() {
+		return TokenPair{}, reusedAuthorizationCode(authorizationCode, database)
+	}
+	if !authorizationCode.isValid() {
+		return TokenPair{}, newOAuthError(OAuthErrorInvalidGrant, "Authorization code has expired.")
+	}
+	if authorizationCode.RedirectURI != redirectURI {
+		return TokenPair{}, newOAuthError(OAuthErrorInvalidGrant, "Redirect uri does not match.")
+	}
+	if !verifyCodeChallenge(authorizationCode.CodeChallenge, authorizationCode.CodeChallengeMethod, verifier) {
+		return TokenPair{}, newOAuthError(OAuthErrorInvalidGrant, "Code verifier does not match.")
+	}
+	used, err := database.useAuthorizationCode(hash)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	if !used {
+		return TokenPair{}, reusedAuthorizationCode(authorizationCode, database)
+	}
+	user, err := database.getUserByID(authorizationCode.UserID)
+	if err != nil {
+		return TokenPair{}, newOAuthError(OAuthErrorInvalidGrant, "User not found.")
+	}
+	err = checkAccountActive(user)
+	if err != nil {
+		return TokenPair{}, newOAuthError(OAuthErrorInvalidGrant, err.Error()+".")
+	}
+	err = startSession(authorizationCode.UserID, client.ClientID, authorizationCode.FamilyID, Device{Name: client.Name}, database)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	tokens, err := issueTokenPair(RefreshToken{
+		UserID:    authorizationCode.UserID,
+		ClientID:  client.ClientID,
+		Scope:     authorizationCode.Scope,
+		FamilyID:  authorizationCode.FamilyID,
+		ExpiresAt: getRefreshExpiresAtTime(),
+	}, database)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	return withIDToken(tokens, authorizationCode.Nonce, database)
+}
+
+//reusedAuthorizationCode revokes the tokens a code was already exchanged for
+func reusedAuthorizationCode(authorizationCode AuthorizationCode, database Database) error {
+	revokeTokenFamily(authorizationCode.FamilyID, database)
+	return newOAuthError(OAuthErrorInvalidGrant, "Authorization code has already been used.")
+}
+
+//ClientCredentialsGrant issues a token to a confidential client on its own
+//behalf. The scope defaults to, and must be within, the scope the client was
+//registered with. No refresh token is issued.
+func ClientCredentialsGrant(client Client, scope string, database Database) (Token, error) {
+	if client.isPublic() || !client.allowsGrantType("client_credentials") {
+		return Token{}, newOAuthError(OAuthErrorUnauthorizedClient, "Client can not use client credentials.")
+	}
+	scope = normalizeScope(scope)
+	if scope == "" {
+		scope = client.Scope
+	}
+	if !scopeCovers(client.Scope, scope) {
+		return Token{}, newOAuthError(OAuthErrorInvalidScope, "Requested scope is not allowed for this client.")
+	}
+	token, err := generateToken(Token{Kind: TokenKindClient, ClientID: client.ClientID, Scope: scope})
+	if err != nil {
+		return Token{}, err
+	}
+	err = token.Save(database)
+	if err != nil {
+		return Token{}, err
+	}
+	token.cache(database)
+	return token, nil
+}
+
+//RefreshClientTokens rotates a refresh token that was issued to client
+func RefreshClientTokens(key string, client Client, database Database) (TokenPair, error) {
+	refreshToken, err := database.getRefreshTokenByHash(hashKey(key))
+	if err != nil || refreshToken.ClientID != client.ClientID {
+		return TokenPair{}, newOAuthError(OAuthErrorInvalidGrant, "Unknown refresh token.")
+	}
+	tokens, err := RefreshTokens(key, database)
+	if err != nil {
+		return TokenPair{}, newOAuthError(OAuthErrorInvalidGrant, err.Error())
+	}
+	return withIDToken(tokens, "", database)
+}
+
+func verifyCodeChallenge(challenge, method, verifier string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	expected := verifier
+	if method == "S256" {
+		sum := sha256.Sum256([]byte(verifier))
+		expected = encodeSegment(sum[:])
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+func validateRedirectURI(uri string) error {
+	parsed, err := url.Parse(uri)
+	if err != nil || !parsed.IsAbs() || parsed.Host == "" {
+		return errors.New("Redirect uri must be an absolute uri")
+	}
+	if parsed.Fragment != "" {
+		return errors.New("Redirect uri must not contain a fragment")
+	}
+	host := parsed.Hostname()
+	if parsed.Scheme != "https" && !(parsed.Scheme == "http" && (host == "localhost" || host == "127.0.0.1")) {
+		return errors.New("Redirect uri must use https")
+	}
+	return nil
+}
+
+func redirectURIWith(redirectURI string, params url.Values) (string, error) {
+	parsed, err := url.Parse(redirectURI)
+	if err != nil {
+		return "", err
+	}
+	query := parsed.Query()
+	for key, values := range params {
+		if len(values) > 0 && values[0] != "" {
+			query.Set(key, values[0])
+		}
+	}
+	parsed.RawQuery = query.Encode()
+	return parsed.String(), nil
+}
+
+func normalizeScope(scope string) string {
+	seen := map[string]bool{}
+	var scopes []string
+	for _, s := range strings.Fields(scope) {
+		if !seen[s] {
+			seen[s] = true
+			scopes = append(scopes, s)
+		}
+	}
+	return strings.Join(scopes, " ")
+}
+
+//scopeCovers reports whether every requested scope is in granted
+func scopeCovers(granted, requested string) bool {
+	grantedScopes := map[string]bool{}
+	for _, s := range strings.Fields(granted) {
+		grantedScopes[s] = true
+	}
+	for _, s := range strings.Fields(requested) {
+		if !grantedScopes[s] {
+			return false
+		}
+	}
+	return true
+}
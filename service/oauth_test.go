@@ -0,0 +1,215 @@
+package service
+
+import (
+	"crypto/sha256"
+	"net/url"
+	"testing"
+	"time"
+)
+
+const testVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+
+func testCodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return encodeSegment(sum[:])
+}
+
+func testAuthorizationRequest(database *testDatabase) AuthorizationRequest {
+	client := Client{Name: "bot", RedirectURIs: []string{"https://bot.example.com/callback"}, Scope: "openid email chat profile"}
+	client.Save(database)
+	values := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.ClientID},
+		"scope":                 {"chat profile chat"},
+		"state":                 {"xyz"},
+		"code_challenge":        {testCodeChallenge(testVerifier)},
+		"code_challenge_method": {"S256"},
+	}
+	request, _ := ParseAuthorizationRequest(values, database)
+	return request
+}
+
+func TestClientSave(t *testing.T) {
+	database := &testDatabase{}
+	client := Client{Name: "bot", RedirectURIs: []string{"https://bot.example.com/callback"}}
+	err := client.Save(database)
+	if err != nil || client.ClientID == "" || len(database.clients) != 1 {
+		t.Errorf("Expected client to be saved with a client id, got %v", err)
+	}
+
+	invalid := []Client{
+		{RedirectURIs: []string{"https://bot.example.com/callback"}},
+		{Name: "bot"},
+		{Name: "bot", RedirectURIs: []string{"http://bot.example.com/callback"}},
+		{Name: "bot", RedirectURIs: []string{"https://bot.example.com/callback#fragment"}},
+		{Name: "bot", RedirectURIs: []string{"/callback"}},
+	}
+	for _, client := range invalid {
+		if client.Save(database) == nil {
+			t.Errorf("Expected invalid client %+v not to save", client)
+		}
+	}
+
+	local := Client{Name: "dev", RedirectURIs: []string{"http://localhost:8080/callback"}}
+	if local.Save(database) != nil {
+		t.Error("Expected http redirect uris on localhost to be allowed")
+	}
+}
+
+func TestParseAuthorizationRequest(t *testing.T) {
+	database := &testDatabase{}
+	request := testAuthorizationRequest(database)
+	if request.RedirectURI != "https://bot.example.com/callback" || request.Scope != "chat profile" {
+		t.Errorf("Expected registered redirect uri and normalized scope, got %+v", request)
+	}
+
+	values := url.Values{"response_type": {"code"}, "client_id": {request.ClientID}, "redirect_uri": {"https://evil.example.com"}}
+	request, err := ParseAuthorizationRequest(values, database)
+	if err == nil || request.RedirectURI != "" {
+		t.Error("Expected unregistered redirect uri to be refused without redirecting")
+	}
+
+	values = url.Values{"response_type": {"code"}, "client_id": {request.ClientID}}
+	request, err = ParseAuthorizationRequest(values, database)
+	if err == nil || request.RedirectURI == "" {
+		t.Error("Expected missing code challenge to be sent to the redirect uri")
+	}
+
+	values = url.Values{"response_type": {"code"}, "client_id": {request.ClientID}, "scope": {"chat admin"}, "code_challenge": {testCodeChallenge(testVerifier)}, "code_challenge_method": {"S256"}}
+	if _, err = ParseAuthorizationRequest(values, database); err == nil || err.(*OAuthError).Code != OAuthErrorInvalidScope {
+		t.Errorf("Expected scope outside the registration to be refused, got %v", err)
+	}
+
+	values.Set("scope", "")
+	values.Set("code_challenge", testVerifier)
+	values.Set("code_challenge_method", "plain")
+	if _, err = ParseAuthorizationRequest(values, database); err == nil {
+		t.Error("Expected public clients to need the S256 code challenge method")
+	}
+	values.Del("code_challenge_method")
+	if _, err = ParseAuthorizationRequest(values, database); err == nil {
+		t.Error("Expected public clients not to default to the plain code challenge method")
+	}
+	values.Set("code_challenge", testCodeChallenge(testVerifier))
+	values.Set("code_challenge_method", "S256")
+	request, err = ParseAuthorizationRequest(values, database)
+	if err != nil || request.Scope != "openid email chat profile" {
+		t.Errorf("Expected the registered scope by default, got %+v %v", request, err)
+	}
+}
+
+func TestExchangeAuthorizationCode(t *testing.T) {
+	database := &testDatabase{}
+	user := User{Username: "testname", Password: "password", Email: "test@mail.com"}
+	user.Save(database)
+	request := testAuthorizationRequest(database)
+	client, _ := database.getClientByClientID(request.ClientID)
+
+	redirectURI, err := IssueAuthorizationCode(1, request, database)
+	if err != nil {
+		t.Fatalf("Failed to issue authorization code: %v", err)
+	}
+	parsed, _ := url.Parse(redirectURI)
+	code := parsed.Query().Get("code")
+	if code == "" || parsed.Query().Get("state") != "xyz" {
+		t.Fatalf("Expected code and state in redirect uri, got %s", redirectURI)
+	}
+
+	if _, err = ExchangeAuthorizationCode(code, request.RedirectURI, "wrong-verifier-wrong-verifier-wrong-verifier", client, database); err == nil {
+		t.Error("Expected wrong code verifier to be refused")
+	}
+	if _, err = ExchangeAuthorizationCode(code, request.RedirectURI, testVerifier, client, database); err != nil {
+		t.Errorf("A refused exchange should not use up the code; got %v", err)
+	}
+
+	redirectURI, _ = IssueAuthorizationCode(1, request, database)
+	parsed, _ = url.Parse(redirectURI)
+	code = parsed.Query().Get("code")
+	if _, err = ExchangeAuthorizationCode(code, "https://bot.example.com/other", testVerifier, client, database); err == nil {
+		t.Error("Expected mismatched redirect uri to be refused")
+	}
+
+	redirectURI, _ = IssueAuthorizationCode(1, request, database)
+	parsed, _ = url.Parse(redirectURI)
+	code = parsed.Query().Get("code")
+	tokens, err := ExchangeAuthorizationCode(code, request.RedirectURI, testVerifier, client, database)
+	if err != nil {
+		t.Fatalf("Expected code exchange to succeed, got %v", err)
+	}
+	if tokens.ClientID != client.ClientID || tokens.Scope != "chat profile" || tokens.UserID != 1 {
+		t.Errorf("Expected tokens for the client and scope, got %+v", tokens.Token)
+	}
+
+	if _, err = ExchangeAuthorizationCode(code, request.RedirectURI, testVerifier, client, database); err == nil {
+		t.Error("Expected reused code to be refused")
+	}
+	if _, err = CheckTokenKey(tokens.Key, database); err == nil {
+		t.Error("Expected tokens issued for a reused code to be revoked")
+	}
+
+	redirectURI, _ = IssueAuthorizationCode(1, request, database)
+	parsed, _ = url.Parse(redirectURI)
+	code = parsed.Query().Get("code")
+	BanUser(2, 1, "abuse", time.Time{}, database)
+	if _, err = ExchangeAuthorizationCode(code, request.RedirectURI, testVerifier, client, database); err == nil {
+		t.Error("Expected users banned after authorizing not to get tokens")
+	}
+}
+
+func TestConsent(t *testing.T) {
+	database := &testDatabase{}
+	request := testAuthorizationRequest(database)
+	if HasConsent(1, request, database) {
+		t.Error("Expected no consent before it is granted")
+	}
+	GrantConsent(1, request, database)
+	if !HasConsent(1, request, database) {
+		t.Error("Expected consent after it is granted")
+	}
+	request.Scope = "chat admin"
+	if HasConsent(1, request, database) {
+		t.Error("Expected consent not to cover new scopes")
+	}
+}
+
+func TestClientCredentialsGrant(t *testing.T) {
+	database := &testDatabase{}
+	client := Client{Name: "presence", GrantTypes: []string{"client_credentials"}, Scope: "presence:write messages:read"}
+	client.generateSecret()
+	if err := client.Save(database); err != nil {
+		t.Fatalf("Failed to save confidential client: %v", err)
+	}
+
+	token, err := ClientCredentialsGrant(client, "", database)
+	if err != nil {
+		t.Fatalf("Expected client credentials grant to succeed, got %v", err)
+	}
+	if token.Kind != TokenKindClient || token.UserID != 0 || token.Scope != client.Scope {
+		t.Errorf("Expected a client token with the registered scope, got %+v", token)
+	}
+	claims, err := VerifyKey(token.Key)
+	if err != nil || claims.Subject != client.ClientID || claims.Kind != TokenKindClient {
+		t.Errorf("Expected client token to verify with the client as subject, got %v", err)
+	}
+	validation := ValidateTokenKey(token.Key, database)
+	if validation.Status != TokenStatusValid || validation.Kind != TokenKindClient {
+		t.Error("Expected validation to report a client token")
+	}
+
+	token, err = ClientCredentialsGrant(client, "presence:write", database)
+	if err != nil || token.Scope != "presence:write" {
+		t.Error("Expected narrower scope to be allowed")
+	}
+	if _, err = ClientCredentialsGrant(client, "admin", database); err == nil {
+		t.Error("Expected scope outside the registration to be refused")
+	}
+
+	public := Client{Name: "bot", RedirectURIs: []string{"https://bot.example.com/callback"}}
+	public.Save(database)
+	if _, err = ClientCredentialsGrant(public, "", database); err == nil {
+		t.Error("Expected public client to be refused")
+	}
+	if (&Client{Name: "bot", GrantTypes: []string{"client_credentials"}}).Save(database) == nil {
+		t.Error("Expected public client not to register for client credentials")
+	}
+}
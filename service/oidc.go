@@ -0,0 +1,162 @@
+package service
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+//ErrOpenIDNotConfigured is returned when ID tokens can not be issued
+var ErrOpenIDNotConfigured = errors.New("OpenID Connect needs TOKEN_ISSUER set to an https url and an active RS256 or ES256 signing key")
+
+//openIDSigningAlgs are the ID token algorithms relying parties can verify
+//without a shared secret
+var openIDSigningAlgs = []string{"RS256", "ES256"}
+
+//IDTokenClaims are the claims of an OpenID Connect ID token
+type IDTokenClaims struct {
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	Email             string `json:"email,omitempty"`
+	Nonce             string `json:"nonce,omitempty"`
+	jwt.StandardClaims
+}
+
+//UserInfo holds the claims about a user released for the granted scopes
+type UserInfo struct {
+	Sub               string `json:"sub"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	Email             string `json:"email,omitempty"`
+}
+
+//OpenIDConfiguration is the OpenID Connect discovery document
+type OpenIDConfiguration struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	RegistrationEndpoint              string   `json:"registration_endpoint"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+//CheckOpenIDProvider reports whether ID tokens can be issued. TOKEN_ISSUER must
+//be the public https base url of the service and the active signing key must
+//be asymmetric, HS256 ID tokens can only be checked with the client secret.
+func CheckOpenIDProvider() error {
+	_, err := openIDSigningKey()
+	return err
+}
+
+func openIDSigningKey() (*SigningKey, error) {
+	issuer, err := url.Parse(os.Getenv("TOKEN_ISSUER"))
+	if err != nil || issuer.Scheme != "https" || issuer.Host == "" {
+		return nil, ErrOpenIDNotConfigured
+	}
+	key := currentKeyring().active(time.Now())
+	if key == nil {
+		return nil, ErrOpenIDNotConfigured
+	}
+	for _, alg := range openIDSigningAlgs {
+		if key.Method.Alg() == alg {
+			return key, nil
+		}
+	}
+	return nil, ErrOpenIDNotConfigured
+}
+
+//GetOpenIDConfiguration builds the discovery document, it is only served when
+//ID tokens can be issued
+func GetOpenIDConfiguration() (OpenIDConfiguration, error) {
+	key, err := openIDSigningKey()
+	if err != nil {
+		return OpenIDConfiguration{}, err
+	}
+	issuer := getIssuer()
+	base := strings.TrimSuffix(issuer, "/")
+	return OpenIDConfiguration{
+		Issuer:                            issuer,
+		AuthorizationEndpoint:             base + "/oauth/authorize",
+		TokenEndpoint:                     base + "/oauth/token",
+		UserinfoEndpoint:                  base + "/userinfo",
+		JWKSURI:                           base + "/.well-known/jwks.json",
+		RegistrationEndpoint:              base + "/oauth/clients",
+		IntrospectionEndpoint:             base + "/auth/introspect",
+		ScopesSupported:                   []string{"openid", "profile", "email"},
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code", "refresh_token", "client_credentials"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{key.Method.Alg()},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{"S256", "plain"},
+		ClaimsSupported:                   []string{"sub", "iss", "aud", "exp", "iat", "nonce", "preferred_username", "email"},
+	}, nil
+}
+
+//GetUserInfo returns the claims about a user that scope allows
+func GetUserInfo(userID uint, scope string, database Database) (UserInfo, error) {
+	user, err := database.getUserByID(userID)
+	if err != nil {
+		return UserInfo{}, err
+	}
+	info := UserInfo{Sub: strconv.FormatUint(uint64(user.ID), 10)}
+	if scopeCovers(scope, "profile") {
+		info.PreferredUsername = user.Username
+	}
+	if scopeCovers(scope, "email") {
+		info.Email = user.Email
+	}
+	return info, nil
+}
+
+//GenerateIDToken signs an ID token for the user with the client as audience
+func GenerateIDToken(userID uint, clientID, scope, nonce string, database Database) (string, error) {
+	key, err := openIDSigningKey()
+	if err != nil {
+		return "", err
+	}
+	info, err := GetUserInfo(userID, scope, database)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().Unix()
+	claims := IDTokenClaims{
+		PreferredUsername: info.PreferredUsername,
+		Email:             info.Email,
+		Nonce:             nonce,
+		StandardClaims: jwt.StandardClaims{
+			Subject:   info.Sub,
+			Issuer:    getIssuer(),
+			Audience:  clientID,
+			IssuedAt:  now,
+			ExpiresAt: getExpiresAtTime(),
+		},
+	}
+	return key.sign(claims)
+}
+
+//withIDToken adds an ID token for the openid scope, it is left out when ID
+//tokens can not be issued
+func withIDToken(tokens TokenPair, nonce string, database Database) (TokenPair, error) {
+	if !scopeCovers(tokens.Scope, "openid") {
+		return tokens, nil
+	}
+	idToken, err := GenerateIDToken(tokens.UserID, tokens.ClientID, tokens.Scope, nonce, database)
+	if err == ErrOpenIDNotConfigured {
+		return tokens, nil
+	}
+	tokens.IDToken = idToken
+	return tokens, err
+}
@@ -0,0 +1,166 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestGetUserInfo(t *testing.T) {
+	database := &testDatabase{}
+	user := User{Username: "testname", Password: "password", Email: "test@mail.com"}
+	user.Save(database)
+
+	info, err := GetUserInfo(user.ID, "openid", database)
+	if err != nil || info.Sub != "1" || info.Email != "" || info.PreferredUsername != "" {
+		t.Errorf("Expected only the subject for the openid scope, got %+v", info)
+	}
+
+	info, _ = GetUserInfo(user.ID, "openid profile email", database)
+	if info.Email != "test@mail.com" || info.PreferredUsername != "testname" {
+		t.Errorf("Expected profile and email claims, got %+v", info)
+	}
+
+	if _, err = GetUserInfo(5, "openid", database); err == nil {
+		t.Error("Expected error for unknown user")
+	}
+}
+
+//useTestOpenIDProvider signs with an ES256 key under an https issuer
+func useTestOpenIDProvider(t *testing.T) func() {
+	keys := testSigningKeys(t)
+	key, _ := LoadSigningKey("ES256", keys["ES256"])
+	KEYRING = NewKeyring(key)
+	os.Setenv("TOKEN_ISSUER", "https://auth.example.com")
+	return func() {
+		KEYRING = nil
+		os.Unsetenv("TOKEN_ISSUER")
+		for _, path := range keys {
+			os.Remove(path)
+		}
+	}
+}
+
+func TestCheckOpenIDProvider(t *testing.T) {
+	if CheckOpenIDProvider() != ErrOpenIDNotConfigured {
+		t.Error("Expected HS256 without an issuer url not to issue ID tokens")
+	}
+	defer useTestOpenIDProvider(t)()
+	if err := CheckOpenIDProvider(); err != nil {
+		t.Errorf("Expected ES256 with an https issuer to issue ID tokens; got %v", err)
+	}
+	os.Setenv("TOKEN_ISSUER", "http://auth.example.com")
+	if CheckOpenIDProvider() == nil {
+		t.Error("Expected the issuer to need https")
+	}
+	os.Setenv("TOKEN_ISSUER", "https://auth.example.com")
+	secret := []byte("secret")
+	KEYRING = NewKeyring(&SigningKey{Method: jwt.SigningMethodHS256, Private: secret, Public: secret})
+	if CheckOpenIDProvider() == nil {
+		t.Error("Expected symmetric keys not to sign ID tokens")
+	}
+}
+
+func TestExchangeAuthorizationCodeWithoutOpenID(t *testing.T) {
+	database := &testDatabase{}
+	user := User{Username: "testname", Password: "password", Email: "test@mail.com"}
+	user.Save(database)
+	request := testAuthorizationRequest(database)
+	request.Scope = "openid email"
+	client, _ := database.getClientByClientID(request.ClientID)
+
+	redirectURI, _ := IssueAuthorizationCode(user.ID, request, database)
+	parsed, _ := url.Parse(redirectURI)
+	tokens, err := ExchangeAuthorizationCode(parsed.Query().Get("code"), request.RedirectURI, testVerifier, client, database)
+	if err != nil || tokens.Key == "" || tokens.IDToken != "" {
+		t.Errorf("Expected tokens without an ID token; got %+v %v", tokens, err)
+	}
+}
+
+func TestExchangeAuthorizationCodeIDToken(t *testing.T) {
+	defer useTestOpenIDProvider(t)()
+	database := &testDatabase{}
+	user := User{Username: "testname", Password: "password", Email: "test@mail.com"}
+	user.Save(database)
+	request := testAuthorizationRequest(database)
+	request.Scope = "openid email"
+	request.Nonce = "n-0S6_WzA2Mj"
+	client, _ := database.getClientByClientID(request.ClientID)
+
+	redirectURI, _ := IssueAuthorizationCode(user.ID, request, database)
+	parsed, _ := url.Parse(redirectURI)
+	tokens, err := ExchangeAuthorizationCode(parsed.Query().Get("code"), request.RedirectURI, testVerifier, client, database)
+	if err != nil || tokens.IDToken == "" {
+		t.Fatalf("Expected an ID token, got %v", err)
+	}
+
+	var claims IDTokenClaims
+	_, err = jwt.ParseWithClaims(tokens.IDToken, &claims, currentKeyring().verificationKey)
+	if err != nil {
+		t.Fatalf("Expected ID token to verify, got %v", err)
+	}
+	if claims.Audience != client.ClientID || claims.Subject != "1" || claims.Nonce != request.Nonce || claims.Email != "test@mail.com" {
+		t.Errorf("Unexpected ID token claims %+v", claims)
+	}
+	if claims.Issuer != getIssuer() || claims.ExpiresAt <= time.Now().Unix() {
+		t.Error("Expected issuer and expiry claims")
+	}
+}
+
+func TestUserInfoHandler(t *testing.T) {
+	database := &testDatabase{}
+	user := User{Username: "testname", Password: "password", Email: "test@mail.com"}
+	user.Save(database)
+	database.addToken(&Token{Key: "openid", UserID: user.ID, ClientID: "bot", Scope: "openid profile", ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	database.addToken(&Token{Key: "chat", UserID: user.ID, ClientID: "bot", Scope: "chat", ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	server := MakeTestServer(database)
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/userinfo", nil)
+	request.Header.Set("Authorization", "Bearer chat")
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected token without openid scope to return %v; received %v", http.StatusUnauthorized, recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/userinfo", nil)
+	request.Header.Set("Authorization", "Bearer openid")
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected %v; received %v", http.StatusOK, recorder.Code)
+	}
+	var info UserInfo
+	json.Unmarshal(recorder.Body.Bytes(), &info)
+	if info.Sub != "1" || info.PreferredUsername != "testname" || info.Email != "" {
+		t.Errorf("Unexpected userinfo %+v", info)
+	}
+}
+
+func TestOpenIDConfigurationHandler(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/.well-known/openid-configuration", nil)
+	MakeTestServer(&testDatabase{}).ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected discovery to need an OpenID signing key; received %v", recorder.Code)
+	}
+
+	defer useTestOpenIDProvider(t)()
+	recorder = httptest.NewRecorder()
+	MakeTestServer(&testDatabase{}).ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected %v; received %v", http.StatusOK, recorder.Code)
+	}
+	var config OpenIDConfiguration
+	json.Unmarshal(recorder.Body.Bytes(), &config)
+	if config.Issuer != getIssuer() || config.JWKSURI != getIssuer()+"/.well-known/jwks.json" || len(config.IDTokenSigningAlgValuesSupported) != 1 || config.IDTokenSigningAlgValuesSupported[0] != "ES256" {
+		t.Errorf("Unexpected discovery document %+v", config)
+	}
+}
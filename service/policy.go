@@ -0,0 +1,182 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+//Password policy violation codes
+const (
+	PasswordTooShort         = "password_too_short"
+	PasswordTooLong          = "password_too_long"
+	PasswordContainsUsername = "password_contains_username"
+	PasswordContainsEmail    = "password_contains_email"
+	PasswordBreached         = "password_breached"
+)
+
+//bcrypt only uses the first 72 bytes of a password. argon2id uses all of it,
+//the cap only bounds the work a single hash can be made to do.
+const (
+	bcryptMaxBytes   = 72
+	argon2idMaxBytes = 1024
+)
+
+//PasswordViolation is one way a password breaks the policy
+type PasswordViolation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+//PasswordPolicyError lists every violation of a rejected password
+type PasswordPolicyError struct {
+	Message    string              `json:"message"`
+	Violations []PasswordViolation `json:"violations"`
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return e.Message
+}
+
+//PasswordPolicy is configured with PASSWORD_MIN_LENGTH and PASSWORD_BREACHED_FILE,
+//the maximum length follows PASSWORD_HASHER.
+//The breached file holds upper case hex SHA-1 hashes, or prefixes of them all
+//the same length, one per line in sorted order. Anything after a colon is ignored.
+type PasswordPolicy struct {
+	MinLength    int
+	MaxBytes     int
+	BreachedFile string
+}
+
+//CurrentPasswordPolicy reads the policy from the environment
+func CurrentPasswordPolicy() PasswordPolicy {
+	minLength, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_LENGTH"))
+	if err != nil || minLength <= 0 {
+		minLength = 8
+	}
+	maxBytes := bcryptMaxBytes
+	if os.Getenv("PASSWORD_HASHER") == HasherArgon2id {
+		maxBytes = argon2idMaxBytes
+	}
+	return PasswordPolicy{MinLength: minLength, MaxBytes: maxBytes, BreachedFile: os.Getenv("PASSWORD_BREACHED_FILE")}
+}
+
+//CheckPassword checks a new password for the user against the current policy
+func CheckPassword(password, username, email string) error {
+	return CurrentPasswordPolicy().Check(password, username, email)
+}
+
+//Check returns a PasswordPolicyError listing every violation, or nil
+func (p PasswordPolicy) Check(password, username, email string) error {
+	var violations []PasswordViolation
+	if utf8.RuneCountInString(password) < p.MinLength {
+		violations = append(violations, PasswordViolation{PasswordTooShort, "Password must be at least " + strconv.Itoa(p.MinLength) + " characters."})
+	}
+	if p.MaxBytes > 0 && len(password) > p.MaxBytes {
+		violations = append(violations, PasswordViolation{PasswordTooLong, "Password must be at most " + strconv.Itoa(p.MaxBytes) + " bytes."})
+	}
+	lower := strings.ToLower(password)
+	if containsIdentifier(lower, username) {
+		violations = append(violations, PasswordViolation{PasswordContainsUsername, "Password must not contain the username."})
+	}
+	localPart := strings.SplitN(email, "@", 2)[0]
+	if containsIdentifier(lower, email) || containsIdentifier(lower, localPart) {
+		violations = append(violations, PasswordViolation{PasswordContainsEmail, "Password must not contain the email address."})
+	}
+	if p.BreachedFile != "" {
+		breached, err := isBreachedPassword(p.BreachedFile, password)
+		if err != nil {
+			log.Print(err)
+		} else if breached {
+			violations = append(violations, PasswordViolation{PasswordBreached, "Password has appeared in a data breach."})
+		}
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	return &PasswordPolicyError{Message: "Password does not meet the password policy.", Violations: violations}
+}
+
+//containsIdentifier ignores very short identifiers that would ban too many passwords
+func containsIdentifier(password, identifier string) bool {
+	identifier = strings.ToLower(strings.TrimSpace(identifier))
+	return len(identifier) >= 3 && strings.Contains(password, identifier)
+}
+
+//isBreachedPassword binary searches the sorted corpus for the passwords hash
+//without loading the file
+func isBreachedPassword(path, password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := []byte(strings.ToUpper(hex.EncodeToString(sum[:])))
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	low, high := int64(0), info.Size()
+	for low < high {
+		start, line, err := corpusLineAt(file, low, (low+high)/2)
+		if err != nil {
+			return false, err
+		}
+		prefix := line
+		if i := bytes.IndexByte(line, ':'); i >= 0 {
+			prefix = line[:i]
+		}
+		prefix = bytes.ToUpper(bytes.TrimSpace(prefix))
+		if len(prefix) == 0 || len(prefix) > len(hash) {
+			return false, errors.New("Invalid line in breached password file")
+		}
+		switch bytes.Compare(hash[:len(prefix)], prefix) {
+		case 0:
+			return true, nil
+		case 1:
+			low = start + int64(len(line)) + 1
+		default:
+			high = start
+		}
+	}
+	return false, nil
+}
+
+const corpusMaxLine = 128
+
+//corpusLineAt returns the line containing offset and where it starts. Lines
+//start at or after low, which is always the start of a line.
+func corpusLineAt(file *os.File, low, offset int64) (int64, []byte, error) {
+	from := offset - corpusMaxLine
+	if from < low {
+		from = low
+	}
+	before := make([]byte, offset-from)
+	_, err := file.ReadAt(before, from)
+	if err != nil {
+		return 0, nil, err
+	}
+	start := from
+	if i := bytes.LastIndexByte(before, '\n'); i >= 0 {
+		start = from + int64(i) + 1
+	} else if from != low {
+		return 0, nil, errors.New("Line too long in breached password file")
+	}
+	line := make([]byte, corpusMaxLine)
+	n, err := file.ReadAt(line, start)
+	if n == 0 && err != nil {
+		return 0, nil, err
+	}
+	line = line[:n]
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	return start, line, nil
+}
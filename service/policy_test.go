@@ -0,0 +1,115 @@
+package service
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func writeBreachedCorpus(t *testing.T, prefixLength int, passwords ...string) string {
+	var lines []string
+	for _, password := range passwords {
+		sum := sha1.Sum([]byte(password))
+		lines = append(lines, strings.ToUpper(hex.EncodeToString(sum[:]))[:prefixLength]+":42")
+	}
+	for i := 0; i < 500; i++ {
+		sum := sha1.Sum([]byte{byte(i), byte(i >> 8), 'x'})
+		lines = append(lines, strings.ToUpper(hex.EncodeToString(sum[:]))[:prefixLength]+":1")
+	}
+	sort.Strings(lines)
+	file, err := ioutil.TempFile("", "breached")
+	if err != nil {
+		t.Fatalf("Failed to create corpus: %v", err)
+	}
+	defer file.Close()
+	file.WriteString(strings.Join(lines, "\n") + "\n")
+	return file.Name()
+}
+
+func violationCodes(err error) []string {
+	policyErr, ok := err.(*PasswordPolicyError)
+	if !ok {
+		return nil
+	}
+	var codes []string
+	for _, violation := range policyErr.Violations {
+		codes = append(codes, violation.Code)
+	}
+	return codes
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	policy := PasswordPolicy{MinLength: 8, MaxBytes: bcryptMaxBytes}
+	cases := map[string][]string{
+		"a":                        {PasswordTooShort},
+		"correct horse battery":    nil,
+		"my-testname-rocks":        {PasswordContainsUsername},
+		"TESTNAME":                 {PasswordContainsUsername},
+		"mail-person@mail.com!":    {PasswordContainsEmail},
+		"person1":                  {PasswordTooShort, PasswordContainsEmail},
+		strings.Repeat("long", 19): {PasswordTooLong},
+	}
+	for password, expected := range cases {
+		codes := violationCodes(policy.Check(password, "Testname", "person@mail.com"))
+		if strings.Join(codes, ",") != strings.Join(expected, ",") {
+			t.Errorf("%q: expected %v; got %v", password, expected, codes)
+		}
+	}
+}
+
+func TestPasswordPolicyMaxBytes(t *testing.T) {
+	defer os.Unsetenv("PASSWORD_HASHER")
+	password := strings.Repeat("long", 19)
+	codes := violationCodes(CheckPassword(password, "Testname", "person@mail.com"))
+	if strings.Join(codes, ",") != PasswordTooLong {
+		t.Errorf("Expected the bcrypt limit by default; got %v", codes)
+	}
+	os.Setenv("PASSWORD_HASHER", HasherArgon2id)
+	if err := CheckPassword(password, "Testname", "person@mail.com"); err != nil {
+		t.Errorf("Expected long passwords with argon2id; got %v", err)
+	}
+}
+
+func TestBreachedPasswords(t *testing.T) {
+	for _, prefixLength := range []int{40, 20} {
+		path := writeBreachedCorpus(t, prefixLength, "password123", "letmein-please", "zzzz")
+		defer os.Remove(path)
+		policy := PasswordPolicy{MinLength: 4, BreachedFile: path}
+		for _, password := range []string{"password123", "letmein-please", "zzzz"} {
+			codes := violationCodes(policy.Check(password, "", ""))
+			if len(codes) != 1 || codes[0] != PasswordBreached {
+				t.Errorf("%q should be breached with %d character prefixes; got %v", password, prefixLength, codes)
+			}
+		}
+		if err := policy.Check("an unlisted passphrase", "", ""); err != nil {
+			t.Errorf("Unlisted password should pass: %v", err)
+		}
+	}
+}
+
+func TestRegisterUserHandlerPasswordPolicy(t *testing.T) {
+	database := &testDatabase{}
+	server := MakeTestServer(database)
+	body := `{"username":"Testname","password":"a","email":"test@mail.com"}`
+	req, _ := http.NewRequest("POST", "/auth/register", strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400; got %d", recorder.Code)
+	}
+	var policyErr PasswordPolicyError
+	json.Unmarshal(recorder.Body.Bytes(), &policyErr)
+	if len(policyErr.Violations) != 1 || policyErr.Violations[0].Code != PasswordTooShort {
+		t.Errorf("Expected a too short violation; got %s", recorder.Body.String())
+	}
+	if len(database.users) != 0 {
+		t.Error("User should not be created")
+	}
+}
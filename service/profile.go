@@ -0,0 +1,144 @@
+package service
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strings"
+)
+
+//ErrIncorrectPassword is returned when the current password sent with a change is wrong
+var ErrIncorrectPassword = errors.New("Current password is incorrect")
+
+//ErrUsernameTaken is returned when renaming to a username another user has,
+//deleted users keep theirs
+var ErrUsernameTaken = errors.New("Username is already in use")
+
+//Profile is the signed in user as shown to themselves
+type Profile struct {
+	User
+	Roles []string `json:"roles"`
+}
+
+//GetProfile returns the user with their roles, without the password hash
+func GetProfile(userID uint, database Database) (Profile, error) {
+	user, err := database.getUserByID(userID)
+	if err != nil {
+		return Profile{}, errors.New("User not found")
+	}
+	user.Password = ""
+	user.Status = user.Status.current().public()
+	roles, err := UserRoles(userID, database)
+	if err != nil {
+		return Profile{}, err
+	}
+	return Profile{User: user, Roles: roles}, nil
+}
+
+//UpdateUsername renames the user, the email is changed with RequestEmailChange
+func UpdateUsername(userID uint, username string, database Database) error {
+	username = strings.TrimSpace(username)
+	err := validateUsername(username)
+	if err != nil {
+		return err
+	}
+	existing, err := database.getUserByUsername(username)
+	if err == nil && existing.ID != userID {
+		return ErrUsernameTaken
+	}
+	return database.updateUsername(userID, username)
+}
+
+//ChangePassword sets a new password after checking the current one and signs
+//the user out everywhere except the session the token belongs to. Wrong
+//passwords count towards the login lockout and reset links sent before stop
+//working.
+func ChangePassword(token Token, current, password, ip string, database Database) error {
+	user, err := database.getUserByID(token.UserID)
+	if err != nil {
+		return errors.New("User not found")
+	}
+	err = checkLoginLockout(user.Username, ip, database)
+	if err != nil {
+		return err
+	}
+	if !user.CheckPasswordEqual(current) {
+		recordLoginFailure(user.Username, ip, database)
+		return ErrIncorrectPassword
+	}
+	err = CheckPassword(password, user.Username, user.Email)
+	if err != nil {
+		return err
+	}
+	user.Password = password
+	err = user.hashPassword()
+	if err != nil {
+		return err
+	}
+	err = database.updateUserPassword(user.ID, user.Password)
+	if err != nil {
+		return err
+	}
+	err = database.usePasswordResets(user.ID)
+	if err != nil {
+		return err
+	}
+	return RevokeOtherSessions(token, database)
+}
+
+//RequestEmailChange emails a link to the new address, the address changes
+//once the link is followed. The current password is required and wrong ones
+//count towards the login lockout like in ChangePassword.
+func RequestEmailChange(userID uint, password, email, ip string, database Database) error {
+	email = strings.TrimSpace(email)
+	if !strings.Contains(email, "@") || strings.ContainsAny(email, " \r\n") {
+		return errors.New("Invalid email address")
+	}
+	user, err := database.getUserByID(userID)
+	if err != nil {
+		return errors.New("User not found")
+	}
+	err = checkLoginLockout(user.Username, ip, database)
+	if err != nil {
+		return err
+	}
+	if !user.CheckPasswordEqual(password) {
+		recordLoginFailure(user.Username, ip, database)
+		return ErrIncorrectPassword
+	}
+	if email == user.Email {
+		return errors.New("Email address has not changed")
+	}
+	_, err = database.getUserByEmail(email)
+	if err == nil {
+		return errors.New("Email address is already in use")
+	}
+	key, err := generateVerificationKey(user.ID, email, user.Email)
+	if err != nil {
+		return err
+	}
+	body := "Use this link to change your email address to " + email + ", it expires in one day:\n\n" +
+		os.Getenv("VERIFY_EMAIL_URL") + key + "\n\n" +
+		"If you did not ask to change your email address you can ignore this email.\n"
+	return sendMail(email, "Confirm your new email address", body)
+}
+
+//changeEmail applies an email change link. The link only works while the
+//address is still the one it was requested from. The previous address is
+//told about the change.
+func changeEmail(user User, previous, email string, database Database) error {
+	changed, err := database.changeUserEmail(user.ID, previous, email)
+	if err != nil {
+		return err
+	}
+	if !changed {
+		return errors.New("Invalid verification token")
+	}
+	body := "The email address of your account " + user.Username + " was changed to " + email + ".\n\n" +
+		"If you did not change it reset your password and contact support.\n"
+	err = sendMail(previous, "Your email address was changed", body)
+	if err != nil {
+		log.Print(err)
+	}
+	return nil
+}
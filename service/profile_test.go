@@ -0,0 +1,134 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestProfileHandlers(t *testing.T) {
+	database := &testDatabase{}
+	saveTestUser(database)
+	other := User{Username: "Othername", Password: "otherpassword", Email: "other@mail.com"}
+	other.Save(database)
+	server := MakeTestServer(database)
+	tokens, _ := UserLogin("Testname", "testpassword", database)
+
+	recorder := bearerRequest(server, "GET", "/auth/me", "", "")
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected %v; received %v", http.StatusUnauthorized, recorder.Code)
+	}
+	recorder = bearerRequest(server, "GET", "/auth/me", tokens.Key, "")
+	var profile Profile
+	json.Unmarshal(recorder.Body.Bytes(), &profile)
+	if recorder.Code != http.StatusOK || profile.Username != "Testname" || profile.Password != "" || len(profile.Roles) != 1 {
+		t.Errorf("Unexpected profile %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = bearerRequest(server, "PATCH", "/auth/me", tokens.Key, `{"username": "Othername"}`)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected a taken username to be refused; received %v", recorder.Code)
+	}
+	recorder = bearerRequest(server, "PATCH", "/auth/me", tokens.Key, `{"username": " Newname "}`)
+	json.Unmarshal(recorder.Body.Bytes(), &profile)
+	if recorder.Code != http.StatusOK || profile.Username != "Newname" {
+		t.Errorf("Expected the username to change; got %d %s", recorder.Code, recorder.Body.String())
+	}
+	if _, err := UserLogin("Newname", "testpassword", database); err != nil {
+		t.Errorf("Expected login with the new username; got %v", err)
+	}
+
+	recorder = bearerRequest(server, "PATCH", "/auth/me", tokens.Key, `{"username": "New name"}`)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected usernames to be validated like at signup; received %v", recorder.Code)
+	}
+	DeleteUser(2, other.ID, database)
+	recorder = bearerRequest(server, "PATCH", "/auth/me", tokens.Key, `{"username": "Othername"}`)
+	if recorder.Code != http.StatusBadRequest || recorder.Body.String() != "\"Username is already in use.\"\n" {
+		t.Errorf("Expected deleted users to keep their username; got %d %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	mailer := &MemoryMailer{}
+	MAILER = mailer
+	defer func() { MAILER = nil }()
+	database := &testDatabase{}
+	saveTestUser(database)
+	server := MakeTestServer(database)
+	RequestPasswordReset("test@mail.com", database)
+	resetKey := resetKeyFromMail(t, mailer, "test@mail.com")
+	current, _ := UserLogin("Testname", "testpassword", database)
+	other, _ := UserLogin("Testname", "testpassword", database)
+
+	recorder := bearerRequest(server, "POST", "/auth/me/password", current.Key, `{"current_password": "wrongpassword", "password": "a new password"}`)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected %v; received %v", http.StatusForbidden, recorder.Code)
+	}
+	recorder = bearerRequest(server, "POST", "/auth/me/password", current.Key, `{"current_password": "testpassword", "password": "short"}`)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected the password policy to apply; received %v", recorder.Code)
+	}
+	recorder = bearerRequest(server, "POST", "/auth/me/password", current.Key, `{"current_password": "testpassword", "password": "a new password"}`)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected %v; received %v %s", http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+	if _, err := UserLogin("Testname", "a new password", database); err != nil {
+		t.Errorf("Expected login with the new password; got %v", err)
+	}
+	if ValidateTokenKey(current.Key, database).Status != TokenStatusValid {
+		t.Error("Changing the password should keep the current session")
+	}
+	if ValidateTokenKey(other.Key, database).Status != TokenStatusRevoked {
+		t.Error("Changing the password should sign out other sessions")
+	}
+	if err := ResetPassword(resetKey, "another new password", database); err == nil {
+		t.Error("Changing the password should stop earlier reset links")
+	}
+}
+
+func TestChangeEmail(t *testing.T) {
+	mailer := &MemoryMailer{}
+	MAILER = mailer
+	defer func() { MAILER = nil }()
+	database := &testDatabase{}
+	saveTestUser(database)
+	other := User{Username: "Othername", Password: "otherpassword", Email: "other@mail.com"}
+	other.Save(database)
+	server := MakeTestServer(database)
+	tokens, _ := UserLogin("Testname", "testpassword", database)
+
+	recorder := bearerRequest(server, "POST", "/auth/me/email", tokens.Key, `{"email": "new@mail.com", "password": "wrongpassword"}`)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected %v; received %v", http.StatusForbidden, recorder.Code)
+	}
+	if failures := usernameLockout.get("Testname", database); failures.Count != 1 {
+		t.Errorf("Expected wrong passwords to count towards the lockout; got %d", failures.Count)
+	}
+	recorder = bearerRequest(server, "POST", "/auth/me/email", tokens.Key, `{"email": "other@mail.com", "password": "testpassword"}`)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected a used email to be refused; received %v", recorder.Code)
+	}
+	recorder = bearerRequest(server, "POST", "/auth/me/email", tokens.Key, `{"email": "new@mail.com", "password": "testpassword"}`)
+	if recorder.Code != http.StatusAccepted {
+		t.Fatalf("Expected %v; received %v %s", http.StatusAccepted, recorder.Code, recorder.Body.String())
+	}
+	if database.users[0].Email != "test@mail.com" {
+		t.Fatal("The email should only change once the link is followed")
+	}
+
+	key := verificationKeyFromMail(t, mailer, "new@mail.com")
+	err := VerifyEmail(key, database)
+	if err != nil {
+		t.Fatalf("Failed to change email: %v", err)
+	}
+	if database.users[0].Email != "new@mail.com" || !database.users[0].isVerified() {
+		t.Errorf("Expected the new email to be verified; got %+v", database.users[0])
+	}
+	if message, ok := mailer.Last("test@mail.com"); !ok || message.Subject != "Your email address was changed" {
+		t.Error("Expected the previous address to be told about the change")
+	}
+	if err = VerifyEmail(key, database); err == nil {
+		t.Error("An email change link should only work once")
+	}
+}
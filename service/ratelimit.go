@@ -0,0 +1,220 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/unrolled/render"
+)
+
+//Rate limit keys, the part of a request its requests are counted by
+const (
+	RateLimitKeyIP       = "ip"
+	RateLimitKeyUsername = "username"
+	RateLimitKeyClientID = "client_id"
+)
+
+//RateLimitRule limits requests to a route counted by one key. Path segments
+//in braces, like /auth/token/{key}, match any value.
+type RateLimitRule struct {
+	Method string        `json:"method"`
+	Path   string        `json:"path"`
+	Key    string        `json:"key"`
+	Limit  int64         `json:"limit"`
+	Window time.Duration `json:"window"`
+}
+
+//RateLimiter is negroni middleware counting requests in redis with a sliding
+//window, so limits are shared by every replica
+type RateLimiter struct {
+	formatter *render.Render
+	database  Database
+	rules     []RateLimitRule
+}
+
+type rateLimitResult struct {
+	limit     int64
+	remaining int64
+	reset     time.Duration
+}
+
+//NewRateLimiter returns middleware enforcing rules
+func NewRateLimiter(formatter *render.Render, database Database, rules []RateLimitRule) *RateLimiter {
+	return &RateLimiter{formatter: formatter, database: database, rules: rules}
+}
+
+//DefaultRateLimitRules are used unless RATE_LIMITS is set
+func DefaultRateLimitRules() []RateLimitRule {
+	return []RateLimitRule{
+		{Method: "POST", Path: "/auth/register", Key: RateLimitKeyIP, Limit: 10, Window: time.Hour},
+		{Method: "POST", Path: "/auth/login", Key: RateLimitKeyIP, Limit: 30, Window: time.Minute},
+		{Method: "POST", Path: "/auth/login", Key: RateLimitKeyUsername, Limit: 10, Window: time.Minute},
+		{Method: "GET", Path: "/auth/token/{key}", Key: RateLimitKeyIP, Limit: 600, Window: time.Minute},
+		{Method: "GET", Path: "/auth/token/{key}", Key: RateLimitKeyClientID, Limit: 1200, Window: time.Minute},
+	}
+}
+
+//LoadRateLimitRules reads rules from RATE_LIMITS, a JSON list of rules with
+//windows in seconds, falling back to DefaultRateLimitRules
+func LoadRateLimitRules() ([]RateLimitRule, error) {
+	value := os.Getenv("RATE_LIMITS")
+	if value == "" {
+		return DefaultRateLimitRules(), nil
+	}
+	var rules []RateLimitRule
+	err := json.Unmarshal([]byte(value), &rules)
+	if err != nil {
+		return nil, err
+	}
+	for i := range rules {
+		rules[i].Window *= time.Second
+		err = rules[i].validate()
+		if err != nil {
+			return nil, fmt.Errorf("Rule %d: %v", i, err)
+		}
+	}
+	return rules, nil
+}
+
+func (r RateLimitRule) validate() error {
+	if r.Method == "" || r.Path == "" {
+		return errors.New("A method and path are required")
+	}
+	switch r.Key {
+	case RateLimitKeyIP, RateLimitKeyUsername, RateLimitKeyClientID:
+	default:
+		return errors.New("Unknown key " + r.Key)
+	}
+	if r.Limit <= 0 {
+		return errors.New("The limit must be positive")
+	}
+	if r.Window <= 0 {
+		return errors.New("The window must be positive")
+	}
+	return nil
+}
+
+func (l *RateLimiter) ServeHTTP(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	var strictest *rateLimitResult
+	for _, rule := range l.rules {
+		if rule.Method != req.Method || !matchRoute(rule.Path, req.URL.Path) {
+			continue
+		}
+		key := rateLimitKey(rule.Key, req)
+		if key == "" {
+			continue
+		}
+		result, err := l.count(rule, key)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		if strictest == nil || result.remaining < strictest.remaining {
+			strictest = &result
+		}
+	}
+	if strictest == nil {
+		next(w, req)
+		return
+	}
+	reset := strconv.Itoa(int(math.Ceil(strictest.reset.Seconds())))
+	w.Header().Set("RateLimit-Limit", strconv.FormatInt(strictest.limit, 10))
+	w.Header().Set("RateLimit-Remaining", strconv.FormatInt(strictest.remaining, 10))
+	w.Header().Set("RateLimit-Reset", reset)
+	if strictest.remaining < 0 {
+		w.Header().Set("RateLimit-Remaining", "0")
+		w.Header().Set("Retry-After", reset)
+		l.formatter.JSON(w, http.StatusTooManyRequests, "Too many requests.")
+		return
+	}
+	next(w, req)
+}
+
+//count adds the request to the current window and estimates the rate over the
+//last full window by weighting the previous windows count
+func (l *RateLimiter) count(rule RateLimitRule, key string) (rateLimitResult, error) {
+	now := time.Now()
+	window := now.UnixNano() / int64(rule.Window)
+	prefix := "ratelimit:" + rule.Method + ":" + rule.Path + ":" + rule.Key + ":" + key + ":"
+	current, err := l.database.redisIncrement(prefix+strconv.FormatInt(window, 10), 2*rule.Window)
+	if err != nil {
+		return rateLimitResult{}, err
+	}
+	var previous int64
+	value, err := l.database.redisGetValue(prefix + strconv.FormatInt(window-1, 10))
+	if err == nil && value != "" {
+		previous, _ = strconv.ParseInt(value, 10, 64)
+	}
+	elapsed := time.Duration(now.UnixNano() - window*int64(rule.Window))
+	weight := 1 - float64(elapsed)/float64(rule.Window)
+	used := current + int64(float64(previous)*weight)
+	return rateLimitResult{
+		limit:     rule.Limit,
+		remaining: rule.Limit - used,
+		reset:     rule.Window - elapsed,
+	}, nil
+}
+
+func rateLimitKey(kind string, req *http.Request) string {
+	switch kind {
+	case RateLimitKeyIP:
+		return clientIP(req)
+	case RateLimitKeyUsername:
+		return requestUsername(req)
+	case RateLimitKeyClientID:
+		if clientID, _, ok := req.BasicAuth(); ok {
+			return clientID
+		}
+		return req.URL.Query().Get("client_id")
+	}
+	return ""
+}
+
+//requestUsername reads the username from a JSON body and puts the body back for the handler
+func requestUsername(req *http.Request) string {
+	if req.Body == nil {
+		return ""
+	}
+	payload, err := ioutil.ReadAll(io.LimitReader(req.Body, 1<<20))
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(payload))
+	if err != nil {
+		return ""
+	}
+	var body struct {
+		Username string `json:"username"`
+	}
+	json.Unmarshal(payload, &body)
+	return body.Username
+}
+
+func matchRoute(pattern, path string) bool {
+	patternParts := strings.Split(strings.Trim(pattern, "/"), "/")
+	pathParts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(patternParts) != len(pathParts) {
+		return false
+	}
+	for i, part := range patternParts {
+		if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+			if pathParts[i] == "" {
+				return false
+			}
+			continue
+		}
+		if part != pathParts[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,126 @@
+package service
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/urfave/negroni"
+)
+
+func makeRateLimitedServer(database Database, rules []RateLimitRule) *negroni.Negroni {
+	n := negroni.New(NewRateLimiter(formatter, database, rules))
+	n.UseHandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		payload, _ := ioutil.ReadAll(req.Body)
+		w.Write(payload)
+	})
+	return n
+}
+
+func TestRateLimiter(t *testing.T) {
+	database := &testDatabase{}
+	server := makeRateLimitedServer(database, []RateLimitRule{
+		{Method: "GET", Path: "/auth/token/{key}", Key: RateLimitKeyIP, Limit: 2, Window: time.Hour},
+	})
+	for i := 0; i < 2; i++ {
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest("GET", "/auth/token/abc", nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("Request %d should be allowed; got %d", i, recorder.Code)
+		}
+		if recorder.Header().Get("RateLimit-Limit") != "2" || recorder.Header().Get("RateLimit-Remaining") != strconv.Itoa(1-i) {
+			t.Errorf("Unexpected rate limit headers %v", recorder.Header())
+		}
+	}
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest("GET", "/auth/token/def", nil))
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429; got %d", recorder.Code)
+	}
+	if recorder.Header().Get("Retry-After") == "" || recorder.Header().Get("RateLimit-Remaining") != "0" {
+		t.Errorf("Expected Retry-After on limited responses; got %v", recorder.Header())
+	}
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest("POST", "/auth/token/refresh", nil))
+	if recorder.Code != http.StatusOK || recorder.Header().Get("RateLimit-Limit") != "" {
+		t.Error("Other routes should not be limited")
+	}
+	req := httptest.NewRequest("GET", "/auth/token/abc", nil)
+	req.RemoteAddr = "10.0.0.9:1234"
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Error("Other ips should have their own limit")
+	}
+}
+
+func TestRateLimiterUsername(t *testing.T) {
+	database := &testDatabase{}
+	server := makeRateLimitedServer(database, []RateLimitRule{
+		{Method: "POST", Path: "/auth/login", Key: RateLimitKeyUsername, Limit: 1, Window: time.Minute},
+	})
+	body := `{"username":"Testname","password":"testpassword"}`
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest("POST", "/auth/login", bytes.NewBufferString(body)))
+	if recorder.Code != http.StatusOK || recorder.Body.String() != body {
+		t.Fatalf("The handler should still receive the body; got %d %q", recorder.Code, recorder.Body.String())
+	}
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest("POST", "/auth/login", bytes.NewBufferString(body)))
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429; got %d", recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest("POST", "/auth/login", bytes.NewBufferString(`{"username":"other"}`)))
+	if recorder.Code != http.StatusOK {
+		t.Error("Other usernames should have their own limit")
+	}
+}
+
+func TestMatchRoute(t *testing.T) {
+	cases := []struct {
+		pattern, path string
+		match         bool
+	}{
+		{"/auth/login", "/auth/login", true},
+		{"/auth/login", "/auth/login/mfa", false},
+		{"/auth/token/{key}", "/auth/token/abc", true},
+		{"/auth/token/{key}", "/auth/token/", false},
+		{"/auth/token/{key}", "/auth/token/abc/def", false},
+	}
+	for _, c := range cases {
+		if matchRoute(c.pattern, c.path) != c.match {
+			t.Errorf("matchRoute(%q, %q) should be %v", c.pattern, c.path, c.match)
+		}
+	}
+}
+
+func TestLoadRateLimitRules(t *testing.T) {
+	defer os.Unsetenv("RATE_LIMITS")
+	os.Setenv("RATE_LIMITS", `[{"method": "POST", "path": "/auth/login", "key": "ip", "limit": 5, "window": 60}]`)
+	rules, err := LoadRateLimitRules()
+	if err != nil || len(rules) != 1 || rules[0].Window != time.Minute {
+		t.Errorf("Expected the rule with its window in seconds; got %+v %v", rules, err)
+	}
+
+	invalid := []string{
+		`[{"method": "POST", "path": "/auth/login", "key": "ip", "limit": 5}]`,
+		`[{"method": "POST", "path": "/auth/login", "key": "ip", "limit": 5, "window": -60}]`,
+		`[{"method": "POST", "path": "/auth/login", "key": "ip", "limit": 0, "window": 60}]`,
+		`[{"method": "POST", "path": "/auth/login", "key": "email", "limit": 5, "window": 60}]`,
+		`[{"method": "", "path": "/auth/login", "key": "ip", "limit": 5, "window": 60}]`,
+		`[{"method": "POST", "path": "", "key": "ip", "limit": 5, "window": 60}]`,
+	}
+	for _, value := range invalid {
+		os.Setenv("RATE_LIMITS", value)
+		if _, err = LoadRateLimitRules(); err == nil {
+			t.Errorf("Expected %s to be refused", value)
+		}
+	}
+}
@@ -32,3 +32,33 @@ func (r *redisClient) redisGetValue(key string) (string, error) {
 func (r *redisClient) redisSetValue(key, value string, seconds time.Duration) error {
 	return REDIS.Set(key, value, seconds).Err()
 }
+
+func (r *redisClient) redisDeleteValue(key string) error {
+	return REDIS.Del(key).Err()
+}
+
+//redisTakeValue gets and deletes a value. Only the caller whose delete
+//removed the key gets the value, so it can be taken once.
+func (r *redisClient) redisTakeValue(key string) (string, error) {
+	value, err := REDIS.Get(key).Result()
+	if err != nil {
+		return "", err
+	}
+	deleted, err := REDIS.Del(key).Result()
+	if err != nil || deleted != 1 {
+		return "", err
+	}
+	return value, nil
+}
+
+//redisIncrement adds one to a counter, the expiration is set when it is created
+func (r *redisClient) redisIncrement(key string, expiration time.Duration) (int64, error) {
+	count, err := REDIS.Incr(key).Result()
+	if err != nil {
+		return count, err
+	}
+	if count == 1 {
+		err = REDIS.Expire(key, expiration).Err()
+	}
+	return count, err
+}
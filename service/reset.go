@@ -0,0 +1,102 @@
+package service
+
+import (
+	"errors"
+	"log"
+	"os"
+	"time"
+)
+
+//RequestPasswordReset emails a single use reset token to the user with the
+//email. Unknown emails are not reported so accounts can not be discovered.
+func RequestPasswordReset(email string, database Database) error {
+	user, err := database.getUserByEmail(email)
+	if err != nil {
+		return nil
+	}
+	return sendPasswordReset(user, database)
+}
+
+//sendPasswordReset creates a reset token for the user and emails it to them,
+//tokens sent before stop working
+func sendPasswordReset(user User, database Database) error {
+	key, err := randomString(32)
+	if err != nil {
+		return err
+	}
+	err = database.usePasswordResets(user.ID)
+	if err != nil {
+		return err
+	}
+	reset := PasswordReset{
+		Key:       key,
+		UserID:    user.ID,
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	}
+	err = reset.Save(database)
+	if err != nil {
+		return err
+	}
+	body := "Use this link to reset your password, it expires in one hour:\n\n" +
+		os.Getenv("RESET_PASSWORD_URL") + key + "\n\n" +
+		"If you did not ask to reset your password you can ignore this email.\n"
+	err = sendMail(user.Email, "Reset your password", body)
+	if err != nil {
+		log.Print(err)
+	}
+	return err
+}
+
+//ResetPassword sets a new password with a reset token, signs the user out
+//everywhere and lifts the login lockout
+func ResetPassword(key, password string, database Database) error {
+	hash := hashKey(key)
+	reset, err := database.getPasswordResetByHash(hash)
+	if err != nil {
+		return errors.New("Invalid reset token")
+	}
+	if reset.isUsed() || !reset.isValid() {
+		return errors.New("Reset token has expired")
+	}
+	account, err := database.getUserByID(reset.UserID)
+	if err != nil || !account.DeletedAt.IsZero() {
+		return errors.New("Invalid reset token")
+	}
+	err = CheckPassword(password, account.Username, account.Email)
+	if err != nil {
+		return err
+	}
+	used, err := database.usePasswordReset(hash)
+	if err != nil {
+		return err
+	}
+	if !used {
+		return errors.New("Reset token has expired")
+	}
+	err = database.usePasswordResets(account.ID)
+	if err != nil {
+		return err
+	}
+	user := User{ID: reset.UserID, Password: password}
+	err = user.hashPassword()
+	if err != nil {
+		return err
+	}
+	err = database.updateUserPassword(user.ID, user.Password)
+	if err != nil {
+		return err
+	}
+	clearLoginFailures(account.Username, database)
+	return revokeUserTokens(user.ID, database)
+}
+
+func revokeUserTokens(userID uint, database Database) error {
+	keys, err := database.revokeUserTokens(userID)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		database.redisDeleteValue(key)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package service
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func resetKeyFromMail(t *testing.T, mailer *MemoryMailer, to string) string {
+	message, ok := mailer.Last(to)
+	if !ok {
+		t.Fatalf("No email sent to %s", to)
+	}
+	parts := strings.Split(message.Body, "\n\n")
+	if len(parts) < 2 || parts[1] == "" {
+		t.Fatalf("Reset email has no token: %q", message.Body)
+	}
+	return parts[1]
+}
+
+func TestResetPassword(t *testing.T) {
+	mailer := &MemoryMailer{}
+	MAILER = mailer
+	defer func() { MAILER = nil }()
+	database := &testDatabase{}
+	user := User{Username: "Testname", Password: "testpassword", Email: "test@mail.com"}
+	user.Save(database)
+	tokens, err := UserLogin("Testname", "testpassword", database)
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+
+	err = RequestPasswordReset("test@mail.com", database)
+	if err != nil {
+		t.Fatalf("Failed to request reset: %v", err)
+	}
+	key := resetKeyFromMail(t, mailer, "test@mail.com")
+	if database.resets[0].KeyHash == key || database.resets[0].KeyHash != hashKey(key) {
+		t.Error("Only the hash of the reset key should be stored")
+	}
+
+	err = ResetPassword(key, "newpassword", database)
+	if err != nil {
+		t.Fatalf("Failed to reset password: %v", err)
+	}
+	_, err = UserLogin("Testname", "testpassword", database)
+	if err == nil {
+		t.Error("Old password should no longer work")
+	}
+	_, err = UserLogin("Testname", "newpassword", database)
+	if err != nil {
+		t.Errorf("New password should work: %v", err)
+	}
+	if ValidateTokenKey(tokens.Key, database).Status != TokenStatusRevoked {
+		t.Error("Resetting the password should revoke existing tokens")
+	}
+	err = ResetPassword(key, "anotherpassword", database)
+	if err == nil {
+		t.Error("Reset token should only be usable once")
+	}
+}
+
+func TestResetPasswordOutstandingResets(t *testing.T) {
+	mailer := &MemoryMailer{}
+	MAILER = mailer
+	defer func() { MAILER = nil }()
+	database := &testDatabase{}
+	user := User{Username: "Testname", Password: "testpassword", Email: "test@mail.com"}
+	user.Save(database)
+
+	RequestPasswordReset("test@mail.com", database)
+	first := resetKeyFromMail(t, mailer, "test@mail.com")
+	RequestPasswordReset("test@mail.com", database)
+	second := resetKeyFromMail(t, mailer, "test@mail.com")
+	RequestPasswordReset("test@mail.com", database)
+	third := resetKeyFromMail(t, mailer, "test@mail.com")
+	if err := ResetPassword(first, "newpassword", database); err == nil {
+		t.Error("Requesting a new reset should invalidate older ones")
+	}
+
+	for i := 0; i < usernameLockout.threshold; i++ {
+		recordLoginFailure("Testname", "", database)
+	}
+	if checkLoginLockout("Testname", "", database) == nil {
+		t.Fatal("Expected the username to be locked")
+	}
+	if err := ResetPassword(third, "newpassword", database); err != nil {
+		t.Fatalf("Failed to reset password: %v", err)
+	}
+	if err := checkLoginLockout("Testname", "", database); err != nil {
+		t.Errorf("Resetting the password should lift the lockout; got %v", err)
+	}
+	for _, reset := range database.resets {
+		if reset.UsedAt.IsZero() {
+			t.Errorf("Expected every reset to be used; %d is not", reset.ID)
+		}
+	}
+	if err := ResetPassword(second, "anotherpassword", database); err == nil {
+		t.Error("Older reset tokens should not work after a reset")
+	}
+}
+
+func TestResetPasswordDeletedUser(t *testing.T) {
+	mailer := &MemoryMailer{}
+	MAILER = mailer
+	defer func() { MAILER = nil }()
+	database := &testDatabase{}
+	user := User{Username: "Testname", Password: "testpassword", Email: "test@mail.com"}
+	user.Save(database)
+
+	RequestPasswordReset("test@mail.com", database)
+	key := resetKeyFromMail(t, mailer, "test@mail.com")
+	database.deleteUser(user.ID, true)
+	if err := ResetPassword(key, "newpassword", database); err == nil {
+		t.Error("Deleted users should not reset their password")
+	}
+}
+
+func TestResetPasswordExpired(t *testing.T) {
+	database := &testDatabase{}
+	reset := PasswordReset{Key: "expired", UserID: 1, ExpiresAt: time.Now().Add(-time.Minute).Unix()}
+	reset.Save(database)
+	err := ResetPassword("expired", "newpassword", database)
+	if err == nil {
+		t.Error("Expired reset token should not be usable")
+	}
+}
+
+func TestRequestPasswordResetUnknownEmail(t *testing.T) {
+	mailer := &MemoryMailer{}
+	MAILER = mailer
+	defer func() { MAILER = nil }()
+	database := &testDatabase{}
+	err := RequestPasswordReset("nobody@mail.com", database)
+	if err != nil {
+		t.Errorf("Unknown emails should not be reported: %v", err)
+	}
+	if len(mailer.Messages) != 0 || len(database.resets) != 0 {
+		t.Error("No reset should be created for an unknown email")
+	}
+}
@@ -0,0 +1,163 @@
+package service
+
+import (
+	"errors"
+	"log"
+)
+
+//Roles every deployment starts with, see tables.sql
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+	RoleBot       = "bot"
+)
+
+//Permissions checked by chat-auth itself, other permissions are checked by
+//the services reading the tokens
+const (
+	PermissionRolesManage   = "roles:manage"
+	PermissionUsersRead     = "users:read"
+	PermissionUsersManage   = "users:manage"
+	PermissionClientsManage = "clients:manage"
+)
+
+//Audit event types for role changes
+const (
+	AuditRoleGranted       = "role.granted"
+	AuditRoleRevoked       = "role.revoked"
+	AuditPermissionGranted = "permission.granted"
+	AuditPermissionRevoked = "permission.revoked"
+)
+
+//Role errors
+var (
+	ErrRoleNotFound       = errors.New("Role not found")
+	ErrPermissionNotFound = errors.New("Permission not found")
+)
+
+//UserRoles returns the effective roles of a user. Every user has RoleUser,
+//it is listed first followed by the assigned roles.
+func UserRoles(userID uint, database Database) ([]string, error) {
+	assigned, err := database.getUserRoles(userID)
+	if err != nil {
+		return nil, err
+	}
+	roles := []string{RoleUser}
+	for _, role := range assigned {
+		if role != RoleUser {
+			roles = append(roles, role)
+		}
+	}
+	return roles, nil
+}
+
+//HasPermission reports whether any of the users roles grants the permission
+func HasPermission(userID uint, permission string, database Database) bool {
+	permissions, err := database.getUserPermissions(userID)
+	if err != nil {
+		log.Print(err)
+		return false
+	}
+	for _, p := range permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+//AssignRole gives a user a role. Tokens pick up the role when they are
+//next refreshed.
+func AssignRole(actorID, userID uint, role string, database Database) error {
+	if role == RoleUser {
+		return errors.New("Every user has the user role")
+	}
+	user, err := database.getUserByID(userID)
+	if err != nil || !user.DeletedAt.IsZero() {
+		return errors.New("User not found")
+	}
+	added, err := database.addUserRole(userID, role, actorID)
+	if err != nil {
+		return err
+	}
+	if !added {
+		return checkRole(role, database)
+	}
+	audit(AuditEvent{Type: AuditRoleGranted, UserID: userID, ActorID: actorID, Detail: role})
+	return nil
+}
+
+//RemoveRole takes a role away from a user. Tokens lose the role when they
+//are next refreshed.
+func RemoveRole(actorID, userID uint, role string, database Database) error {
+	if role == RoleUser {
+		return errors.New("Every user has the user role")
+	}
+	removed, err := database.removeUserRole(userID, role)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return checkRole(role, database)
+	}
+	audit(AuditEvent{Type: AuditRoleRevoked, UserID: userID, ActorID: actorID, Detail: role})
+	return nil
+}
+
+//GrantPermission adds a permission to a role
+func GrantPermission(actorID uint, role, permission string, database Database) error {
+	added, err := database.addRolePermission(role, permission)
+	if err != nil {
+		return err
+	}
+	if !added {
+		return checkRolePermission(role, permission, database)
+	}
+	audit(AuditEvent{Type: AuditPermissionGranted, ActorID: actorID, Detail: role + " " + permission})
+	return nil
+}
+
+//RevokePermission removes a permission from a role
+func RevokePermission(actorID uint, role, permission string, database Database) error {
+	removed, err := database.removeRolePermission(role, permission)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return checkRolePermission(role, permission, database)
+	}
+	audit(AuditEvent{Type: AuditPermissionRevoked, ActorID: actorID, Detail: role + " " + permission})
+	return nil
+}
+
+//checkRole tells an unknown role apart from a change that was already made
+func checkRole(role string, database Database) error {
+	roles, err := database.getRoles()
+	if err != nil {
+		return err
+	}
+	for _, r := range roles {
+		if r.Name == role {
+			return nil
+		}
+	}
+	return ErrRoleNotFound
+}
+
+func checkRolePermission(role, permission string, database Database) error {
+	err := checkRole(role, database)
+	if err != nil {
+		return err
+	}
+	permissions, err := database.getPermissions()
+	if err != nil {
+		return err
+	}
+	for _, p := range permissions {
+		if p == permission {
+			return nil
+		}
+	}
+	return ErrPermissionNotFound
+}
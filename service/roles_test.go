@@ -0,0 +1,157 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestRolesInTokens(t *testing.T) {
+	database := &testDatabase{}
+	user := User{Username: "Testname", Password: "testpassword", Email: "test@mail.com"}
+	user.Save(database)
+	auditor := &MemoryAuditor{}
+	AUDITOR = auditor
+	defer func() { AUDITOR = LogAuditor{} }()
+
+	err := AssignRole(1, user.ID, RoleModerator, database)
+	if err != nil {
+		t.Fatalf("Failed to assign role: %v", err)
+	}
+	if len(auditor.Events) != 1 || auditor.Events[0].Type != AuditRoleGranted || auditor.Events[0].Detail != RoleModerator {
+		t.Errorf("Expected the role change to be audited; got %+v", auditor.Events)
+	}
+
+	result, err := UserLogin("Testname", "testpassword", database)
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	claims, err := VerifyKey(result.Key)
+	if err != nil {
+		t.Fatalf("Failed to verify key: %v", err)
+	}
+	if len(claims.Roles) != 2 || claims.Roles[0] != RoleUser || claims.Roles[1] != RoleModerator {
+		t.Errorf("Expected user and moderator roles in the key; got %v", claims.Roles)
+	}
+	validation := ValidateTokenKey(result.Key, database)
+	if len(validation.Roles) != 2 {
+		t.Errorf("Expected validation to return the roles; got %v", validation.Roles)
+	}
+
+	RemoveRole(1, user.ID, RoleModerator, database)
+	refreshed, err := RefreshTokens(result.RefreshToken, database)
+	if err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	claims, _ = VerifyKey(refreshed.Key)
+	if len(claims.Roles) != 1 || claims.Roles[0] != RoleUser {
+		t.Errorf("Expected the removed role to leave on refresh; got %v", claims.Roles)
+	}
+
+	client := Client{Name: "app", RedirectURIs: []string{"https://app.example/callback"}}
+	client.Save(database)
+	pair, err := issueTokenPair(RefreshToken{UserID: user.ID, ClientID: client.ClientID, FamilyID: "family", ExpiresAt: getRefreshExpiresAtTime()}, database)
+	if err != nil {
+		t.Fatalf("Failed to issue client token: %v", err)
+	}
+	claims, _ = VerifyKey(pair.Key)
+	if len(claims.Roles) != 0 {
+		t.Errorf("Tokens issued to a client should not carry roles; got %v", claims.Roles)
+	}
+}
+
+func TestRoleErrors(t *testing.T) {
+	database := &testDatabase{}
+	user := User{Username: "Testname", Password: "testpassword", Email: "test@mail.com"}
+	user.Save(database)
+
+	if err := AssignRole(1, user.ID, "superuser", database); err != ErrRoleNotFound {
+		t.Errorf("Expected unknown role error; got %v", err)
+	}
+	if err := AssignRole(1, 42, RoleAdmin, database); err == nil {
+		t.Error("Expected unknown user error")
+	}
+	if err := RemoveRole(1, user.ID, RoleUser, database); err == nil {
+		t.Error("Expected the user role not to be removable")
+	}
+	if err := AssignRole(1, user.ID, RoleBot, database); err != nil {
+		t.Errorf("Failed to assign role: %v", err)
+	}
+	if err := AssignRole(1, user.ID, RoleBot, database); err != nil {
+		t.Errorf("Assigning a role twice should succeed; got %v", err)
+	}
+	if err := GrantPermission(1, RoleBot, "dm:everyone", database); err != ErrPermissionNotFound {
+		t.Errorf("Expected unknown permission error; got %v", err)
+	}
+	if HasPermission(user.ID, "rooms:moderate", database) {
+		t.Error("Bots should not moderate rooms")
+	}
+	if err := GrantPermission(1, RoleBot, "rooms:moderate", database); err != nil {
+		t.Errorf("Failed to grant permission: %v", err)
+	}
+	if !HasPermission(user.ID, "rooms:moderate", database) {
+		t.Error("Expected the granted permission")
+	}
+	DeleteUser(2, user.ID, database)
+	if err := AssignRole(2, user.ID, RoleModerator, database); err == nil {
+		t.Error("Deleted users should not be given roles")
+	}
+}
+
+func TestRoleHandlers(t *testing.T) {
+	database := &testDatabase{}
+	admin := User{Username: "Testname", Password: "testpassword", Email: "test@mail.com"}
+	admin.Save(database)
+	other := User{Username: "Othername", Password: "otherpassword", Email: "other@mail.com"}
+	other.Save(database)
+	database.addUserRole(admin.ID, RoleAdmin, 0)
+	server := MakeTestServer(database)
+	adminTokens, _ := UserLogin("Testname", "testpassword", database)
+	otherTokens, _ := UserLogin("Othername", "otherpassword", database)
+
+	recorder := bearerRequest(server, "PUT", "/auth/users/1/roles/moderator", otherTokens.Key, "")
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected %v; received %v", http.StatusForbidden, recorder.Code)
+	}
+	recorder = bearerRequest(server, "GET", "/auth/users/1/roles", otherTokens.Key, "")
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Users should not see the roles of others; received %v", recorder.Code)
+	}
+
+	recorder = bearerRequest(server, "PUT", "/auth/users/2/roles/moderator", adminTokens.Key, "")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected %v; received %v %s", http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+	recorder = bearerRequest(server, "GET", "/auth/users/2/roles", otherTokens.Key, "")
+	var body struct {
+		Roles       []string `json:"roles"`
+		Permissions []string `json:"permissions"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &body)
+	if recorder.Code != http.StatusOK || len(body.Roles) != 2 || !containsString(body.Permissions, "rooms:moderate") {
+		t.Errorf("Expected users to see their own roles; got %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = bearerRequest(server, "PUT", "/auth/roles/moderator/permissions/users:manage", adminTokens.Key, "")
+	if recorder.Code != http.StatusOK || !HasPermission(other.ID, "users:manage", database) {
+		t.Errorf("Expected the permission to be granted; got %d", recorder.Code)
+	}
+	recorder = bearerRequest(server, "DELETE", "/auth/users/2/roles/moderator", adminTokens.Key, "")
+	if recorder.Code != http.StatusOK || HasPermission(other.ID, "users:manage", database) {
+		t.Errorf("Expected the role to be removed; got %d", recorder.Code)
+	}
+
+	recorder = bearerRequest(server, "GET", "/auth/roles", otherTokens.Key, "")
+	var roles []Role
+	json.Unmarshal(recorder.Body.Bytes(), &roles)
+	if recorder.Code != http.StatusOK || len(roles) != len(testRoles) {
+		t.Errorf("Expected the roles to be listed; got %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = bearerRequest(server, "GET", "/auth/token/"+adminTokens.Key, "", "")
+	var validation TokenValidation
+	json.Unmarshal(recorder.Body.Bytes(), &validation)
+	if validation.Token == nil || !containsString(validation.Roles, RoleAdmin) {
+		t.Errorf("Expected the validator to return the roles; got %s", recorder.Body.String())
+	}
+}
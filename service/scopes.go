@@ -0,0 +1,103 @@
+package service
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+)
+
+//Chat scopes narrow a user token to what an embedded widget needs. Room
+//scopes are room:<id>:read and room:<id>:write, chat-auth does not know
+//about rooms so the chat servers check membership themselves.
+const (
+	ScopeDMRead = "dm:read"
+	ScopeDMSend = "dm:send"
+)
+
+//Room scope access levels
+const (
+	RoomAccessRead  = "read"
+	RoomAccessWrite = "write"
+)
+
+//Scoped token lifetimes, a scoped token never outlives the token it was exchanged from
+const (
+	defaultScopedTokenTTL = 5 * time.Minute
+	maxScopedTokenTTL     = 15 * time.Minute
+)
+
+//ErrScopeNotAllowed is returned when a token asks for more than it holds
+var ErrScopeNotAllowed = errors.New("Requested scope is not allowed for this token")
+
+var roomScopePattern = regexp.MustCompile(`^room:[A-Za-z0-9_-]{1,64}:(read|write)$`)
+
+//RoomScope is the scope for access to a room
+func RoomScope(roomID, access string) string {
+	return "room:" + roomID + ":" + access
+}
+
+func isChatScope(scope string) bool {
+	return scope == ScopeDMRead || scope == ScopeDMSend || roomScopePattern.MatchString(scope)
+}
+
+//isScoped reports whether the token was narrowed to chat scopes by ExchangeScopedToken
+func (t *Token) isScoped() bool {
+	for _, scope := range strings.Fields(t.Scope) {
+		if isChatScope(scope) {
+			return t.ClientID == ""
+		}
+	}
+	return false
+}
+
+//ExchangeScopedToken issues a short lived token limited to chat scopes for the
+//user of a token. A scoped token can be exchanged again for a narrower one.
+//The new token joins the token family, so it is revoked with its session.
+func ExchangeScopedToken(token Token, scope string, ttl time.Duration, database Database) (Token, error) {
+	if token.ClientID != "" {
+		return Token{}, errors.New("Token was issued to a client")
+	}
+	if token.Scope == UnverifiedScope {
+		return Token{}, ErrEmailNotVerified
+	}
+	scope = normalizeScope(scope)
+	if scope == "" {
+		return Token{}, errors.New("No scope requested")
+	}
+	for _, s := range strings.Fields(scope) {
+		if !isChatScope(s) {
+			return Token{}, errors.New("Invalid scope " + s)
+		}
+	}
+	if token.isScoped() && !scopeCovers(token.Scope, scope) {
+		return Token{}, ErrScopeNotAllowed
+	}
+	if ttl <= 0 {
+		ttl = defaultScopedTokenTTL
+	}
+	if ttl > maxScopedTokenTTL {
+		ttl = maxScopedTokenTTL
+	}
+	scoped := Token{
+		UserID:    token.UserID,
+		Kind:      TokenKindUser,
+		Scope:     scope,
+		FamilyID:  token.FamilyID,
+		ExpiresAt: time.Now().Add(ttl).Unix(),
+	}
+	if scoped.ExpiresAt > token.ExpiresAt {
+		scoped.ExpiresAt = token.ExpiresAt
+	}
+	key, err := generateKey(scoped)
+	if err != nil {
+		return Token{}, err
+	}
+	scoped.Key = key
+	err = scoped.Save(database)
+	if err != nil {
+		return Token{}, err
+	}
+	scoped.cache(database)
+	return scoped, nil
+}
@@ -0,0 +1,98 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestExchangeScopedToken(t *testing.T) {
+	database := &testDatabase{}
+	user := saveTestUser(database)
+	database.addUserRole(user.ID, RoleAdmin, 0)
+	result, err := UserLogin("Testname", "testpassword", database)
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+
+	scope := RoomScope("123", RoomAccessRead) + " " + RoomScope("123", RoomAccessWrite)
+	scoped, err := ExchangeScopedToken(result.Token, scope+" "+ScopeDMSend, time.Hour, database)
+	if err != nil {
+		t.Fatalf("Exchange failed: %v", err)
+	}
+	if scoped.UserID != user.ID || scoped.FamilyID != result.FamilyID || !scoped.isScoped() {
+		t.Errorf("Unexpected scoped token %+v", scoped)
+	}
+	if scoped.ttl() > int64(maxScopedTokenTTL/time.Second) {
+		t.Errorf("Scoped tokens should be short lived; ttl %d", scoped.ttl())
+	}
+	claims, err := VerifyKey(scoped.Key)
+	if err != nil || claims.Scope != scope+" "+ScopeDMSend || len(claims.Roles) != 0 {
+		t.Errorf("Expected only the scopes in the key; got %+v %v", claims, err)
+	}
+
+	narrower, err := ExchangeScopedToken(scoped, RoomScope("123", RoomAccessRead), 0, database)
+	if err != nil || narrower.Scope != "room:123:read" {
+		t.Errorf("Expected a scoped token to be narrowed; got %v", err)
+	}
+	if _, err = ExchangeScopedToken(narrower, scope, 0, database); err != ErrScopeNotAllowed {
+		t.Errorf("Expected a scoped token not to be widened; got %v", err)
+	}
+	for _, invalid := range []string{"", "openid", "room:123:admin", "room::read", "room:1/2:read"} {
+		if _, err = ExchangeScopedToken(result.Token, invalid, 0, database); err == nil {
+			t.Errorf("Expected scope %q to be refused", invalid)
+		}
+	}
+
+	err = RevokeToken(scoped.Key, database)
+	if err != nil {
+		t.Fatalf("Failed to revoke scoped token: %v", err)
+	}
+	if ValidateTokenKey(result.Key, database).Status != TokenStatusValid {
+		t.Error("Revoking a scoped token should not sign out its session")
+	}
+	revokeTokenFamily(result.FamilyID, database)
+	if ValidateTokenKey(narrower.Key, database).Status != TokenStatusRevoked {
+		t.Error("Signing out a session should revoke its scoped tokens")
+	}
+}
+
+func TestExchangeTokenHandler(t *testing.T) {
+	database := &testDatabase{}
+	saveTestUser(database)
+	server := MakeTestServer(database)
+	result, _ := UserLogin("Testname", "testpassword", database)
+
+	recorder := bearerRequest(server, "POST", "/auth/token/exchange", "", `{"scope": "room:123:read"}`)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected %v; received %v", http.StatusUnauthorized, recorder.Code)
+	}
+	recorder = bearerRequest(server, "POST", "/auth/token/exchange", result.Key, `{"scope": "room:123:delete"}`)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected %v; received %v", http.StatusBadRequest, recorder.Code)
+	}
+
+	recorder = bearerRequest(server, "POST", "/auth/token/exchange", result.Key, `{"scope": "room:123:read", "expires_in": 60}`)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected %v; received %v %s", http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+	var scoped Token
+	json.Unmarshal(recorder.Body.Bytes(), &scoped)
+	if scoped.Scope != "room:123:read" || scoped.ttl() > 60 {
+		t.Errorf("Unexpected scoped token %+v", scoped)
+	}
+
+	recorder = bearerRequest(server, "POST", "/auth/token/exchange", scoped.Key, `{"scope": "room:123:write"}`)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected %v; received %v", http.StatusForbidden, recorder.Code)
+	}
+	recorder = bearerRequest(server, "GET", "/auth/sessions", scoped.Key, "")
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Scoped tokens should not manage the account; received %v", recorder.Code)
+	}
+	recorder = bearerRequest(server, "POST", "/auth/logout", scoped.Key, "")
+	if recorder.Code != http.StatusOK || ValidateTokenKey(result.Key, database).Status != TokenStatusValid {
+		t.Error("Logging out a scoped token should only revoke that token")
+	}
+}
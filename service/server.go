@@ -1,6 +1,8 @@
 package service
 
 import (
+	"log"
+
 	"github.com/gorilla/mux"
 	"github.com/unrolled/render"
 	"github.com/urfave/negroni"
@@ -15,6 +17,11 @@ func NewServer() *negroni.Negroni {
 	n := negroni.Classic()
 	mx := mux.NewRouter()
 	db := &dataHandler{}
+	rules, err := LoadRateLimitRules()
+	if err != nil {
+		log.Fatal("Invalid RATE_LIMITS: ", err)
+	}
+	n.Use(NewRateLimiter(formatter, db, rules))
 	initRoutes(mx, formatter, db)
 	n.UseHandler(mx)
 	return n
@@ -23,5 +30,53 @@ func NewServer() *negroni.Negroni {
 func initRoutes(mx *mux.Router, formatter *render.Render, database Database) {
 	mx.HandleFunc("/auth/register", registerUserHandler(formatter, database)).Methods("POST")
 	mx.HandleFunc("/auth/login", loginUserHandler(formatter, database)).Methods("POST")
+	mx.HandleFunc("/auth/login/mfa", mfaLoginHandler(formatter, database)).Methods("POST")
+	mx.HandleFunc("/auth/login/mfa/webauthn/begin", webAuthnMFABeginHandler(formatter, database)).Methods("POST")
+	mx.HandleFunc("/auth/login/mfa/webauthn/finish", webAuthnMFAFinishHandler(formatter, database)).Methods("POST")
+	mx.HandleFunc("/auth/webauthn/login/begin", webAuthnLoginBeginHandler(formatter, database)).Methods("POST")
+	mx.HandleFunc("/auth/webauthn/login/finish", webAuthnLoginFinishHandler(formatter, database)).Methods("POST")
+	mx.HandleFunc("/auth/webauthn/register/begin", webAuthnRegisterBeginHandler(formatter, database)).Methods("POST")
+	mx.HandleFunc("/auth/webauthn/register/finish", webAuthnRegisterFinishHandler(formatter, database)).Methods("POST")
+	mx.HandleFunc("/auth/webauthn/credentials", webAuthnCredentialsHandler(formatter, database)).Methods("GET")
+	mx.HandleFunc("/auth/webauthn/credentials/{id}", webAuthnDeleteCredentialHandler(formatter, database)).Methods("DELETE")
+	mx.HandleFunc("/auth/mfa/totp/enroll", totpEnrollHandler(formatter, database)).Methods("POST")
+	mx.HandleFunc("/auth/mfa/totp/confirm", totpConfirmHandler(formatter, database)).Methods("POST")
+	mx.HandleFunc("/auth/mfa/totp/disable", totpDisableHandler(formatter, database)).Methods("POST")
+	mx.HandleFunc("/auth/mfa/recovery-codes", recoveryCodesHandler(formatter, database)).Methods("POST")
+	mx.HandleFunc("/auth/password/forgot", forgotPasswordHandler(formatter, database)).Methods("POST")
+	mx.HandleFunc("/auth/password/reset", resetPasswordHandler(formatter, database)).Methods("POST")
+	mx.HandleFunc("/auth/email/verify", verifyEmailHandler(formatter, database)).Methods("GET", "POST")
+	mx.HandleFunc("/auth/email/resend", resendVerificationHandler(formatter, database)).Methods("POST")
+	mx.HandleFunc("/auth/me", meHandler(formatter, database)).Methods("GET")
+	mx.HandleFunc("/auth/me", updateMeHandler(formatter, database)).Methods("PATCH")
+	mx.HandleFunc("/auth/me/password", changePasswordHandler(formatter, database)).Methods("POST")
+	mx.HandleFunc("/auth/me/email", changeEmailHandler(formatter, database)).Methods("POST")
+	mx.HandleFunc("/auth/sessions", listSessionsHandler(formatter, database)).Methods("GET")
+	mx.HandleFunc("/auth/sessions/revoke-others", revokeOtherSessionsHandler(formatter, database)).Methods("POST")
+	mx.HandleFunc("/auth/sessions/{id}", revokeSessionHandler(formatter, database)).Methods("DELETE")
+	mx.HandleFunc("/auth/roles", listRolesHandler(formatter, database)).Methods("GET")
+	mx.HandleFunc("/auth/roles/{role}/permissions/{permission}", rolePermissionHandler(formatter, database)).Methods("PUT", "DELETE")
+	mx.HandleFunc("/auth/users/{id}/roles", userRolesHandler(formatter, database)).Methods("GET")
+	mx.HandleFunc("/auth/users/{id}/roles/{role}", userRoleHandler(formatter, database)).Methods("PUT", "DELETE")
+	mx.HandleFunc("/admin/users", adminSearchUsersHandler(formatter, database)).Methods("GET")
+	mx.HandleFunc("/admin/users/{id}", adminUserHandler(formatter, database)).Methods("GET")
+	mx.HandleFunc("/admin/users/{id}", adminUserActionHandler(formatter, database, DeleteUser, "User succesfully deleted.")).Methods("DELETE")
+	mx.HandleFunc("/admin/users/{id}/restore", adminUserActionHandler(formatter, database, RestoreUser, "User succesfully restored.")).Methods("POST")
+	mx.HandleFunc("/admin/users/{id}/suspend", adminRestrictUserHandler(formatter, database, SuspendUser, "User succesfully suspended.")).Methods("POST")
+	mx.HandleFunc("/admin/users/{id}/unsuspend", adminUserActionHandler(formatter, database, UnsuspendUser, "User succesfully unsuspended.")).Methods("POST")
+	mx.HandleFunc("/admin/users/{id}/ban", adminRestrictUserHandler(formatter, database, BanUser, "User succesfully banned.")).Methods("POST")
+	mx.HandleFunc("/admin/users/{id}/unban", adminUserActionHandler(formatter, database, UnbanUser, "User succesfully unbanned.")).Methods("POST")
+	mx.HandleFunc("/admin/users/{id}/password-reset", adminUserActionHandler(formatter, database, ForcePasswordReset, "Password reset succesfully sent.")).Methods("POST")
+	mx.HandleFunc("/admin/users/{id}/revoke-tokens", adminUserActionHandler(formatter, database, RevokeAllTokens, "Tokens succesfully revoked.")).Methods("POST")
+	mx.HandleFunc("/auth/logout", logoutUserHandler(formatter, database)).Methods("POST")
+	mx.HandleFunc("/auth/token/refresh", refreshTokenHandler(formatter, database)).Methods("POST")
+	mx.HandleFunc("/auth/token/exchange", exchangeTokenHandler(formatter, database)).Methods("POST")
 	mx.HandleFunc("/auth/token/{key}", tokenValidatorHandler(formatter, database)).Methods("GET")
+	mx.HandleFunc("/auth/introspect", introspectionHandler(formatter, database)).Methods("POST")
+	mx.HandleFunc("/oauth/clients", registerClientHandler(formatter, database)).Methods("POST")
+	mx.HandleFunc("/oauth/authorize", authorizeHandler(formatter, database)).Methods("GET", "POST")
+	mx.HandleFunc("/oauth/token", oauthTokenHandler(formatter, database)).Methods("POST")
+	mx.HandleFunc("/userinfo", userInfoHandler(formatter, database)).Methods("GET", "POST")
+	mx.HandleFunc("/.well-known/openid-configuration", openIDConfigurationHandler(formatter)).Methods("GET")
+	mx.HandleFunc("/.well-known/jwks.json", jwksHandler(formatter)).Methods("GET")
 }
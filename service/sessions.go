@@ -0,0 +1,81 @@
+package service
+
+import (
+	"errors"
+	"log"
+	"net/http"
+)
+
+//ActiveSession is a session listed to its user
+type ActiveSession struct {
+	Session
+	Current bool `json:"current"`
+}
+
+//Device describes where a login came from
+type Device struct {
+	Name      string `json:"name,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+	IP        string `json:"ip,omitempty"`
+}
+
+//deviceFromRequest reads the user agent and ip of a request
+func deviceFromRequest(req *http.Request, name string) Device {
+	return Device{Name: name, UserAgent: req.UserAgent(), IP: clientIP(req)}
+}
+
+//startSession records a login on a device for the token family
+func startSession(userID uint, clientID, familyID string, device Device, database Database) error {
+	session := Session{
+		FamilyID:   familyID,
+		UserID:     userID,
+		ClientID:   clientID,
+		DeviceName: device.Name,
+		UserAgent:  device.UserAgent,
+		IP:         device.IP,
+		ExpiresAt:  getRefreshExpiresAtTime(),
+	}
+	return database.addSession(&session)
+}
+
+//ListSessions returns the active sessions of the tokens user, marking the one the token belongs to
+func ListSessions(token Token, database Database) ([]ActiveSession, error) {
+	sessions, err := database.getSessionsByUserID(token.UserID)
+	if err != nil {
+		return nil, err
+	}
+	active := []ActiveSession{}
+	for _, session := range sessions {
+		active = append(active, ActiveSession{Session: session, Current: token.FamilyID != "" && session.FamilyID == token.FamilyID})
+	}
+	return active, nil
+}
+
+//RevokeSession signs the user out of one of their sessions
+func RevokeSession(userID, sessionID uint, database Database) error {
+	session, err := database.getSessionByID(sessionID)
+	if err != nil || session.UserID != userID {
+		return errors.New("Session not found")
+	}
+	return revokeTokenFamily(session.FamilyID, database)
+}
+
+//RevokeOtherSessions signs the user out everywhere except the session the token belongs to
+func RevokeOtherSessions(token Token, database Database) error {
+	keys, err := database.revokeOtherUserTokens(token.UserID, token.FamilyID)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		database.redisDeleteValue(key)
+	}
+	return nil
+}
+
+//touchSession records that the session for a token family was used
+func touchSession(familyID string, database Database) {
+	err := database.touchSession(familyID)
+	if err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,136 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func loginFromDevice(t *testing.T, server http.Handler, userAgent, deviceName string) TokenPair {
+	body, _ := json.Marshal(map[string]string{"username": "Testname", "password": "testpassword", "device_name": deviceName})
+	request, _ := http.NewRequest("POST", "/auth/login", bytes.NewBuffer(body))
+	request.Header.Set("User-Agent", userAgent)
+	request.RemoteAddr = "10.0.0.1:4000"
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Login failed: %d %s", recorder.Code, recorder.Body.String())
+	}
+	var tokens TokenPair
+	json.Unmarshal(recorder.Body.Bytes(), &tokens)
+	return tokens
+}
+
+func TestLoginSessionPerDevice(t *testing.T) {
+	database := &testDatabase{}
+	saveTestUser(database)
+	server := MakeTestServer(database)
+
+	phone := loginFromDevice(t, server, "ChatApp/2.0 (iPhone)", "My phone")
+	desktop := loginFromDevice(t, server, "ChatApp/2.0 (Windows)", "")
+	if phone.Key == desktop.Key || phone.FamilyID == desktop.FamilyID {
+		t.Fatal("Each login should get its own tokens")
+	}
+	if len(database.sessions) != 2 {
+		t.Fatalf("Expected 2 sessions; got %d", len(database.sessions))
+	}
+	session := database.sessions[0]
+	if session.FamilyID != phone.FamilyID || session.DeviceName != "My phone" || session.UserAgent != "ChatApp/2.0 (iPhone)" || session.IP != "10.0.0.1" {
+		t.Errorf("Unexpected session %+v", session)
+	}
+
+	request, _ := http.NewRequest("POST", "/auth/logout", nil)
+	request.Header.Set("Authorization", "Bearer "+phone.Key)
+	server.ServeHTTP(httptest.NewRecorder(), request)
+	if ValidateTokenKey(phone.Key, database).Status != TokenStatusRevoked {
+		t.Error("The phones token should be revoked")
+	}
+	if ValidateTokenKey(desktop.Key, database).Status != TokenStatusValid {
+		t.Error("Logging out the phone should not log out the desktop")
+	}
+	if database.sessions[0].RevokedAt.IsZero() || !database.sessions[1].RevokedAt.IsZero() {
+		t.Error("Only the phones session should be revoked")
+	}
+}
+
+func TestRefreshTouchesSession(t *testing.T) {
+	database := &testDatabase{}
+	saveTestUser(database)
+	result, err := UserLoginFromDevice("Testname", "testpassword", Device{Name: "laptop"}, database)
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	if !database.sessions[0].LastUsedAt.IsZero() {
+		t.Error("A new session should not have been used yet")
+	}
+	_, err = RefreshTokens(result.RefreshToken, database)
+	if err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if database.sessions[0].LastUsedAt.IsZero() {
+		t.Error("Refreshing should record when the session was last used")
+	}
+}
+
+func TestSessionManagementHandlers(t *testing.T) {
+	database := &testDatabase{}
+	saveTestUser(database)
+	other := User{Username: "Othername", Password: "otherpassword", Email: "other@mail.com"}
+	other.Save(database)
+	server := MakeTestServer(database)
+	phone := loginFromDevice(t, server, "phone", "My phone")
+	laptop := loginFromDevice(t, server, "laptop", "Lost laptop")
+	desktop := loginFromDevice(t, server, "desktop", "Desktop")
+	otherTokens, _ := UserLogin("Othername", "otherpassword", database)
+
+	recorder := bearerRequest(server, "GET", "/auth/sessions", desktop.Key, "")
+	var sessions []ActiveSession
+	json.Unmarshal(recorder.Body.Bytes(), &sessions)
+	if recorder.Code != http.StatusOK || len(sessions) != 3 {
+		t.Fatalf("Expected 3 sessions; got %d %s", recorder.Code, recorder.Body.String())
+	}
+	if !sessions[0].Current || sessions[0].DeviceName != "Desktop" || sessions[1].Current {
+		t.Errorf("Expected the newest session to be the current one; got %+v", sessions)
+	}
+
+	otherSession := database.sessions[len(database.sessions)-1].ID
+	recorder = bearerRequest(server, "DELETE", "/auth/sessions/"+strconv.Itoa(int(otherSession)), desktop.Key, "")
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Revoking another users session should 404; got %d", recorder.Code)
+	}
+	laptopSession := database.sessions[1].ID
+	recorder = bearerRequest(server, "DELETE", "/auth/sessions/"+strconv.Itoa(int(laptopSession)), desktop.Key, "")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected 200; got %d", recorder.Code)
+	}
+	if ValidateTokenKey(laptop.Key, database).Status != TokenStatusRevoked {
+		t.Error("The laptops token should be revoked")
+	}
+	if _, ok := database.redis[laptop.Key]; ok {
+		t.Error("The laptops token should be removed from redis")
+	}
+
+	recorder = bearerRequest(server, "POST", "/auth/sessions/revoke-others", desktop.Key, "")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected 200; got %d", recorder.Code)
+	}
+	if ValidateTokenKey(phone.Key, database).Status != TokenStatusRevoked {
+		t.Error("The phones token should be revoked")
+	}
+	if _, ok := database.redis[phone.Key]; ok {
+		t.Error("The phones token should be removed from redis")
+	}
+	if ValidateTokenKey(desktop.Key, database).Status != TokenStatusValid {
+		t.Error("The current session should stay signed in")
+	}
+	if ValidateTokenKey(otherTokens.Key, database).Status != TokenStatusValid {
+		t.Error("Other users should stay signed in")
+	}
+	_, err := RefreshTokens(phone.RefreshToken, database)
+	if err == nil {
+		t.Error("Revoked sessions should not be refreshable")
+	}
+}
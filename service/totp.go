@@ -0,0 +1,176 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//TOTP parameters from RFC 6238, these are the defaults every authenticator app supports
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	totpSkew   = 1
+)
+
+const recoveryCodeCount = 10
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+//TOTPEnrollment is returned when a user starts enrolling an authenticator
+type TOTPEnrollment struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
+//EnrollTOTP creates a new unconfirmed secret for the user. The provisioning
+//uri is meant to be shown as a QR code for authenticator apps.
+func EnrollTOTP(userID uint, database Database) (TOTPEnrollment, error) {
+	user, err := database.getUserByID(userID)
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+	existing, err := database.getTOTPByUserID(userID)
+	if err == nil && existing.isConfirmed() {
+		return TOTPEnrollment{}, errors.New("Two factor authentication is already enabled")
+	}
+	secret := make([]byte, 20)
+	_, err = rand.Read(secret)
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+	totp := TOTP{UserID: userID, Secret: totpEncoding.EncodeToString(secret)}
+	err = database.saveTOTP(&totp)
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+	return TOTPEnrollment{Secret: totp.Secret, ProvisioningURI: provisioningURI(user.Username, totp.Secret)}, nil
+}
+
+//ConfirmTOTP enables two factor authentication once the user proves their
+//authenticator works and returns the one time recovery codes
+func ConfirmTOTP(userID uint, code string, database Database) ([]string, error) {
+	totp, err := database.getTOTPByUserID(userID)
+	if err != nil {
+		return nil, errors.New("Two factor authentication has not been enrolled")
+	}
+	if totp.isConfirmed() {
+		return nil, errors.New("Two factor authentication is already enabled")
+	}
+	ok, err := checkTOTP(totp, code, database)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("Invalid code")
+	}
+	err = database.confirmTOTP(userID)
+	if err != nil {
+		return nil, err
+	}
+	return GenerateRecoveryCodes(userID, database)
+}
+
+//DisableTOTP turns off two factor authentication after checking a code or recovery code
+func DisableTOTP(userID uint, code string, database Database) error {
+	ok, err := VerifySecondFactor(userID, code, database)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("Invalid code")
+	}
+	return database.deleteTOTP(userID)
+}
+
+//GenerateRecoveryCodes replaces the users recovery codes, only their hashes are stored
+func GenerateRecoveryCodes(userID uint, database Database) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(b))
+		codes[i] = code[:8] + "-" + code[8:]
+		hashes[i] = hashKey(normalizeRecoveryCode(codes[i]))
+	}
+	err := database.saveRecoveryCodes(userID, hashes)
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+//VerifySecondFactor checks a TOTP code, or uses up a recovery code, for a
+//user with two factor authentication enabled
+func VerifySecondFactor(userID uint, code string, database Database) (bool, error) {
+	totp, err := database.getTOTPByUserID(userID)
+	if err != nil || !totp.isConfirmed() {
+		return false, errors.New("Two factor authentication is not enabled")
+	}
+	code = strings.TrimSpace(code)
+	if len(code) == totpDigits {
+		return checkTOTP(totp, code, database)
+	}
+	return database.useRecoveryCode(userID, hashKey(normalizeRecoveryCode(code)))
+}
+
+//checkTOTP compares the code against the steps around now. A step can only be
+//used once so a code seen by someone else can not be replayed.
+func checkTOTP(totp TOTP, code string, database Database) (bool, error) {
+	secret, err := totpEncoding.DecodeString(totp.Secret)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now().Unix() / totpPeriod
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if step <= totp.LastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return database.useTOTPStep(totp.UserID, step)
+		}
+	}
+	return false, nil
+}
+
+//totpCode is the HOTP value from RFC 4226 for a time step
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+func provisioningURI(username, secret string) string {
+	issuer := getIssuer()
+	params := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	label := url.PathEscape(issuer + ":" + username)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
@@ -0,0 +1,183 @@
+package service
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func currentTOTPCode(t *testing.T, secret string) string {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatalf("Invalid secret: %v", err)
+	}
+	return totpCode(key, time.Now().Unix()/totpPeriod)
+}
+
+//enableTestTOTP turns on two factor authentication and returns the code used
+//to confirm it and the recovery codes
+func enableTestTOTP(t *testing.T, database *testDatabase, userID uint) (string, []string) {
+	enrollment, err := EnrollTOTP(userID, database)
+	if err != nil {
+		t.Fatalf("Failed to enroll: %v", err)
+	}
+	code := currentTOTPCode(t, enrollment.Secret)
+	codes, err := ConfirmTOTP(userID, code, database)
+	if err != nil {
+		t.Fatalf("Failed to confirm: %v", err)
+	}
+	return code, codes
+}
+
+func TestTOTPCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	vectors := map[int64]string{
+		59 / totpPeriod:         "287082",
+		1111111109 / totpPeriod: "081804",
+		2000000000 / totpPeriod: "279037",
+	}
+	for step, expected := range vectors {
+		if code := totpCode(secret, step); code != expected {
+			t.Errorf("Step %d: expected %s; got %s", step, expected, code)
+		}
+	}
+}
+
+func TestEnrollTOTP(t *testing.T) {
+	database := &testDatabase{}
+	user := User{Username: "Testname", Password: "testpassword", Email: "test@mail.com"}
+	user.Save(database)
+	enrollment, err := EnrollTOTP(user.ID, database)
+	if err != nil {
+		t.Fatalf("Failed to enroll: %v", err)
+	}
+	if !strings.HasPrefix(enrollment.ProvisioningURI, "otpauth://totp/chat-auth:Testname?") || !strings.Contains(enrollment.ProvisioningURI, "secret="+enrollment.Secret) {
+		t.Errorf("Unexpected provisioning uri %s", enrollment.ProvisioningURI)
+	}
+	_, err = ConfirmTOTP(user.ID, "000000", database)
+	if err == nil {
+		t.Error("Wrong code should not confirm enrollment")
+	}
+	codes, err := ConfirmTOTP(user.ID, currentTOTPCode(t, enrollment.Secret), database)
+	if err != nil {
+		t.Fatalf("Failed to confirm: %v", err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Errorf("Expected %d recovery codes; got %d", recoveryCodeCount, len(codes))
+	}
+	_, err = EnrollTOTP(user.ID, database)
+	if err == nil {
+		t.Error("Enrolling again should fail while enabled")
+	}
+}
+
+func TestUserLoginWithTOTP(t *testing.T) {
+	database := &testDatabase{}
+	user := User{Username: "Testname", Password: "testpassword", Email: "test@mail.com"}
+	user.Save(database)
+	code, codes := enableTestTOTP(t, database, user.ID)
+
+	result, err := UserLogin("Testname", "testpassword", database)
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	if !result.MFARequired || result.MFAToken == "" || result.TokenPair != nil {
+		t.Fatal("Expected an MFA challenge instead of tokens")
+	}
+	_, err = CompleteMFALogin(result.MFAToken, code, database)
+	if err == nil {
+		t.Error("A code used to confirm enrollment should not be usable again")
+	}
+	tokens, err := CompleteMFALogin(result.MFAToken, codes[0], database)
+	if err != nil {
+		t.Fatalf("Recovery code should complete login: %v", err)
+	}
+	if tokens.Key == "" || tokens.RefreshToken == "" {
+		t.Error("Expected tokens after completing the challenge")
+	}
+	_, err = CompleteMFALogin(result.MFAToken, codes[1], database)
+	if err == nil {
+		t.Error("A challenge should only be usable once")
+	}
+
+	result, _ = UserLogin("Testname", "testpassword", database)
+	_, err = CompleteMFALogin(result.MFAToken, strings.ToUpper(codes[0]), database)
+	if err == nil {
+		t.Error("A recovery code should only be usable once")
+	}
+}
+
+func TestCompleteMFALoginAttempts(t *testing.T) {
+	database := &testDatabase{}
+	user := User{Username: "Testname", Password: "testpassword", Email: "test@mail.com"}
+	user.Save(database)
+	_, codes := enableTestTOTP(t, database, user.ID)
+	result, _ := UserLogin("Testname", "testpassword", database)
+	for i := 0; i < mfaChallengeAttempts; i++ {
+		CompleteMFALogin(result.MFAToken, "000000", database)
+		clearLoginFailures("Testname", database)
+	}
+	_, err := CompleteMFALogin(result.MFAToken, codes[0], database)
+	if err == nil {
+		t.Error("Challenge should be discarded after too many wrong codes")
+	}
+
+	result, _ = UserLogin("Testname", "testpassword", database)
+	challenge, _ := getMFAChallenge(result.MFAToken, database)
+	for i := 0; i < mfaChallengeAttempts; i++ {
+		countMFAAttempt(result.MFAToken, challenge, database)
+	}
+	if _, err = CompleteMFALogin(result.MFAToken, codes[1], database); err == nil {
+		t.Error("Attempts in flight should count towards the limit")
+	}
+}
+
+func TestCompleteMFALoginLockout(t *testing.T) {
+	database := &testDatabase{}
+	user := User{Username: "Testname", Password: "testpassword", Email: "test@mail.com"}
+	user.Save(database)
+	_, codes := enableTestTOTP(t, database, user.ID)
+	UserLogin("Testname", "wrongpassword", database)
+	UserLogin("Testname", "wrongpassword", database)
+	result, err := UserLogin("Testname", "testpassword", database)
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	if failures := usernameLockout.get("Testname", database); failures.Count != 2 {
+		t.Errorf("Failures should be kept until the second factor passes; got %d", failures.Count)
+	}
+
+	CompleteMFALogin(result.MFAToken, "000000", database)
+	_, err = CompleteMFALogin(result.MFAToken, codes[0], database)
+	if _, ok := err.(*LoginLockedError); !ok {
+		t.Fatalf("Wrong second factors should count towards the lockout; got %v", err)
+	}
+
+	database.redisDeleteValue(usernameLockout.lockKey("Testname"))
+	_, err = CompleteMFALogin(result.MFAToken, codes[0], database)
+	if err != nil {
+		t.Fatalf("Failed to complete login: %v", err)
+	}
+	if failures := usernameLockout.get("Testname", database); failures.Count != 0 {
+		t.Errorf("Failures should be cleared after the second factor passes; got %d", failures.Count)
+	}
+}
+
+func TestDisableTOTP(t *testing.T) {
+	database := &testDatabase{}
+	user := User{Username: "Testname", Password: "testpassword", Email: "test@mail.com"}
+	user.Save(database)
+	_, codes := enableTestTOTP(t, database, user.ID)
+	err := DisableTOTP(user.ID, "000000", database)
+	if err == nil {
+		t.Error("Wrong code should not disable two factor authentication")
+	}
+	err = DisableTOTP(user.ID, codes[0], database)
+	if err != nil {
+		t.Fatalf("Failed to disable: %v", err)
+	}
+	result, err := UserLogin("Testname", "testpassword", database)
+	if err != nil || result.MFARequired {
+		t.Error("Login should not need a second factor once disabled")
+	}
+}
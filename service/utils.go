@@ -1,73 +1,321 @@
 package service
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
-	"os"
+	"log"
 	"time"
-
-	jwt "github.com/dgrijalva/jwt-go"
 )
 
+//ErrRefreshTokenReused is returned when an already rotated refresh token is presented
+var ErrRefreshTokenReused = errors.New("Refresh token has already been used")
+
 //GenerateToken creates token
 func GenerateToken(userID uint) (Token, error) {
-	key, err := generateKey(userID)
+	return generateToken(Token{UserID: userID, Kind: TokenKindUser})
+}
+
+//generateToken signs a key for the user, client and scope of token
+func generateToken(token Token) (Token, error) {
+	token.ExpiresAt = getExpiresAtTime()
+	key, err := generateKey(token)
 	if err != nil {
 		return Token{}, err
 	}
-
-	token := Token{
-		Key:       key,
-		UserID:    userID,
-		ExpiresAt: getExpiresAtTime(),
-	}
-
+	token.Key = key
 	return token, nil
 }
 
-func UserLogin(username, password string, database Database) (Token, error) {
+//UserLogin checks a users password and starts a new token family. Users with
+//two factor authentication get a challenge to finish with CompleteMFALogin.
+func UserLogin(username, password string, database Database) (LoginResult, error) {
+	return UserLoginFromDevice(username, password, Device{}, database)
+}
+
+//UserLoginFromDevice is UserLogin recording the device on the new session.
+//Failed attempts are also counted against the devices ip.
+func UserLoginFromDevice(username, password string, device Device, database Database) (LoginResult, error) {
+	ip := device.IP
+	err := checkLoginLockout(username, ip, database)
+	if err != nil {
+		return LoginResult{}, err
+	}
 	user, err := database.getUserByUsername(username)
 	if err != nil {
-		return Token{}, err
+		recordLoginFailure(username, ip, database)
+		return LoginResult{}, err
 	}
 	canLogin := user.CheckPasswordEqual(password)
 	if canLogin == false {
-		return Token{}, errors.New("Passwords do not match")
+		recordLoginFailure(username, ip, database)
+		return LoginResult{}, errors.New("Passwords do not match")
 	}
-	newToken, err := getTokenOrCreateNewOneIfExpired(user.ID, database)
-	return newToken, err
+	if passwordNeedsRehash(user.Password) {
+		rehashPassword(user, password, database)
+	}
+	_, err = verificationScope(user)
+	if err != nil {
+		return LoginResult{}, err
+	}
+	err = checkAccountActive(user)
+	if err != nil {
+		return LoginResult{}, err
+	}
+	methods := mfaMethods(user.ID, database)
+	if len(methods) > 0 {
+		return newMFAChallenge(user, methods, device, database)
+	}
+	clearLoginFailures(username, database)
+	tokens, err := startTokenFamily(user, device, database)
+	if err != nil {
+		return LoginResult{}, err
+	}
+	return LoginResult{TokenPair: &tokens}, nil
 }
 
-func CheckTokenKey(key string, database Database) (Token, error) {
+//rehashPassword upgrades the stored hash to the current algorithm and
+//parameters. Failing to is logged since the login itself succeeded.
+func rehashPassword(user User, password string, database Database) {
+	user.Password = password
+	err := user.hashPassword()
+	if err == nil {
+		err = database.updateUserPassword(user.ID, user.Password)
+	}
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+//startTokenFamily starts a session on the device and issues the first tokens
+//of its family for a logged in user
+func startTokenFamily(user User, device Device, database Database) (TokenPair, error) {
+	err := checkAccountActive(user)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	scope, err := verificationScope(user)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	familyID, err := randomString(16)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	err = startSession(user.ID, "", familyID, device, database)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	return issueTokenPair(RefreshToken{UserID: user.ID, Scope: scope, FamilyID: familyID, ExpiresAt: getRefreshExpiresAtTime()}, database)
+}
+
+//RefreshTokens rotates a refresh token and issues a new access token.
+//Presenting a refresh token that was already rotated revokes its whole family.
+func RefreshTokens(key string, database Database) (TokenPair, error) {
+	hash := hashKey(key)
+	refreshToken, err := database.getRefreshTokenByHash(hash)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	if refreshToken.isRevoked() {
+		return TokenPair{}, errors.New("Refresh token has been revoked")
+	}
+	if !refreshToken.isValid() {
+		return TokenPair{}, errors.New("Refresh token has expired")
+	}
+	if user, err := database.getUserByID(refreshToken.UserID); err == nil {
+		err = checkAccountActive(user)
+		if err != nil {
+			return TokenPair{}, err
+		}
+		if refreshToken.ClientID == "" {
+			//The user may have verified their email since the last refresh
+			refreshToken.Scope, err = verificationScope(user)
+			if err != nil {
+				return TokenPair{}, err
+			}
+		}
+	}
+	rotated := false
+	if !refreshToken.isRotated() {
+		rotated, err = database.rotateRefreshToken(hash)
+		if err != nil {
+			return TokenPair{}, err
+		}
+	}
+	if !rotated {
+		err = revokeTokenFamily(refreshToken.FamilyID, database)
+		if err != nil {
+			return TokenPair{}, err
+		}
+		return TokenPair{}, ErrRefreshTokenReused
+	}
+	touchSession(refreshToken.FamilyID, database)
+	return issueTokenPair(refreshToken, database)
+}
+
+//Token validation statuses, tokens of suspended or banned users have the
+//account state as their status
+const (
+	TokenStatusValid     = "valid"
+	TokenStatusExpired   = "expired"
+	TokenStatusRevoked   = "revoked"
+	TokenStatusUnknown   = "unknown"
+	TokenStatusSuspended = AccountSuspended
+	TokenStatusBanned    = AccountBanned
+)
+
+//TokenValidation is the result of validating a token key
+type TokenValidation struct {
+	*Token
+	Status  string         `json:"status"`
+	TTL     int64          `json:"ttl"`
+	Account *AccountStatus `json:"account,omitempty"`
+}
+
+//ValidateTokenKey looks up a token key and reports whether it can be used.
+//The roles are the ones signed into the key.
+func ValidateTokenKey(key string, database Database) TokenValidation {
 	token, err := database.getTokenByKey(key)
-	return token, err
+	if err != nil {
+		return TokenValidation{Status: TokenStatusUnknown}
+	}
+	if claims, err := VerifyKey(key); err == nil {
+		token.Roles = claims.Roles
+	}
+	validation := TokenValidation{Token: &token, Status: TokenStatusValid, TTL: token.ttl()}
+	if token.isRevoked() {
+		validation.Status = TokenStatusRevoked
+		validation.TTL = 0
+	} else if !token.isValid() {
+		validation.Status = TokenStatusExpired
+	} else if !token.isClient() {
+		checkTokenAccount(&validation, database)
+	}
+	return validation
 }
 
-func generateKey(userID uint) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"user": userID,
-	})
-	tokenString, err := token.SignedString([]byte(os.Getenv("SECRET_KEY")))
-	return tokenString, err
+//checkTokenAccount fails the validation of a token whose user is suspended or banned
+func checkTokenAccount(validation *TokenValidation, database Database) {
+	user, err := database.getUserByID(validation.UserID)
+	if err != nil {
+		return
+	}
+	status := user.Status.current()
+	if status.State != AccountActive {
+		status = status.public()
+		validation.Status = status.State
+		validation.TTL = 0
+		validation.Account = &status
+	}
 }
 
-func getExpiresAtTime() int64 {
-	now := time.Now().AddDate(0, 2, 0).Unix()
-	return now
+//CheckTokenKey returns the token for a key if it is valid
+func CheckTokenKey(key string, database Database) (Token, error) {
+	validation := ValidateTokenKey(key, database)
+	if validation.Status != TokenStatusValid {
+		return Token{}, errors.New("Token is " + validation.Status)
+	}
+	return *validation.Token, nil
 }
 
-func getTokenOrCreateNewOneIfExpired(userID uint, database Database) (Token, error) {
-	token, err := database.getTokenByUserID(userID)
+//RevokeToken marks a token and its refresh tokens as deleted and removes it from redis.
+//Revoking a scoped token leaves the rest of its family alone.
+func RevokeToken(key string, database Database) error {
+	token, err := database.getTokenByKey(key)
 	if err != nil {
-		return Token{}, err
+		return err
+	}
+	if token.FamilyID != "" && !token.isScoped() {
+		return revokeTokenFamily(token.FamilyID, database)
 	}
-	if token.isValid() {
-		return token, nil
+	err = database.revokeToken(key)
+	if err != nil {
+		return err
 	}
+	return database.redisDeleteValue(key)
+}
 
-	newToken, err := GenerateToken(token.UserID)
+func revokeTokenFamily(familyID string, database Database) error {
+	keys, err := database.revokeTokenFamily(familyID)
 	if err != nil {
-		return Token{}, err
+		return err
 	}
-	err = database.addToken(&newToken)
-	return newToken, err
+	for _, key := range keys {
+		database.redisDeleteValue(key)
+	}
+	return nil
+}
+
+//issueTokenPair creates an access token and a refresh token for the user,
+//client, scope, family and expiry of grant
+func issueTokenPair(grant RefreshToken, database Database) (TokenPair, error) {
+	var roles []string
+	var err error
+	if grant.ClientID == "" {
+		roles, err = UserRoles(grant.UserID, database)
+		if err != nil {
+			return TokenPair{}, err
+		}
+	}
+	token, err := generateToken(Token{
+		UserID:   grant.UserID,
+		Kind:     TokenKindUser,
+		ClientID: grant.ClientID,
+		Scope:    grant.Scope,
+		FamilyID: grant.FamilyID,
+		Roles:    roles,
+	})
+	if err != nil {
+		return TokenPair{}, err
+	}
+	err = token.Save(database)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	token.cache(database)
+
+	key, err := randomString(32)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	refreshToken := RefreshToken{
+		Key:       key,
+		UserID:    grant.UserID,
+		ClientID:  grant.ClientID,
+		Scope:     grant.Scope,
+		FamilyID:  grant.FamilyID,
+		ExpiresAt: grant.ExpiresAt,
+	}
+	err = refreshToken.Save(database)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	return TokenPair{Token: token, RefreshToken: key, RefreshExpiresAt: grant.ExpiresAt}, nil
+}
+
+func randomString(length int) (string, error) {
+	b := make([]byte, length)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func getExpiresAtTime() int64 {
+	now := time.Now().Add(15 * time.Minute).Unix()
+	return now
+}
+
+func getRefreshExpiresAtTime() int64 {
+	now := time.Now().AddDate(0, 2, 0).Unix()
+	return now
 }
@@ -21,35 +21,137 @@ func TestUserLogin(t *testing.T) {
 		t.Error("Expected error because wrong password, got none")
 	}
 
-	correctPasswordToken, err := UserLogin(user.Username, oldPassword, database)
-	if err != nil && correctPasswordToken != database.tokens[0] {
-		t.Error("Expect token from user but got an error and wrong token")
+	correctPasswordTokens, err := UserLogin(user.Username, oldPassword, database)
+	if err != nil {
+		t.Errorf("Expected tokens from user but got an error: %v", err)
+		return
+	}
+	if correctPasswordTokens.Key == "" || correctPasswordTokens.RefreshToken == "" {
+		t.Error("Expected an access token and a refresh token")
+	}
+	if correctPasswordTokens.ExpiresAt >= correctPasswordTokens.RefreshExpiresAt {
+		t.Error("Expected access token to expire before the refresh token")
 	}
 }
 
-func TestGetTokenOrCreateNewOneIfExpired(t *testing.T) {
-	var invalidUserID uint
-	expiresAt := time.Now().AddDate(0, 2, 0).Unix()
-	notExpiredToken := &Token{Key: "testtoken", UserID: 1, ExpiresAt: expiresAt}
-	expiredToken := &Token{Key: "testtoken2", UserID: 2, ExpiresAt: time.Now().AddDate(0, 0, -1).Unix()}
-	invalidUserID = 0
+func TestRefreshTokens(t *testing.T) {
 	database := &testDatabase{}
-	database.addToken(notExpiredToken)
-	database.addToken(expiredToken)
+	tokens, err := issueTokenPair(RefreshToken{UserID: 1, FamilyID: "family", ExpiresAt: getRefreshExpiresAtTime()}, database)
+	if err != nil {
+		t.Fatalf("Failed to issue tokens: %v", err)
+	}
 
-	_, err := getTokenOrCreateNewOneIfExpired(invalidUserID, database)
+	_, err = RefreshTokens("faketoken", database)
+	if err == nil {
+		t.Error("Expected error for unknown refresh token")
+	}
+
+	rotated, err := RefreshTokens(tokens.RefreshToken, database)
+	if err != nil {
+		t.Fatalf("Expected rotation to succeed, got %v", err)
+	}
+	if rotated.RefreshToken == tokens.RefreshToken || rotated.Key == tokens.Key {
+		t.Error("Expected new access and refresh tokens")
+	}
+	if rotated.FamilyID != "family" || rotated.RefreshExpiresAt != tokens.RefreshExpiresAt {
+		t.Error("Expected rotated tokens to stay in the same family")
+	}
+
+	_, err = RefreshTokens(tokens.RefreshToken, database)
+	if err != ErrRefreshTokenReused {
+		t.Errorf("Expected reuse to be detected, got %v", err)
+	}
+	_, err = RefreshTokens(rotated.RefreshToken, database)
+	if err == nil {
+		t.Error("Expected family to be revoked after reuse")
+	}
+	if _, err = CheckTokenKey(rotated.Key, database); err == nil {
+		t.Error("Expected access tokens in the family to be revoked")
+	}
+}
+
+func TestRefreshTokensExpired(t *testing.T) {
+	database := &testDatabase{}
+	tokens, _ := issueTokenPair(RefreshToken{UserID: 1, FamilyID: "family", ExpiresAt: time.Now().AddDate(0, 0, -1).Unix()}, database)
+
+	_, err := RefreshTokens(tokens.RefreshToken, database)
+	if err == nil {
+		t.Error("Expected error for expired refresh token")
+	}
+}
+
+func TestRevokeToken(t *testing.T) {
+	database := &testDatabase{}
+	token := &Token{Key: "testtoken", UserID: 1, ExpiresAt: time.Now().AddDate(0, 2, 0).Unix()}
+	database.addToken(token)
+	database.redisSetValue(token.Key, "1", time.Hour)
+
+	err := RevokeToken("faketoken", database)
 	if err == nil {
 		t.Error("Expected error for not found token")
 	}
 
-	token, err := getTokenOrCreateNewOneIfExpired(1, database)
-	if err != nil && token != database.tokens[0] {
-		t.Error("Expected valid token and no error")
+	err = RevokeToken(token.Key, database)
+	if err != nil {
+		t.Errorf("Expected no error revoking token, got %v", err)
+	}
+	if database.tokens[0].isRevoked() == false {
+		t.Error("Expected token to be revoked")
+	}
+	if _, ok := database.redis[token.Key]; ok {
+		t.Error("Expected token to be removed from redis")
+	}
+
+	_, err = CheckTokenKey(token.Key, database)
+	if err == nil {
+		t.Error("Expected revoked token to fail check")
 	}
 
-	newToken, err := getTokenOrCreateNewOneIfExpired(2, database)
-	if err != nil && len(database.tokens) != 3 && newToken.UserID != 2 {
-		t.Error("Expeted no error and a newly created token")
+	tokens, _ := issueTokenPair(RefreshToken{UserID: 1, FamilyID: "family", ExpiresAt: getRefreshExpiresAtTime()}, database)
+	err = RevokeToken(tokens.Key, database)
+	if err != nil {
+		t.Errorf("Expected no error revoking token, got %v", err)
+	}
+	_, err = RefreshTokens(tokens.RefreshToken, database)
+	if err == nil {
+		t.Error("Expected refresh token to be revoked with its access token")
 	}
+}
 
+func TestValidateTokenKey(t *testing.T) {
+	database := &testDatabase{}
+	database.addToken(&Token{Key: "valid", UserID: 1, ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	database.addToken(&Token{Key: "expired", UserID: 1, ExpiresAt: time.Now().AddDate(0, 0, -1).Unix()})
+	database.addToken(&Token{Key: "revoked", UserID: 1, ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	database.revokeToken("revoked")
+
+	cases := []struct {
+		key    string
+		status string
+	}{
+		{"valid", TokenStatusValid},
+		{"expired", TokenStatusExpired},
+		{"revoked", TokenStatusRevoked},
+		{"unknown", TokenStatusUnknown},
+	}
+	for _, c := range cases {
+		validation := ValidateTokenKey(c.key, database)
+		if validation.Status != c.status {
+			t.Errorf("Expected %s to be %s; received %s", c.key, c.status, validation.Status)
+		}
+		if c.status == TokenStatusValid && (validation.TTL <= 0 || validation.TTL > 3600) {
+			t.Errorf("Expected ttl within an hour; received %d", validation.TTL)
+		}
+		if c.status != TokenStatusValid && validation.TTL != 0 {
+			t.Errorf("Expected no ttl for %s token; received %d", c.status, validation.TTL)
+		}
+		if c.status == TokenStatusUnknown && validation.Token != nil {
+			t.Error("Expected no token for unknown key")
+		}
+
+		_, err := CheckTokenKey(c.key, database)
+		if (err == nil) != (c.status == TokenStatusValid) {
+			t.Errorf("Unexpected CheckTokenKey result for %s: %v", c.key, err)
+		}
+	}
 }
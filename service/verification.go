@@ -0,0 +1,129 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+//Email verification rules, set with EMAIL_VERIFICATION
+const (
+	EmailVerificationOff   = "off"
+	EmailVerificationLimit = "limit"
+	EmailVerificationBlock = "block"
+)
+
+//UnverifiedScope is the only scope given to unverified users under the limit rule
+const UnverifiedScope = "unverified"
+
+//ErrEmailNotVerified is returned when an unverified user logs in under the block rule
+var ErrEmailNotVerified = errors.New("Email address has not been verified")
+
+const emailVerificationAudience = "email_verification"
+
+//verificationLinkTTL is how long email verification and change links work
+const verificationLinkTTL = 24 * time.Hour
+
+//EmailVerificationClaims are signed into the verification link. The email is
+//included so a link stops working once the address is changed. Links that
+//change the address carry the previous one instead.
+type EmailVerificationClaims struct {
+	Email    string `json:"email"`
+	Previous string `json:"previous,omitempty"`
+	jwt.StandardClaims
+}
+
+//SendVerificationEmail emails the user a signed link that verifies their address
+func SendVerificationEmail(user User) error {
+	key, err := generateVerificationKey(user.ID, user.Email, "")
+	if err != nil {
+		return err
+	}
+	body := "Use this link to verify your email address, it expires in one day:\n\n" +
+		os.Getenv("VERIFY_EMAIL_URL") + key + "\n\n" +
+		"If you did not create an account you can ignore this email.\n"
+	return sendMail(user.Email, "Verify your email address", body)
+}
+
+//ResendVerificationEmail sends a new verification link to an unverified address.
+//Unknown and verified emails are not reported so accounts can not be discovered.
+func ResendVerificationEmail(email string, database Database) error {
+	user, err := database.getUserByEmail(email)
+	if err != nil || user.isVerified() {
+		return nil
+	}
+	return SendVerificationEmail(user)
+}
+
+//VerifyEmail checks a verification key and marks the address as verified
+func VerifyEmail(key string, database Database) error {
+	var claims EmailVerificationClaims
+	_, err := jwt.ParseWithClaims(key, &claims, currentKeyring().verificationKey)
+	if err != nil {
+		return errors.New("Invalid verification token")
+	}
+	if !claims.VerifyIssuer(getIssuer(), true) || !claims.VerifyAudience(emailVerificationAudience, true) {
+		return errors.New("Invalid verification token")
+	}
+	userID, err := strconv.ParseUint(claims.Subject, 10, 64)
+	if err != nil {
+		return errors.New("Invalid verification token")
+	}
+	user, err := database.getUserByID(uint(userID))
+	if err != nil || !user.DeletedAt.IsZero() {
+		return errors.New("Invalid verification token")
+	}
+	if claims.Previous != "" {
+		return changeEmail(user, claims.Previous, claims.Email, database)
+	}
+	if user.Email != claims.Email {
+		return errors.New("Invalid verification token")
+	}
+	if user.isVerified() {
+		return nil
+	}
+	_, err = database.verifyUserEmail(user.ID, claims.Email)
+	return err
+}
+
+func generateVerificationKey(userID uint, email, previous string) (string, error) {
+	now := time.Now().Unix()
+	claims := EmailVerificationClaims{
+		Email:    email,
+		Previous: previous,
+		StandardClaims: jwt.StandardClaims{
+			Subject:   strconv.FormatUint(uint64(userID), 10),
+			Issuer:    getIssuer(),
+			Audience:  emailVerificationAudience,
+			IssuedAt:  now,
+			ExpiresAt: time.Now().Add(verificationLinkTTL).Unix(),
+		},
+	}
+	return currentKeyring().sign(claims)
+}
+
+//verificationScope returns the scope tokens for the user are limited to, or
+//ErrEmailNotVerified when the user may not log in at all
+func verificationScope(user User) (string, error) {
+	if user.isVerified() {
+		return "", nil
+	}
+	switch getEmailVerificationRule() {
+	case EmailVerificationBlock:
+		return "", ErrEmailNotVerified
+	case EmailVerificationLimit:
+		return UnverifiedScope, nil
+	}
+	return "", nil
+}
+
+func getEmailVerificationRule() string {
+	rule := os.Getenv("EMAIL_VERIFICATION")
+	if rule == "" {
+		rule = EmailVerificationOff
+	}
+	return rule
+}
@@ -0,0 +1,155 @@
+package service
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func verificationKeyFromMail(t *testing.T, mailer *MemoryMailer, to string) string {
+	message, ok := mailer.Last(to)
+	if !ok {
+		t.Fatalf("No email sent to %s", to)
+	}
+	parts := strings.Split(message.Body, "\n\n")
+	if len(parts) < 2 || parts[1] == "" {
+		t.Fatalf("Verification email has no token: %q", message.Body)
+	}
+	return parts[1]
+}
+
+func TestVerifyEmail(t *testing.T) {
+	mailer := &MemoryMailer{}
+	MAILER = mailer
+	defer func() { MAILER = nil }()
+	database := &testDatabase{}
+	user := User{Username: "Testname", Password: "testpassword", Email: "test@mail.com"}
+	user.Save(database)
+	key := verificationKeyFromMail(t, mailer, "test@mail.com")
+
+	err := VerifyEmail(database.tokens[0].Key, database)
+	if err == nil {
+		t.Error("Access tokens should not verify an email")
+	}
+	err = VerifyEmail(key, database)
+	if err != nil {
+		t.Fatalf("Failed to verify email: %v", err)
+	}
+	if database.users[0].VerifiedAt.IsZero() {
+		t.Error("User should be verified")
+	}
+	err = VerifyEmail(key, database)
+	if err != nil {
+		t.Errorf("Verifying twice should succeed: %v", err)
+	}
+}
+
+func TestVerifyEmailChangedAddress(t *testing.T) {
+	mailer := &MemoryMailer{}
+	MAILER = mailer
+	defer func() { MAILER = nil }()
+	database := &testDatabase{}
+	user := User{Username: "Testname", Password: "testpassword", Email: "test@mail.com"}
+	user.Save(database)
+	key := verificationKeyFromMail(t, mailer, "test@mail.com")
+	database.users[0].Email = "other@mail.com"
+	err := VerifyEmail(key, database)
+	if err == nil {
+		t.Error("Links for a previous address should not verify the new one")
+	}
+}
+
+func TestVerifyEmailDeletedUser(t *testing.T) {
+	mailer := &MemoryMailer{}
+	MAILER = mailer
+	defer func() { MAILER = nil }()
+	database := &testDatabase{}
+	user := User{Username: "Testname", Password: "testpassword", Email: "test@mail.com"}
+	user.Save(database)
+	key := verificationKeyFromMail(t, mailer, "test@mail.com")
+	DeleteUser(2, user.ID, database)
+	if err := VerifyEmail(key, database); err == nil {
+		t.Error("Deleted users should not verify their email")
+	}
+	if !database.users[0].VerifiedAt.IsZero() {
+		t.Error("Deleted user should stay unverified")
+	}
+}
+
+func TestResendVerificationEmail(t *testing.T) {
+	mailer := &MemoryMailer{}
+	MAILER = mailer
+	defer func() { MAILER = nil }()
+	database := &testDatabase{}
+	user := User{Username: "Testname", Password: "testpassword", Email: "test@mail.com"}
+	user.Save(database)
+	ResendVerificationEmail("test@mail.com", database)
+	if len(mailer.Messages) != 2 {
+		t.Errorf("Expected 2 emails; got %d", len(mailer.Messages))
+	}
+	VerifyEmail(verificationKeyFromMail(t, mailer, "test@mail.com"), database)
+	ResendVerificationEmail("test@mail.com", database)
+	ResendVerificationEmail("nobody@mail.com", database)
+	if len(mailer.Messages) != 2 {
+		t.Error("No email should be sent to verified or unknown addresses")
+	}
+}
+
+func TestUserLoginEmailVerificationRule(t *testing.T) {
+	mailer := &MemoryMailer{}
+	MAILER = mailer
+	defer func() { MAILER = nil }()
+	defer os.Unsetenv("EMAIL_VERIFICATION")
+	database := &testDatabase{}
+	user := User{Username: "Testname", Password: "testpassword", Email: "test@mail.com"}
+	user.Save(database)
+
+	os.Setenv("EMAIL_VERIFICATION", EmailVerificationBlock)
+	_, err := UserLogin("Testname", "testpassword", database)
+	if err != ErrEmailNotVerified {
+		t.Errorf("Expected ErrEmailNotVerified; got %v", err)
+	}
+
+	os.Setenv("EMAIL_VERIFICATION", EmailVerificationLimit)
+	tokens, err := UserLogin("Testname", "testpassword", database)
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	if tokens.Scope != UnverifiedScope {
+		t.Errorf("Expected scope %s; got %q", UnverifiedScope, tokens.Scope)
+	}
+
+	VerifyEmail(verificationKeyFromMail(t, mailer, "test@mail.com"), database)
+	os.Setenv("EMAIL_VERIFICATION", EmailVerificationBlock)
+	tokens, err = UserLogin("Testname", "testpassword", database)
+	if err != nil {
+		t.Fatalf("Verified users should be able to login: %v", err)
+	}
+	if tokens.Scope != "" {
+		t.Errorf("Verified users should not be limited; got %q", tokens.Scope)
+	}
+}
+
+func TestRefreshTokensAfterEmailVerification(t *testing.T) {
+	mailer := &MemoryMailer{}
+	MAILER = mailer
+	defer func() { MAILER = nil }()
+	defer os.Unsetenv("EMAIL_VERIFICATION")
+	os.Setenv("EMAIL_VERIFICATION", EmailVerificationLimit)
+	database := &testDatabase{}
+	user := User{Username: "Testname", Password: "testpassword", Email: "test@mail.com"}
+	user.Save(database)
+
+	tokens, err := UserLogin("Testname", "testpassword", database)
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	VerifyEmail(verificationKeyFromMail(t, mailer, "test@mail.com"), database)
+	refreshed, err := RefreshTokens(tokens.RefreshToken, database)
+	if err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if refreshed.Scope != "" {
+		t.Errorf("Expected the refreshed token to be unrestricted; got %q", refreshed.Scope)
+	}
+}
@@ -0,0 +1,548 @@
+package service
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"strconv"
+	"time"
+)
+
+//WebAuthn ceremonies a challenge can be used for
+const (
+	webAuthnCeremonyRegistration = "registration"
+	webAuthnCeremonyLogin        = "login"
+	webAuthnCeremonyMFA          = "mfa"
+)
+
+//COSE algorithms accepted for credentials
+const (
+	coseAlgES256 = -7
+	coseAlgEdDSA = -8
+	coseAlgRS256 = -257
+)
+
+//Authenticator data flags
+const (
+	authenticatorFlagUserPresent  = 0x01
+	authenticatorFlagUserVerified = 0x04
+	authenticatorFlagAttested     = 0x40
+)
+
+const webAuthnTimeout = 5 * time.Minute
+
+//WebAuthnRelyingParty identifies this service to authenticators
+type WebAuthnRelyingParty struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name"`
+}
+
+//WebAuthnUser is the account a credential is created for
+type WebAuthnUser struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+//WebAuthnCredentialParameter is an accepted credential algorithm
+type WebAuthnCredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int64  `json:"alg"`
+}
+
+//WebAuthnCredentialDescriptor refers to an existing credential
+type WebAuthnCredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+//WebAuthnAuthenticatorSelection states what authenticators are wanted
+type WebAuthnAuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+//WebAuthnCreationOptions are passed to navigator.credentials.create. Binary
+//values are base64url encoded.
+type WebAuthnCreationOptions struct {
+	Challenge              string                         `json:"challenge"`
+	RP                     WebAuthnRelyingParty           `json:"rp"`
+	User                   WebAuthnUser                   `json:"user"`
+	PubKeyCredParams       []WebAuthnCredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                          `json:"timeout"`
+	ExcludeCredentials     []WebAuthnCredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection WebAuthnAuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                         `json:"attestation"`
+}
+
+//WebAuthnRequestOptions are passed to navigator.credentials.get
+type WebAuthnRequestOptions struct {
+	Challenge        string                         `json:"challenge"`
+	Timeout          int64                          `json:"timeout"`
+	RPID             string                         `json:"rpId"`
+	AllowCredentials []WebAuthnCredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                         `json:"userVerification"`
+}
+
+//WebAuthnAuthenticatorResponse holds the base64url encoded authenticator output
+type WebAuthnAuthenticatorResponse struct {
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AttestationObject string `json:"attestationObject,omitempty"`
+	AuthenticatorData string `json:"authenticatorData,omitempty"`
+	Signature         string `json:"signature,omitempty"`
+	UserHandle        string `json:"userHandle,omitempty"`
+}
+
+//WebAuthnCredentialResponse is the PublicKeyCredential returned by the browser
+type WebAuthnCredentialResponse struct {
+	ID       string                        `json:"id"`
+	Type     string                        `json:"type"`
+	Response WebAuthnAuthenticatorResponse `json:"response"`
+}
+
+type webAuthnSession struct {
+	UserID    uint   `json:"user_id"`
+	Ceremony  string `json:"ceremony"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+type collectedClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type authenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+//BeginWebAuthnRegistration starts adding a passkey or security key to the users account
+func BeginWebAuthnRegistration(userID uint, database Database) (WebAuthnCreationOptions, error) {
+	user, err := database.getUserByID(userID)
+	if err != nil {
+		return WebAuthnCreationOptions{}, err
+	}
+	credentials, err := database.getWebAuthnCredentialsByUserID(userID)
+	if err != nil {
+		return WebAuthnCreationOptions{}, err
+	}
+	challenge, err := newWebAuthnSession(userID, webAuthnCeremonyRegistration, database)
+	if err != nil {
+		return WebAuthnCreationOptions{}, err
+	}
+	return WebAuthnCreationOptions{
+		Challenge: challenge,
+		RP:        WebAuthnRelyingParty{ID: getWebAuthnRPID(), Name: getWebAuthnRPName()},
+		User: WebAuthnUser{
+			ID:          encodeSegment(webAuthnUserHandle(user.ID)),
+			Name:        user.Username,
+			DisplayName: user.Username,
+		},
+		PubKeyCredParams: []WebAuthnCredentialParameter{
+			{Type: "public-key", Alg: coseAlgES256},
+			{Type: "public-key", Alg: coseAlgEdDSA},
+			{Type: "public-key", Alg: coseAlgRS256},
+		},
+		Timeout:                int64(webAuthnTimeout / time.Millisecond),
+		ExcludeCredentials:     credentialDescriptors(credentials),
+		AuthenticatorSelection: WebAuthnAuthenticatorSelection{ResidentKey: "preferred", UserVerification: "preferred"},
+		Attestation:            "none",
+	}, nil
+}
+
+//FinishWebAuthnRegistration checks the authenticators response and stores the
+//new credential. Only the none attestation format is accepted.
+func FinishWebAuthnRegistration(userID uint, name string, response WebAuthnCredentialResponse, database Database) (WebAuthnCredential, error) {
+	_, clientData, err := parseClientData(response.Response.ClientDataJSON, "webauthn.create")
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	session, err := takeWebAuthnSession(clientData.Challenge, webAuthnCeremonyRegistration, database)
+	if err != nil || session.UserID != userID {
+		return WebAuthnCredential{}, errors.New("Unknown or expired challenge")
+	}
+	attestationObject, err := decodeWebAuthnBase64(response.Response.AttestationObject)
+	if err != nil {
+		return WebAuthnCredential{}, errors.New("Invalid attestation object")
+	}
+	item, _, err := decodeCBOR(attestationObject)
+	attestation, ok := item.(map[interface{}]interface{})
+	if err != nil || !ok {
+		return WebAuthnCredential{}, errors.New("Invalid attestation object")
+	}
+	statement, _ := attestation["attStmt"].(map[interface{}]interface{})
+	if attestation["fmt"] != "none" || len(statement) != 0 {
+		return WebAuthnCredential{}, errors.New("Only none attestation is supported")
+	}
+	rawAuthData, _ := attestation["authData"].([]byte)
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	if authData.Flags&authenticatorFlagAttested == 0 {
+		return WebAuthnCredential{}, errors.New("Authenticator data has no credential")
+	}
+	err = checkAuthenticatorData(authData, false)
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	_, _, err = parseCOSEKey(authData.PublicKey)
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	credentialID := encodeSegment(authData.CredentialID)
+	if response.ID != credentialID {
+		return WebAuthnCredential{}, errors.New("Credential id does not match")
+	}
+	_, err = database.getWebAuthnCredentialByCredentialID(credentialID)
+	if err == nil {
+		return WebAuthnCredential{}, errors.New("Credential is already registered")
+	}
+	credential := WebAuthnCredential{
+		UserID:       userID,
+		CredentialID: credentialID,
+		PublicKey:    authData.PublicKey,
+		SignCount:    authData.SignCount,
+		Name:         name,
+	}
+	err = database.addWebAuthnCredential(&credential)
+	return credential, err
+}
+
+//BeginWebAuthnLogin starts a passwordless login with a discoverable credential
+func BeginWebAuthnLogin(database Database) (WebAuthnRequestOptions, error) {
+	challenge, err := newWebAuthnSession(0, webAuthnCeremonyLogin, database)
+	if err != nil {
+		return WebAuthnRequestOptions{}, err
+	}
+	return WebAuthnRequestOptions{
+		Challenge:        challenge,
+		Timeout:          int64(webAuthnTimeout / time.Millisecond),
+		RPID:             getWebAuthnRPID(),
+		AllowCredentials: []WebAuthnCredentialDescriptor{},
+		UserVerification: "required",
+	}, nil
+}
+
+//FinishWebAuthnLogin logs a user in with a passkey. The authenticator must
+//have verified the user since no password is checked.
+func FinishWebAuthnLogin(response WebAuthnCredentialResponse, device Device, database Database) (TokenPair, error) {
+	credential, err := verifyWebAuthnAssertion(response, webAuthnCeremonyLogin, 0, database)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	user, err := database.getUserByID(credential.UserID)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	return startTokenFamily(user, device, database)
+}
+
+//BeginWebAuthnMFA starts using a registered credential as the second factor for an MFA challenge
+func BeginWebAuthnMFA(key string, database Database) (WebAuthnRequestOptions, error) {
+	challenge, err := getMFAChallenge(key, database)
+	if err != nil {
+		return WebAuthnRequestOptions{}, err
+	}
+	credentials, err := database.getWebAuthnCredentialsByUserID(challenge.UserID)
+	if err != nil || len(credentials) == 0 {
+		return WebAuthnRequestOptions{}, errors.New("No security keys registered")
+	}
+	webAuthnChallenge, err := newWebAuthnSession(challenge.UserID, webAuthnCeremonyMFA, database)
+	if err != nil {
+		return WebAuthnRequestOptions{}, err
+	}
+	return WebAuthnRequestOptions{
+		Challenge:        webAuthnChallenge,
+		Timeout:          int64(webAuthnTimeout / time.Millisecond),
+		RPID:             getWebAuthnRPID(),
+		AllowCredentials: credentialDescriptors(credentials),
+		UserVerification: "discouraged",
+	}, nil
+}
+
+//CompleteMFALoginWithWebAuthn finishes an MFA challenge with a security key assertion
+func CompleteMFALoginWithWebAuthn(key string, response WebAuthnCredentialResponse, database Database) (TokenPair, error) {
+	challenge, err := getMFAChallenge(key, database)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	attempts, err := countMFAAttempt(key, challenge, database)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	_, err = verifyWebAuthnAssertion(response, webAuthnCeremonyMFA, challenge.UserID, database)
+	if err != nil {
+		failMFAChallenge(key, challenge, attempts, database)
+		return TokenPair{}, err
+	}
+	return completeMFAChallenge(key, challenge, database)
+}
+
+//verifyWebAuthnAssertion checks an assertion for the ceremony and updates the
+//credentials sign count. A user id of 0 accepts any user, which is only done
+//for passwordless logins and so requires user verification.
+func verifyWebAuthnAssertion(response WebAuthnCredentialResponse, ceremony string, userID uint, database Database) (WebAuthnCredential, error) {
+	clientDataJSON, clientData, err := parseClientData(response.Response.ClientDataJSON, "webauthn.get")
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	session, err := takeWebAuthnSession(clientData.Challenge, ceremony, database)
+	if err != nil || session.UserID != userID {
+		return WebAuthnCredential{}, errors.New("Unknown or expired challenge")
+	}
+	credential, err := database.getWebAuthnCredentialByCredentialID(response.ID)
+	if err != nil || (userID != 0 && credential.UserID != userID) {
+		return WebAuthnCredential{}, errors.New("Unknown credential")
+	}
+	if response.Response.UserHandle != "" || userID == 0 {
+		handle, err := decodeWebAuthnBase64(response.Response.UserHandle)
+		if err != nil || !bytes.Equal(handle, webAuthnUserHandle(credential.UserID)) {
+			return WebAuthnCredential{}, errors.New("User handle does not match credential")
+		}
+	}
+	rawAuthData, err := decodeWebAuthnBase64(response.Response.AuthenticatorData)
+	if err != nil {
+		return WebAuthnCredential{}, errors.New("Invalid authenticator data")
+	}
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	err = checkAuthenticatorData(authData, userID == 0)
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	signature, err := decodeWebAuthnBase64(response.Response.Signature)
+	if err != nil {
+		return WebAuthnCredential{}, errors.New("Invalid signature")
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	err = verifyCOSESignature(credential.PublicKey, append(rawAuthData, clientDataHash[:]...), signature)
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	if (authData.SignCount != 0 || credential.SignCount != 0) && authData.SignCount <= credential.SignCount {
+		return WebAuthnCredential{}, errors.New("Sign count did not increase, the authenticator may be cloned")
+	}
+	ok, err := database.updateWebAuthnSignCount(credential.ID, credential.SignCount, authData.SignCount)
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	if !ok {
+		return WebAuthnCredential{}, errors.New("Credential was used concurrently")
+	}
+	credential.SignCount = authData.SignCount
+	return credential, nil
+}
+
+func newWebAuthnSession(userID uint, ceremony string, database Database) (string, error) {
+	challenge, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+	session := webAuthnSession{UserID: userID, Ceremony: ceremony, ExpiresAt: time.Now().Add(webAuthnTimeout).Unix()}
+	value, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+	err = database.redisSetValue(webAuthnSessionKey(challenge), string(value), webAuthnTimeout)
+	return challenge, err
+}
+
+//takeWebAuthnSession returns the session for a challenge and deletes it so it can only be used once
+func takeWebAuthnSession(challenge, ceremony string, database Database) (webAuthnSession, error) {
+	var session webAuthnSession
+	value, err := database.redisTakeValue(webAuthnSessionKey(challenge))
+	if err != nil || value == "" {
+		return session, errors.New("Unknown challenge")
+	}
+	err = json.Unmarshal([]byte(value), &session)
+	if err != nil || session.Ceremony != ceremony || session.ExpiresAt < time.Now().Unix() {
+		return session, errors.New("Unknown challenge")
+	}
+	return session, nil
+}
+
+func webAuthnSessionKey(challenge string) string {
+	return "webauthn:" + challenge
+}
+
+func parseClientData(encoded, ceremonyType string) ([]byte, collectedClientData, error) {
+	var clientData collectedClientData
+	clientDataJSON, err := decodeWebAuthnBase64(encoded)
+	if err != nil {
+		return nil, clientData, errors.New("Invalid client data")
+	}
+	err = json.Unmarshal(clientDataJSON, &clientData)
+	if err != nil || clientData.Type != ceremonyType {
+		return nil, clientData, errors.New("Invalid client data")
+	}
+	if clientData.Origin != getWebAuthnOrigin() {
+		return nil, clientData, errors.New("Client data has an invalid origin")
+	}
+	return clientDataJSON, clientData, nil
+}
+
+func parseAuthenticatorData(data []byte) (authenticatorData, error) {
+	var authData authenticatorData
+	if len(data) < 37 {
+		return authData, errors.New("Invalid authenticator data")
+	}
+	authData.RPIDHash = data[:32]
+	authData.Flags = data[32]
+	authData.SignCount = binary.BigEndian.Uint32(data[33:37])
+	if authData.Flags&authenticatorFlagAttested == 0 {
+		return authData, nil
+	}
+	rest := data[37:]
+	if len(rest) < 18 {
+		return authData, errors.New("Invalid attested credential data")
+	}
+	length := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < length {
+		return authData, errors.New("Invalid attested credential data")
+	}
+	authData.CredentialID = rest[:length]
+	rest = rest[length:]
+	_, after, err := decodeCBOR(rest)
+	if err != nil {
+		return authData, errors.New("Invalid credential public key")
+	}
+	authData.PublicKey = rest[:len(rest)-len(after)]
+	return authData, nil
+}
+
+func checkAuthenticatorData(authData authenticatorData, userVerification bool) error {
+	rpIDHash := sha256.Sum256([]byte(getWebAuthnRPID()))
+	if !bytes.Equal(authData.RPIDHash, rpIDHash[:]) {
+		return errors.New("Authenticator data is for another relying party")
+	}
+	if authData.Flags&authenticatorFlagUserPresent == 0 {
+		return errors.New("User was not present")
+	}
+	if userVerification && authData.Flags&authenticatorFlagUserVerified == 0 {
+		return errors.New("User was not verified")
+	}
+	return nil
+}
+
+//parseCOSEKey reads an EC2 P-256, OKP Ed25519 or RSA public key
+func parseCOSEKey(data []byte) (crypto.PublicKey, int64, error) {
+	item, _, err := decodeCBOR(data)
+	key, ok := item.(map[interface{}]interface{})
+	if err != nil || !ok {
+		return nil, 0, errors.New("Invalid credential public key")
+	}
+	alg, _ := key[int64(3)].(int64)
+	x, _ := key[int64(-2)].([]byte)
+	switch alg {
+	case coseAlgES256:
+		y, _ := key[int64(-3)].([]byte)
+		if key[int64(1)] != int64(2) || key[int64(-1)] != int64(1) || len(x) != 32 || len(y) != 32 {
+			break
+		}
+		publicKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !publicKey.Curve.IsOnCurve(publicKey.X, publicKey.Y) {
+			break
+		}
+		return publicKey, alg, nil
+	case coseAlgEdDSA:
+		if key[int64(1)] != int64(1) || key[int64(-1)] != int64(6) || len(x) != ed25519.PublicKeySize {
+			break
+		}
+		return ed25519.PublicKey(x), alg, nil
+	case coseAlgRS256:
+		n, _ := key[int64(-1)].([]byte)
+		e := new(big.Int).SetBytes(x)
+		if key[int64(1)] != int64(3) || len(n) < 256 || !e.IsInt64() || e.Int64() < 3 {
+			break
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(e.Int64())}, alg, nil
+	}
+	return nil, 0, errors.New("Unsupported credential public key")
+}
+
+func verifyCOSESignature(coseKey, data, signature []byte) error {
+	publicKey, _, err := parseCOSEKey(coseKey)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(data)
+	valid := false
+	switch publicKey := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		var sig struct{ R, S *big.Int }
+		rest, err := asn1.Unmarshal(signature, &sig)
+		valid = err == nil && len(rest) == 0 && ecdsa.Verify(publicKey, digest[:], sig.R, sig.S)
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(publicKey, data, signature)
+	case *rsa.PublicKey:
+		valid = rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature) == nil
+	}
+	if !valid {
+		return errors.New("Invalid signature")
+	}
+	return nil
+}
+
+func credentialDescriptors(credentials []WebAuthnCredential) []WebAuthnCredentialDescriptor {
+	descriptors := []WebAuthnCredentialDescriptor{}
+	for _, credential := range credentials {
+		descriptors = append(descriptors, WebAuthnCredentialDescriptor{Type: "public-key", ID: credential.CredentialID})
+	}
+	return descriptors
+}
+
+//webAuthnUserHandle is the opaque user id given to authenticators
+func webAuthnUserHandle(userID uint) []byte {
+	return []byte(strconv.FormatUint(uint64(userID), 10))
+}
+
+func decodeWebAuthnBase64(value string) ([]byte, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return base64.URLEncoding.DecodeString(value)
+	}
+	return decoded, nil
+}
+
+func getWebAuthnRPID() string {
+	rpID := os.Getenv("WEBAUTHN_RP_ID")
+	if rpID == "" {
+		rpID = "localhost"
+	}
+	return rpID
+}
+
+func getWebAuthnRPName() string {
+	name := os.Getenv("WEBAUTHN_RP_NAME")
+	if name == "" {
+		name = getIssuer()
+	}
+	return name
+}
+
+func getWebAuthnOrigin() string {
+	origin := os.Getenv("WEBAUTHN_ORIGIN")
+	if origin == "" {
+		origin = "https://" + getWebAuthnRPID()
+	}
+	return origin
+}
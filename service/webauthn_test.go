@@ -0,0 +1,289 @@
+package service
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"testing"
+)
+
+//encodeTestCBOR encodes the values a software authenticator needs
+func encodeTestCBOR(value interface{}) []byte {
+	header := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n < 256:
+			return []byte{major<<5 | 24, byte(n)}
+		default:
+			b := []byte{major<<5 | 25, 0, 0}
+			binary.BigEndian.PutUint16(b[1:], uint16(n))
+			return b
+		}
+	}
+	switch v := value.(type) {
+	case int:
+		if v < 0 {
+			return header(1, uint64(-1-v))
+		}
+		return header(0, uint64(v))
+	case []byte:
+		return append(header(2, uint64(len(v))), v...)
+	case string:
+		return append(header(3, uint64(len(v))), v...)
+	case map[interface{}]interface{}:
+		var keys []interface{}
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool { return string(encodeTestCBOR(keys[i])) < string(encodeTestCBOR(keys[j])) })
+		out := header(5, uint64(len(v)))
+		for _, key := range keys {
+			out = append(out, encodeTestCBOR(key)...)
+			out = append(out, encodeTestCBOR(v[key])...)
+		}
+		return out
+	}
+	panic("unsupported value")
+}
+
+//softAuthenticator is a software passkey for tests
+type softAuthenticator struct {
+	signer       crypto.Signer
+	credentialID []byte
+	userHandle   string
+	signCount    uint32
+	flags        byte
+}
+
+func newSoftAuthenticator(t *testing.T, ed bool) *softAuthenticator {
+	var signer crypto.Signer
+	var err error
+	if ed {
+		_, signer, err = ed25519.GenerateKey(rand.Reader)
+	} else {
+		signer, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		t.Fatalf("Failed to create key: %v", err)
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &softAuthenticator{signer: signer, credentialID: id, flags: authenticatorFlagUserPresent | authenticatorFlagUserVerified}
+}
+
+func (a *softAuthenticator) coseKey() []byte {
+	switch key := a.signer.Public().(type) {
+	case *ecdsa.PublicKey:
+		return encodeTestCBOR(map[interface{}]interface{}{1: 2, 3: coseAlgES256, -1: 1, -2: padBytes(key.X.Bytes(), 32), -3: padBytes(key.Y.Bytes(), 32)})
+	case ed25519.PublicKey:
+		return encodeTestCBOR(map[interface{}]interface{}{1: 1, 3: coseAlgEdDSA, -1: 6, -2: []byte(key)})
+	}
+	return nil
+}
+
+func (a *softAuthenticator) authData(attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(getWebAuthnRPID()))
+	data := append([]byte{}, rpIDHash[:]...)
+	flags := a.flags
+	if attested {
+		flags |= authenticatorFlagAttested
+	}
+	data = append(data, flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], a.signCount)
+	if attested {
+		data = append(data, make([]byte, 16)...)
+		data = append(data, byte(len(a.credentialID)>>8), byte(len(a.credentialID)))
+		data = append(data, a.credentialID...)
+		data = append(data, a.coseKey()...)
+	}
+	return data
+}
+
+func testClientData(ceremonyType, challenge string) []byte {
+	clientData, _ := json.Marshal(collectedClientData{Type: ceremonyType, Challenge: challenge, Origin: getWebAuthnOrigin()})
+	return clientData
+}
+
+func (a *softAuthenticator) create(options WebAuthnCreationOptions) WebAuthnCredentialResponse {
+	a.userHandle = options.User.ID
+	attestation := encodeTestCBOR(map[interface{}]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[interface{}]interface{}{},
+		"authData": a.authData(true),
+	})
+	return WebAuthnCredentialResponse{
+		ID:   encodeSegment(a.credentialID),
+		Type: "public-key",
+		Response: WebAuthnAuthenticatorResponse{
+			ClientDataJSON:    encodeSegment(testClientData("webauthn.create", options.Challenge)),
+			AttestationObject: encodeSegment(attestation),
+		},
+	}
+}
+
+func (a *softAuthenticator) get(t *testing.T, options WebAuthnRequestOptions) WebAuthnCredentialResponse {
+	a.signCount++
+	authData := a.authData(false)
+	clientData := testClientData("webauthn.get", options.Challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	signed := append(authData, clientDataHash[:]...)
+	var signature []byte
+	var err error
+	if _, ok := a.signer.(ed25519.PrivateKey); ok {
+		signature, err = a.signer.Sign(rand.Reader, signed, crypto.Hash(0))
+	} else {
+		digest := sha256.Sum256(signed)
+		signature, err = a.signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	return WebAuthnCredentialResponse{
+		ID:   encodeSegment(a.credentialID),
+		Type: "public-key",
+		Response: WebAuthnAuthenticatorResponse{
+			ClientDataJSON:    encodeSegment(clientData),
+			AuthenticatorData: encodeSegment(authData),
+			Signature:         encodeSegment(signature),
+			UserHandle:        a.userHandle,
+		},
+	}
+}
+
+func registerSoftAuthenticator(t *testing.T, database *testDatabase, userID uint, ed bool) *softAuthenticator {
+	authenticator := newSoftAuthenticator(t, ed)
+	options, err := BeginWebAuthnRegistration(userID, database)
+	if err != nil {
+		t.Fatalf("Failed to begin registration: %v", err)
+	}
+	if options.Attestation != "none" || options.RP.ID != "localhost" {
+		t.Errorf("Unexpected creation options %+v", options)
+	}
+	_, err = FinishWebAuthnRegistration(userID, "laptop", authenticator.create(options), database)
+	if err != nil {
+		t.Fatalf("Failed to finish registration: %v", err)
+	}
+	return authenticator
+}
+
+func TestWebAuthnPasswordlessLogin(t *testing.T) {
+	for _, ed := range []bool{false, true} {
+		database := &testDatabase{}
+		user := User{Username: "Testname", Password: "testpassword", Email: "test@mail.com"}
+		user.Save(database)
+		authenticator := registerSoftAuthenticator(t, database, user.ID, ed)
+
+		options, _ := BeginWebAuthnLogin(database)
+		tokens, err := FinishWebAuthnLogin(authenticator.get(t, options), Device{}, database)
+		if err != nil {
+			t.Fatalf("Passwordless login failed: %v", err)
+		}
+		if tokens.UserID != user.ID || tokens.Key == "" {
+			t.Error("Expected tokens for the credentials user")
+		}
+		if database.credentials[0].SignCount != 1 {
+			t.Errorf("Expected sign count 1; got %d", database.credentials[0].SignCount)
+		}
+
+		response := authenticator.get(t, options)
+		_, err = FinishWebAuthnLogin(response, Device{}, database)
+		if err == nil {
+			t.Error("A challenge should only be usable once")
+		}
+	}
+}
+
+func TestWebAuthnSignCountCheck(t *testing.T) {
+	database := &testDatabase{}
+	user := User{Username: "Testname", Password: "testpassword", Email: "test@mail.com"}
+	user.Save(database)
+	authenticator := registerSoftAuthenticator(t, database, user.ID, false)
+	options, _ := BeginWebAuthnLogin(database)
+	FinishWebAuthnLogin(authenticator.get(t, options), Device{}, database)
+
+	clone := *authenticator
+	clone.signCount = 0
+	options, _ = BeginWebAuthnLogin(database)
+	_, err := FinishWebAuthnLogin(clone.get(t, options), Device{}, database)
+	if err == nil {
+		t.Error("A sign count that did not increase should be rejected")
+	}
+}
+
+func TestWebAuthnRequiresUserVerification(t *testing.T) {
+	database := &testDatabase{}
+	user := User{Username: "Testname", Password: "testpassword", Email: "test@mail.com"}
+	user.Save(database)
+	authenticator := registerSoftAuthenticator(t, database, user.ID, false)
+	authenticator.flags = authenticatorFlagUserPresent
+
+	options, _ := BeginWebAuthnLogin(database)
+	_, err := FinishWebAuthnLogin(authenticator.get(t, options), Device{}, database)
+	if err == nil {
+		t.Error("Passwordless login should require user verification")
+	}
+
+	result, err := UserLogin("Testname", "testpassword", database)
+	if err != nil || !result.MFARequired || result.MFAMethods[0] != MFAMethodWebAuthn {
+		t.Fatalf("Expected a webauthn MFA challenge; got %+v %v", result, err)
+	}
+	options, err = BeginWebAuthnMFA(result.MFAToken, database)
+	if err != nil || len(options.AllowCredentials) != 1 {
+		t.Fatalf("Failed to begin MFA: %v", err)
+	}
+	tokens, err := CompleteMFALoginWithWebAuthn(result.MFAToken, authenticator.get(t, options), database)
+	if err != nil {
+		t.Fatalf("A security key should work as a second factor: %v", err)
+	}
+	if tokens.UserID != user.ID {
+		t.Error("Expected tokens for the user")
+	}
+}
+
+func TestWebAuthnRegistrationChecks(t *testing.T) {
+	database := &testDatabase{}
+	user := User{Username: "Testname", Password: "testpassword", Email: "test@mail.com"}
+	user.Save(database)
+	authenticator := newSoftAuthenticator(t, false)
+
+	options, _ := BeginWebAuthnRegistration(user.ID, database)
+	_, err := FinishWebAuthnRegistration(user.ID+1, "laptop", authenticator.create(options), database)
+	if err == nil {
+		t.Error("A challenge should only be usable by the user it was issued to")
+	}
+
+	options, _ = BeginWebAuthnRegistration(user.ID, database)
+	response := authenticator.create(options)
+	response.Response.AttestationObject = encodeSegment(encodeTestCBOR(map[interface{}]interface{}{
+		"fmt":      "packed",
+		"attStmt":  map[interface{}]interface{}{"alg": coseAlgES256},
+		"authData": authenticator.authData(true),
+	}))
+	_, err = FinishWebAuthnRegistration(user.ID, "laptop", response, database)
+	if err == nil {
+		t.Error("Only none attestation should be accepted")
+	}
+}
+
+func TestDecodeCBORInvalid(t *testing.T) {
+	inputs := [][]byte{
+		{},
+		{0x5f},
+		{0x59, 0xff, 0xff},
+		{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		{0xa1, 0x80, 0x01},
+	}
+	for _, input := range inputs {
+		_, _, err := decodeCBOR(input)
+		if err == nil {
+			t.Errorf("Expected error decoding %x", input)
+		}
+	}
+}
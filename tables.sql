@@ -5,7 +5,13 @@ create table "users" (
     deleted_at   timestamp with time zone,
     username     text NOT NULL UNIQUE,
     password     text NOT NULL,
-    email        text NOT NULL UNIQUE
+    email        text NOT NULL UNIQUE,
+    verified_at  timestamp with time zone,
+    state             text NOT NULL DEFAULT 'active',
+    state_reason      text NOT NULL DEFAULT '',
+    state_actor_id    integer,
+    state_until       timestamp with time zone,
+    state_changed_at  timestamp with time zone
 );
 
 CREATE TABLE "tokens" (
@@ -15,5 +21,173 @@ CREATE TABLE "tokens" (
     deleted_at  timestamp with time zone,
     key text    NOT NULL UNIQUE,
     user_id     integer,
+    kind        text NOT NULL DEFAULT 'user',
+    client_id   text NOT NULL DEFAULT '',
+    scope       text NOT NULL DEFAULT '',
+    family_id   text NOT NULL DEFAULT '',
     expires_at  bigint
 );
+
+CREATE TABLE "refresh_tokens" (
+    id          serial PRIMARY KEY,
+    created_at  timestamp default current_timestamp,
+    rotated_at  timestamp with time zone,
+    deleted_at  timestamp with time zone,
+    key_hash    text NOT NULL UNIQUE,
+    user_id     integer,
+    client_id   text NOT NULL DEFAULT '',
+    scope       text NOT NULL DEFAULT '',
+    family_id   text NOT NULL,
+    expires_at  bigint
+);
+
+CREATE INDEX refresh_tokens_family_id ON refresh_tokens (family_id);
+CREATE INDEX tokens_family_id ON tokens (family_id);
+
+
+CREATE TABLE "clients" (
+    id          serial PRIMARY KEY,
+    created_at  timestamp default current_timestamp,
+    updated_at  timestamp with time zone,
+    deleted_at  timestamp with time zone,
+    client_id   text NOT NULL UNIQUE,
+    secret_hash text NOT NULL DEFAULT '',
+    name        text NOT NULL,
+    redirect_uris text NOT NULL DEFAULT '',
+    grant_types text NOT NULL DEFAULT 'authorization_code refresh_token',
+    scope       text NOT NULL DEFAULT '',
+    owner_id    integer
+);
+
+CREATE TABLE "authorization_codes" (
+    id          serial PRIMARY KEY,
+    created_at  timestamp default current_timestamp,
+    used_at     timestamp with time zone,
+    code_hash   text NOT NULL UNIQUE,
+    client_id   text NOT NULL,
+    user_id     integer NOT NULL,
+    redirect_uri text NOT NULL,
+    scope       text NOT NULL DEFAULT '',
+    code_challenge text NOT NULL,
+    code_challenge_method text NOT NULL,
+    nonce       text NOT NULL DEFAULT '',
+    family_id   text NOT NULL,
+    expires_at  bigint
+);
+
+CREATE TABLE "consents" (
+    id          serial PRIMARY KEY,
+    created_at  timestamp default current_timestamp,
+    updated_at  timestamp with time zone,
+    user_id     integer NOT NULL,
+    client_id   text NOT NULL,
+    scope       text NOT NULL DEFAULT '',
+    UNIQUE (user_id, client_id)
+);
+
+
+CREATE TABLE "password_resets" (
+    id          serial PRIMARY KEY,
+    created_at  timestamp default current_timestamp,
+    used_at     timestamp with time zone,
+    key_hash    text NOT NULL UNIQUE,
+    user_id     integer NOT NULL,
+    expires_at  bigint
+);
+
+CREATE TABLE "totp_secrets" (
+    id            serial PRIMARY KEY,
+    created_at    timestamp default current_timestamp,
+    confirmed_at  timestamp with time zone,
+    user_id       integer NOT NULL UNIQUE,
+    secret        text NOT NULL,
+    last_step     bigint NOT NULL DEFAULT 0
+);
+
+CREATE TABLE "recovery_codes" (
+    id          serial PRIMARY KEY,
+    created_at  timestamp default current_timestamp,
+    used_at     timestamp with time zone,
+    user_id     integer NOT NULL,
+    code_hash   text NOT NULL
+);
+
+CREATE INDEX recovery_codes_user_id ON recovery_codes (user_id);
+
+CREATE TABLE "webauthn_credentials" (
+    id             serial PRIMARY KEY,
+    created_at     timestamp default current_timestamp,
+    last_used_at   timestamp with time zone,
+    user_id        integer NOT NULL,
+    credential_id  text NOT NULL UNIQUE,
+    public_key     bytea NOT NULL,
+    sign_count     bigint NOT NULL DEFAULT 0,
+    name           text NOT NULL DEFAULT ''
+);
+
+CREATE INDEX webauthn_credentials_user_id ON webauthn_credentials (user_id);
+
+CREATE TABLE "sessions" (
+    id            serial PRIMARY KEY,
+    created_at    timestamp default current_timestamp,
+    last_used_at  timestamp with time zone,
+    revoked_at    timestamp with time zone,
+    family_id     text NOT NULL UNIQUE,
+    user_id       integer NOT NULL,
+    client_id     text NOT NULL DEFAULT '',
+    device_name   text NOT NULL DEFAULT '',
+    user_agent    text NOT NULL DEFAULT '',
+    ip            text NOT NULL DEFAULT '',
+    expires_at    bigint
+);
+
+CREATE INDEX sessions_user_id ON sessions (user_id);
+CREATE TABLE "roles" (
+    id           serial PRIMARY KEY,
+    created_at   timestamp default current_timestamp,
+    name         text NOT NULL UNIQUE,
+    description  text NOT NULL DEFAULT ''
+);
+
+CREATE TABLE "permissions" (
+    id           serial PRIMARY KEY,
+    created_at   timestamp default current_timestamp,
+    name         text NOT NULL UNIQUE,
+    description  text NOT NULL DEFAULT ''
+);
+
+CREATE TABLE "role_permissions" (
+    role_id        integer NOT NULL REFERENCES roles (id) ON DELETE CASCADE,
+    permission_id  integer NOT NULL REFERENCES permissions (id) ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE "user_roles" (
+    created_at  timestamp default current_timestamp,
+    user_id     integer NOT NULL,
+    role_id     integer NOT NULL REFERENCES roles (id) ON DELETE CASCADE,
+    granted_by  integer,
+    PRIMARY KEY (user_id, role_id)
+);
+
+INSERT INTO roles (name, description) VALUES
+    ('user', 'Every registered user'),
+    ('moderator', 'Moderates rooms and messages'),
+    ('admin', 'Manages users, roles and clients'),
+    ('bot', 'Automated account');
+
+INSERT INTO permissions (name, description) VALUES
+    ('roles:manage', 'Assign roles and change their permissions'),
+    ('users:read', 'View other users accounts'),
+    ('users:manage', 'Suspend, delete and restore users'),
+    ('clients:manage', 'Register confidential clients that get tokens of their own'),
+    ('rooms:moderate', 'Moderate any room'),
+    ('messages:delete', 'Delete messages of other users');
+
+INSERT INTO role_permissions (role_id, permission_id)
+    SELECT roles.id, permissions.id FROM roles, permissions
+    WHERE roles.name = 'admin'
+       OR (roles.name = 'moderator' AND permissions.name IN ('users:read', 'rooms:moderate', 'messages:delete'));
+
+-- Grant the first admin by hand:
+-- INSERT INTO user_roles (user_id, role_id) SELECT <user id>, id FROM roles WHERE name = 'admin';